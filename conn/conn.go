@@ -67,6 +67,20 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// PathMTUDiscovery is implemented by Bind objects that support setting the
+// don't-fragment bit on outgoing datagrams and reporting the path MTU
+// learned by the kernel, from local EMSGSIZE errors and received ICMP
+// errors alike.
+type PathMTUDiscovery interface {
+	// SetPathMTUDiscovery enables or disables setting the don't-fragment bit.
+	// When enabled, Send fails with EMSGSIZE for datagrams larger than the
+	// known path MTU.
+	SetPathMTUDiscovery(enabled bool) error
+
+	// PathMTU reports the path MTU towards ep, including IP and UDP headers.
+	PathMTU(ep Endpoint) (int, error)
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst : the remote address of a peer ("endpoint" in uapi terminology)
@@ -67,6 +67,7 @@ type nativeBind struct {
 
 var _ Endpoint = (*NativeEndpoint)(nil)
 var _ Bind = (*nativeBind)(nil)
+var _ PathMTUDiscovery = (*nativeBind)(nil)
 
 func CreateEndpoint(s string) (Endpoint, error) {
 	var end NativeEndpoint
@@ -171,6 +172,91 @@ func (bind *nativeBind) SetMark(value uint32) error {
 	return nil
 }
 
+func (bind *nativeBind) SetPathMTUDiscovery(enabled bool) error {
+	mode4, mode6 := unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	if enabled {
+		mode4, mode6 = unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO
+	}
+
+	if bind.sock6 != -1 {
+		err := unix.SetsockoptInt(
+			bind.sock6,
+			unix.IPPROTO_IPV6,
+			unix.IPV6_MTU_DISCOVER,
+			mode6,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if bind.sock4 != -1 {
+		err := unix.SetsockoptInt(
+			bind.sock4,
+			unix.IPPROTO_IP,
+			unix.IP_MTU_DISCOVER,
+			mode4,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* The path MTU of an unconnected socket cannot be queried,
+ * however the kernel shares its route cache between sockets:
+ * connecting a throwaway socket reveals the path MTU learned so far.
+ * The socket is bound to the sticky source address of the endpoint, if any,
+ * so that the route used for sending is looked up; like sending, it falls back
+ * to the source chosen by the kernel if the address is gone.
+ */
+func (bind *nativeBind) PathMTU(end Endpoint) (int, error) {
+	nend := end.(*NativeEndpoint)
+
+	family, level, option := unix.AF_INET, unix.IPPROTO_IP, unix.IP_MTU
+	if nend.isV6 {
+		family, level, option = unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	if bind.lastMark != 0 {
+		err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(bind.lastMark))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	nend.Lock()
+	if nend.isV6 {
+		dst := *nend.dst6()
+		if src := nend.src6().src; src != [16]byte{} {
+			unix.Bind(fd, &unix.SockaddrInet6{Addr: src, ZoneId: dst.ZoneId})
+		}
+		err = unix.Connect(fd, &dst)
+	} else {
+		dst := *nend.dst4()
+		if src := nend.src4(); src.Src != [4]byte{} {
+			unix.Bind(fd, &unix.SockaddrInet4{Addr: src.Src})
+		}
+		err = unix.Connect(fd, &dst)
+	}
+	nend.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	return unix.GetsockoptInt(fd, level, option)
+}
+
 func closeUnblock(fd int) error {
 	// shutdown to unblock readers and writers
 	unix.Shutdown(fd, unix.SHUT_RDWR)
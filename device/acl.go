@@ -0,0 +1,349 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Per-peer access control lists
+ *
+ * Each rule has the form protocol:cidr[:port[-port]], e.g. tcp:10.0.0.0/8:443,
+ * and describes what the peer may reach through the tunnel, on the local side:
+ * packets received from the peer are matched on their destination,
+ * packets sent to the peer on their source, as replies.
+ *
+ * Rules are evaluated in order, the first matching rule decides.
+ * Unmatched packets are dropped if the list contains any allow rule,
+ * and accepted otherwise. The rules are compiled into a list per protocol,
+ * so that only the rules for the protocol of a packet are evaluated.
+ *
+ * Flows initiated from the local side are not restricted: packets sent to the peer
+ * not allowed as replies are accepted, and their flow recorded for ACLFlowTimeout,
+ * so that the replies of the peer are accepted as well. Of ICMP messages, only echo
+ * requests are recorded, by their identifier, so that only their replies are accepted.
+ * Once ACLFlowTableSize flows are recorded, packets of new flows are dropped.
+ */
+
+const aclProtocolAny = -1
+
+const (
+	ACLFlowTimeout   = time.Minute * 3
+	ACLFlowTableSize = 4096
+)
+
+type aclRule struct {
+	hits     uint64 // first for alignment
+	allow    bool
+	protocol int
+	network  net.IPNet
+	portLow  uint16
+	portHigh uint16 // 0 = any port
+}
+
+type accessList struct {
+	rules        []*aclRule
+	byProtocol   map[uint8][]*aclRule // rules matching each protocol named by a rule, in order
+	anyProtocol  []*aclRule           // rules matching any protocol, for the others
+	defaultAllow bool
+}
+
+/* A flow initiated from the local side,
+ * for ICMP the local port is the echo identifier
+ */
+type aclFlow struct {
+	protocol   uint8
+	local      [net.IPv6len]byte
+	remote     [net.IPv6len]byte
+	localPort  uint16
+	remotePort uint16
+}
+
+type aclFlows struct {
+	sync.Mutex
+	expiry map[aclFlow]time.Time
+}
+
+var aclProtocolNames = map[string]int{
+	"any":    aclProtocolAny,
+	"icmp":   ipProtocolICMPv4,
+	"tcp":    ipProtocolTCP,
+	"udp":    ipProtocolUDP,
+	"icmpv6": ipProtocolICMPv6,
+}
+
+func parseACLRule(value string, allow bool) (*aclRule, error) {
+	rule := &aclRule{allow: allow}
+
+	// split protocol
+
+	i := strings.IndexByte(value, ':')
+	if i < 0 {
+		return nil, errors.New("missing network")
+	}
+	name, rest := value[:i], value[i+1:]
+	if protocol, ok := aclProtocolNames[name]; ok {
+		rule.protocol = protocol
+	} else {
+		protocol, err := strconv.ParseUint(name, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol %q", name)
+		}
+		rule.protocol = int(protocol)
+	}
+
+	// split optional port range following the prefix length
+
+	slash := strings.IndexByte(rest, '/')
+	if slash < 0 {
+		return nil, errors.New("network must be given in CIDR notation")
+	}
+	if i := strings.LastIndexByte(rest, ':'); i > slash {
+		ports := rest[i+1:]
+		rest = rest[:i]
+		if rule.protocol != ipProtocolTCP && rule.protocol != ipProtocolUDP {
+			return nil, errors.New("ports require tcp or udp")
+		}
+		low, high := ports, ports
+		if j := strings.IndexByte(ports, '-'); j >= 0 {
+			low, high = ports[:j], ports[j+1:]
+		}
+		portLow, err := strconv.ParseUint(low, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", low)
+		}
+		portHigh, err := strconv.ParseUint(high, 10, 16)
+		if err != nil || portHigh < portLow || portHigh == 0 {
+			return nil, fmt.Errorf("invalid port %q", high)
+		}
+		rule.portLow = uint16(portLow)
+		rule.portHigh = uint16(portHigh)
+	}
+
+	_, network, err := net.ParseCIDR(rest)
+	if err != nil {
+		return nil, err
+	}
+	rule.network = *network
+	return rule, nil
+}
+
+func (rule *aclRule) String() string {
+	var b strings.Builder
+	if rule.allow {
+		b.WriteString("acl_allow=")
+	} else {
+		b.WriteString("acl_deny=")
+	}
+	protocol := strconv.Itoa(rule.protocol)
+	for name, number := range aclProtocolNames {
+		if number == rule.protocol {
+			protocol = name
+			break
+		}
+	}
+	b.WriteString(protocol)
+	b.WriteByte(':')
+	b.WriteString(rule.network.String())
+	if rule.portHigh != 0 {
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(int(rule.portLow)))
+		if rule.portHigh != rule.portLow {
+			b.WriteByte('-')
+			b.WriteString(strconv.Itoa(int(rule.portHigh)))
+		}
+	}
+	return b.String()
+}
+
+func (rule *aclRule) matches(addr net.IP, protocol uint8, port uint16) bool {
+	if rule.protocol != aclProtocolAny && rule.protocol != int(protocol) {
+		return false
+	}
+	if rule.portHigh != 0 && (port < rule.portLow || port > rule.portHigh) {
+		return false
+	}
+	return rule.network.Contains(addr)
+}
+
+func compileACL(rules []*aclRule, defaultAllow bool) *accessList {
+	acl := &accessList{
+		rules:        rules,
+		byProtocol:   make(map[uint8][]*aclRule),
+		defaultAllow: defaultAllow,
+	}
+	for _, rule := range rules {
+		if rule.protocol == aclProtocolAny {
+			acl.anyProtocol = append(acl.anyProtocol, rule)
+		} else if _, ok := acl.byProtocol[uint8(rule.protocol)]; !ok {
+			acl.byProtocol[uint8(rule.protocol)] = nil
+		}
+	}
+	for protocol := range acl.byProtocol {
+		for _, rule := range rules {
+			if rule.protocol == aclProtocolAny || rule.protocol == int(protocol) {
+				acl.byProtocol[protocol] = append(acl.byProtocol[protocol], rule)
+			}
+		}
+	}
+	return acl
+}
+
+/* Reports whether the address, protocol and port
+ * on the local side of the tunnel are accessible to the peer
+ */
+func (acl *accessList) allows(addr net.IP, protocol uint8, port uint16) bool {
+	rules, ok := acl.byProtocol[protocol]
+	if !ok {
+		rules = acl.anyProtocol
+	}
+	for _, rule := range rules {
+		if rule.portHigh != 0 && (port < rule.portLow || port > rule.portHigh) {
+			continue
+		}
+		if rule.network.Contains(addr) {
+			atomic.AddUint64(&rule.hits, 1)
+			return rule.allow
+		}
+	}
+	return acl.defaultAllow
+}
+
+func newACLFlow(protocol uint8, local net.IP, remote net.IP, localPort uint16, remotePort uint16) (flow aclFlow) {
+	flow.protocol = protocol
+	copy(flow.local[:], local.To16())
+	copy(flow.remote[:], remote.To16())
+	flow.localPort = localPort
+	flow.remotePort = remotePort
+	return
+}
+
+/* Returns the identifier of an ICMP echo request or reply
+ */
+func aclEcho(protocol uint8, packet []byte) (identifier uint16, request bool, ok bool) {
+	_, transport, _, valid := ipTransport(packet)
+	if !valid || len(transport) < icmpHeaderSize {
+		return
+	}
+	switch {
+	case protocol == ipProtocolICMPv4 && transport[0] == icmpv4TypeEchoRequest:
+		request = true
+	case protocol == ipProtocolICMPv6 && transport[0] == icmpv6TypeEchoRequest:
+		request = true
+	case protocol == ipProtocolICMPv4 && transport[0] == icmpv4TypeEchoReply:
+	case protocol == ipProtocolICMPv6 && transport[0] == icmpv6TypeEchoReply:
+	default:
+		return
+	}
+	return binary.BigEndian.Uint16(transport[4:]), request, true
+}
+
+/* Reports whether a packet read from the TUN device may be sent to the peer,
+ * recording the flows initiated from the local side
+ */
+func (peer *Peer) aclAllowsOutbound(acl *accessList, tuple *FiveTuple, packet []byte) bool {
+	if acl.allows(tuple.Src, tuple.Protocol, tuple.SrcPort) {
+		return true
+	}
+	flow := newACLFlow(tuple.Protocol, tuple.Src, tuple.Dst, tuple.SrcPort, tuple.DstPort)
+	if tuple.Protocol == ipProtocolICMPv4 || tuple.Protocol == ipProtocolICMPv6 {
+		identifier, request, ok := aclEcho(tuple.Protocol, packet)
+		if !ok || !request {
+			return true // nothing to reply to
+		}
+		flow.localPort = identifier
+	}
+	now := time.Now()
+
+	flows := &peer.aclFlows
+	flows.Lock()
+	defer flows.Unlock()
+
+	if flows.expiry == nil {
+		flows.expiry = make(map[aclFlow]time.Time)
+	}
+	if _, ok := flows.expiry[flow]; !ok && len(flows.expiry) >= ACLFlowTableSize {
+		for other, expiry := range flows.expiry {
+			if !now.Before(expiry) {
+				delete(flows.expiry, other)
+			}
+		}
+		if len(flows.expiry) >= ACLFlowTableSize {
+			return false // its replies could not be accepted
+		}
+	}
+	flows.expiry[flow] = now.Add(ACLFlowTimeout)
+	return true
+}
+
+/* Reports whether a packet received from the peer may be written to the TUN device
+ */
+func (peer *Peer) aclAllowsInbound(acl *accessList, tuple *FiveTuple, packet []byte) bool {
+	if acl.allows(tuple.Dst, tuple.Protocol, tuple.DstPort) {
+		return true
+	}
+	flow := newACLFlow(tuple.Protocol, tuple.Dst, tuple.Src, tuple.DstPort, tuple.SrcPort)
+	if tuple.Protocol == ipProtocolICMPv4 || tuple.Protocol == ipProtocolICMPv6 {
+		identifier, request, ok := aclEcho(tuple.Protocol, packet)
+		if !ok || request {
+			return false
+		}
+		flow.localPort = identifier
+	}
+
+	flows := &peer.aclFlows
+	flows.Lock()
+	defer flows.Unlock()
+
+	expiry, ok := flows.expiry[flow]
+	return ok && time.Now().Before(expiry)
+}
+
+func (peer *Peer) accessList() *accessList {
+	acl, _ := peer.acl.Load().(*accessList)
+	return acl
+}
+
+/* Appends a rule to the access list of the peer,
+ * keeping the hit counters of existing rules
+ */
+func (peer *Peer) AddACLRule(rule string, allow bool) error {
+	parsed, err := parseACLRule(rule, allow)
+	if err != nil {
+		return err
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	var rules []*aclRule
+	defaultAllow := !allow
+	if old := peer.accessList(); old != nil {
+		rules = append(rules, old.rules...)
+		defaultAllow = old.defaultAllow && !allow
+	}
+	rules = append(rules, parsed)
+	peer.acl.Store(compileACL(rules, defaultAllow))
+	return nil
+}
+
+func (peer *Peer) ClearACL() {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.acl.Store((*accessList)(nil))
+
+	peer.aclFlows.Lock()
+	peer.aclFlows.expiry = nil
+	peer.aclFlows.Unlock()
+}
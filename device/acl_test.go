@@ -0,0 +1,243 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestParseACLRule(t *testing.T) {
+	valid := map[string]string{
+		"tcp:10.0.0.0/8:443":         "acl_allow=tcp:10.0.0.0/8:443",
+		"udp:fd00::/8:1000-2000":     "acl_allow=udp:fd00::/8:1000-2000",
+		"any:0.0.0.0/0":              "acl_allow=any:0.0.0.0/0",
+		"icmpv6:fd00::1/128":         "acl_allow=icmpv6:fd00::1/128",
+		"47:192.168.1.0/24":          "acl_allow=47:192.168.1.0/24",
+		"tcp:192.168.1.7/24:22-22":   "acl_allow=tcp:192.168.1.0/24:22",
+		"udp:fd00::1:2/128:53":       "acl_allow=udp:fd00::1:2/128:53",
+		"tcp:fd00::1:2/128:500-1000": "acl_allow=tcp:fd00::1:2/128:500-1000",
+	}
+	for value, expected := range valid {
+		rule, err := parseACLRule(value, true)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", value, err)
+			continue
+		}
+		if rule.String() != expected {
+			t.Errorf("%q formatted as %q, expected %q", value, rule.String(), expected)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"tcp",
+		"tcp:10.0.0.1",
+		"tcp:10.0.0.0/33",
+		"foo:10.0.0.0/8",
+		"icmp:10.0.0.0/8:80",
+		"tcp:10.0.0.0/8:2000-1000",
+		"tcp:10.0.0.0/8:0",
+		"tcp:10.0.0.0/8:65536",
+	}
+	for _, value := range invalid {
+		if _, err := parseACLRule(value, true); err == nil {
+			t.Errorf("parsed invalid rule %q", value)
+		}
+	}
+}
+
+func TestAccessList(t *testing.T) {
+	peer := &Peer{}
+	if peer.accessList() != nil {
+		t.Fatal("empty peer has access list")
+	}
+
+	assertNil(t, peer.AddACLRule("tcp:10.0.0.5/32:22", false))
+	acl := peer.accessList()
+	if !acl.allows(net.IPv4(10, 0, 0, 6).To4(), ipProtocolTCP, 22) {
+		t.Error("deny-only list must accept unmatched packets")
+	}
+
+	assertNil(t, peer.AddACLRule("tcp:10.0.0.0/24:1-1024", true))
+	acl = peer.accessList()
+	tests := []struct {
+		addr     net.IP
+		protocol uint8
+		port     uint16
+		allowed  bool
+	}{
+		{net.IPv4(10, 0, 0, 5), ipProtocolTCP, 22, false},
+		{net.IPv4(10, 0, 0, 5), ipProtocolTCP, 80, true},
+		{net.IPv4(10, 0, 0, 6), ipProtocolTCP, 22, true},
+		{net.IPv4(10, 0, 0, 6), ipProtocolTCP, 8080, false},
+		{net.IPv4(10, 0, 0, 6), ipProtocolUDP, 53, false},
+		{net.IPv4(10, 0, 1, 6), ipProtocolTCP, 22, false},
+		{net.ParseIP("fd00::1"), ipProtocolTCP, 22, false},
+	}
+	for _, test := range tests {
+		if acl.allows(test.addr, test.protocol, test.port) != test.allowed {
+			t.Errorf("%v proto %d port %d: expected allowed=%v", test.addr, test.protocol, test.port, test.allowed)
+		}
+	}
+
+	if hits := acl.rules[0].hits; hits != 1 {
+		t.Errorf("deny rule has %d hits, expected 1", hits)
+	}
+	if hits := acl.rules[1].hits; hits != 2 {
+		t.Errorf("allow rule has %d hits, expected 2", hits)
+	}
+
+	peer.ClearACL()
+	if peer.accessList() != nil {
+		t.Error("access list not cleared")
+	}
+}
+
+func TestAccessListCompiled(t *testing.T) {
+	peer := &Peer{}
+	assertNil(t, peer.AddACLRule("any:10.0.0.5/32", false))
+	assertNil(t, peer.AddACLRule("udp:10.0.0.0/24:53", true))
+	assertNil(t, peer.AddACLRule("any:10.0.1.0/24", true))
+	acl := peer.accessList()
+
+	// rules are kept in order for their protocol, rules for any protocol apply to all
+
+	if len(acl.byProtocol[ipProtocolUDP]) != 3 || len(acl.anyProtocol) != 2 || len(acl.byProtocol) != 1 {
+		t.Fatalf("unexpected compiled rules: %d udp, %d any", len(acl.byProtocol[ipProtocolUDP]), len(acl.anyProtocol))
+	}
+	tests := []struct {
+		addr     net.IP
+		protocol uint8
+		port     uint16
+		allowed  bool
+	}{
+		{net.IPv4(10, 0, 0, 5), ipProtocolUDP, 53, false},
+		{net.IPv4(10, 0, 0, 6), ipProtocolUDP, 53, true},
+		{net.IPv4(10, 0, 0, 6), ipProtocolTCP, 53, false},
+		{net.IPv4(10, 0, 1, 6), ipProtocolTCP, 80, true},
+		{net.IPv4(10, 0, 1, 6), ipProtocolUDP, 123, true},
+	}
+	for _, test := range tests {
+		if acl.allows(test.addr, test.protocol, test.port) != test.allowed {
+			t.Errorf("%v proto %d port %d: expected allowed=%v", test.addr, test.protocol, test.port, test.allowed)
+		}
+	}
+}
+
+func TestAccessListLocalFlows(t *testing.T) {
+	peer := &Peer{}
+	assertNil(t, peer.AddACLRule("tcp:10.0.0.0/24:22", true))
+	acl := peer.accessList()
+
+	local, remote := net.IPv4(10, 0, 0, 6), net.IPv4(10, 1, 0, 2)
+	request := FiveTuple{Src: remote, Dst: local, Protocol: ipProtocolTCP, SrcPort: 40000, DstPort: 80}
+	if peer.aclAllowsInbound(acl, &request, nil) {
+		t.Fatal("inbound flow to disallowed port accepted")
+	}
+
+	// flows initiated from the local side are accepted in both directions
+
+	outbound := FiveTuple{Src: local, Dst: remote, Protocol: ipProtocolTCP, SrcPort: 50000, DstPort: 80}
+	if !peer.aclAllowsOutbound(acl, &outbound, nil) {
+		t.Fatal("locally initiated flow dropped")
+	}
+	reply := FiveTuple{Src: remote, Dst: local, Protocol: ipProtocolTCP, SrcPort: 80, DstPort: 50000}
+	if !peer.aclAllowsInbound(acl, &reply, nil) {
+		t.Error("reply to locally initiated flow dropped")
+	}
+	other := FiveTuple{Src: remote, Dst: local, Protocol: ipProtocolTCP, SrcPort: 81, DstPort: 50000}
+	if peer.aclAllowsInbound(acl, &other, nil) {
+		t.Error("packet outside of locally initiated flow accepted")
+	}
+
+	// until they expire
+
+	flow := newACLFlow(ipProtocolTCP, local, remote, 50000, 80)
+	peer.aclFlows.expiry[flow] = time.Now()
+	if peer.aclAllowsInbound(acl, &reply, nil) {
+		t.Error("reply to expired flow accepted")
+	}
+}
+
+func TestAccessListLocalEchoFlows(t *testing.T) {
+	peer := &Peer{}
+	assertNil(t, peer.AddACLRule("tcp:10.0.0.0/24:22", true))
+	acl := peer.accessList()
+
+	local, remote := net.IPv4(10, 0, 0, 6).To4(), net.IPv4(10, 1, 0, 2).To4()
+	packet := func(src, dst net.IP, icmpType uint8, identifier uint16) ([]byte, *FiveTuple) {
+		packet := tuntest.Ping(dst, src)
+		packet[ipv4.HeaderLen] = icmpType
+		binary.BigEndian.PutUint16(packet[ipv4.HeaderLen+4:], identifier)
+		var tuple FiveTuple
+		if !parseFiveTuple(packet, &tuple) {
+			t.Fatal("failed to parse ICMP packet")
+		}
+		return packet, &tuple
+	}
+
+	// only replies to locally sent echo requests with their identifier are accepted
+
+	request, tuple := packet(local, remote, icmpv4TypeEchoRequest, 1)
+	if !peer.aclAllowsOutbound(acl, tuple, request) {
+		t.Fatal("locally sent echo request dropped")
+	}
+	reply, tuple := packet(remote, local, icmpv4TypeEchoReply, 1)
+	if !peer.aclAllowsInbound(acl, tuple, reply) {
+		t.Error("reply to locally sent echo request dropped")
+	}
+	reply, tuple = packet(remote, local, icmpv4TypeEchoReply, 2)
+	if peer.aclAllowsInbound(acl, tuple, reply) {
+		t.Error("echo reply with other identifier accepted")
+	}
+	request, tuple = packet(remote, local, icmpv4TypeEchoRequest, 1)
+	if peer.aclAllowsInbound(acl, tuple, request) {
+		t.Error("echo request of the peer accepted")
+	}
+	unreachable, tuple := packet(remote, local, icmpv4TypeDestinationUnreachable, 1)
+	if peer.aclAllowsInbound(acl, tuple, unreachable) {
+		t.Error("other ICMP message accepted")
+	}
+}
+
+func TestAccessListFlowTableFull(t *testing.T) {
+	peer := &Peer{}
+	assertNil(t, peer.AddACLRule("tcp:10.0.0.0/24:22", true))
+	acl := peer.accessList()
+
+	local, remote := net.IPv4(10, 0, 0, 6), net.IPv4(10, 1, 0, 2)
+	outbound := func(port uint16) bool {
+		tuple := FiveTuple{Src: local, Dst: remote, Protocol: ipProtocolTCP, SrcPort: port, DstPort: 80}
+		return peer.aclAllowsOutbound(acl, &tuple, nil)
+	}
+	for port := 0; port < ACLFlowTableSize; port++ {
+		if !outbound(uint16(port + 1024)) {
+			t.Fatal("flow dropped before table is full")
+		}
+	}
+
+	// new flows are dropped rather than sent without their replies accepted
+
+	if outbound(ACLFlowTableSize + 1024) {
+		t.Error("flow beyond table size not dropped")
+	}
+	if !outbound(1024) {
+		t.Error("recorded flow dropped")
+	}
+
+	// until flows expire
+
+	peer.aclFlows.expiry[newACLFlow(ipProtocolTCP, local, remote, 1025, 80)] = time.Now()
+	if !outbound(ACLFlowTableSize + 1024) {
+		t.Error("flow dropped after another expired")
+	}
+}
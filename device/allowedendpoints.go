@@ -0,0 +1,56 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Allowed endpoints
+ *
+ * A peer with allowed endpoints accepts handshake initiations, responses and transport packets
+ * only from source addresses within them, and does not roam to other addresses.
+ * Packets from other addresses are dropped as DropDisallowedEndpoint.
+ * A peer without allowed endpoints accepts any source address.
+ * Endpoints configured through UAPI are not restricted.
+ */
+
+func (peer *Peer) AllowedEndpoints() []net.IPNet {
+	networks, _ := peer.allowedEndpoints.Load().([]net.IPNet)
+	return networks
+}
+
+func (peer *Peer) AddAllowedEndpoint(network net.IPNet) {
+	peer.Lock()
+	defer peer.Unlock()
+
+	old := peer.AllowedEndpoints()
+	networks := make([]net.IPNet, len(old), len(old)+1)
+	copy(networks, old)
+	peer.allowedEndpoints.Store(append(networks, network))
+}
+
+func (peer *Peer) ClearAllowedEndpoints() {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.allowedEndpoints.Store([]net.IPNet(nil))
+}
+
+func (peer *Peer) endpointAllowed(endpoint conn.Endpoint) bool {
+	networks := peer.AllowedEndpoints()
+	if len(networks) == 0 {
+		return true
+	}
+	ip := endpoint.DstIP()
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestAllowedEndpoints(t *testing.T) {
+	newKey := func() NoisePrivateKey {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sk
+	}
+	newDevice := func(name string, config string) (*Device, *tuntest.ChannelTUN) {
+		tun := tuntest.NewChannelTUN()
+		device := NewDevice(tun.TUN(), NewLogger(LogLevelError, name+": "))
+		device.Up()
+		if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			t.Fatal(err)
+		}
+		return device, tun
+	}
+
+	sk1, sk2 := newKey(), newKey()
+	port1, port2 := getFreePort(t), getFreePort(t)
+	dev1, tun1 := newDevice("dev1", fmt.Sprintf(
+		"private_key=%s\nlisten_port=%s\npublic_key=%s\nallowed_ip=1.0.0.2/32\nendpoint=127.0.0.1:%s\n",
+		sk1.ToHex(), port1, sk2.publicKey().ToHex(), port2))
+	defer dev1.Close()
+	dev2, tun2 := newDevice("dev2", fmt.Sprintf(
+		"private_key=%s\nlisten_port=%s\npublic_key=%s\nallowed_ip=1.0.0.1/32\nallowed_endpoint=127.0.0.0/8\nallowed_endpoint=2001:db8::/32\n",
+		sk2.ToHex(), port2, sk1.publicKey().ToHex()))
+	defer dev2.Close()
+	peer1 := dev2.LookupPeer(sk1.publicKey())
+
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	assertNil(t, dev2.IpcGetOperation(writer))
+	writer.Flush()
+	if !strings.Contains(buf.String(), "allowed_endpoint=127.0.0.0/8\nallowed_endpoint=2001:db8::/32\n") {
+		t.Fatal("allowed endpoints missing from configuration")
+	}
+
+	ping := func() bool {
+		msg := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+		tun1.Outbound <- msg
+		select {
+		case received := <-tun2.Inbound:
+			return bytes.Equal(msg, received)
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	// packets from allowed endpoints are accepted
+
+	if !ping() {
+		t.Fatal("ping from allowed endpoint did not transit")
+	}
+
+	// and from others dropped
+
+	config := "public_key=" + sk1.publicKey().ToHex() + "\nreplace_allowed_endpoints=true\nallowed_endpoint=192.0.2.0/24\n"
+	assertNil(t, dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(config))))
+	if ping() {
+		t.Error("ping from disallowed endpoint transited")
+	}
+	if peer1.DropCounters()[DropDisallowedEndpoint] == 0 {
+		t.Error("packet from disallowed endpoint not counted")
+	}
+
+	// roaming is refused to disallowed endpoints
+
+	endpoint := peer1.endpoint
+	roamed, err := conn.CreateEndpoint("198.51.100.1:51820")
+	assertNil(t, err)
+	peer1.SetEndpointFromPacket(roamed)
+	if peer1.endpoint != endpoint {
+		t.Error("roamed to disallowed endpoint")
+	}
+	roamed, err = conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	peer1.SetEndpointFromPacket(roamed)
+	if peer1.endpoint != roamed {
+		t.Error("did not roam to allowed endpoint")
+	}
+
+	// peers without allowed endpoints accept any
+
+	config = "public_key=" + sk1.publicKey().ToHex() + "\nreplace_allowed_endpoints=true\nendpoint=127.0.0.1:" + port1 + "\n"
+	assertNil(t, dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(config))))
+	if !ping() {
+		t.Error("ping did not transit after clearing allowed endpoints")
+	}
+}
+
+func TestAllowedEndpointsReplay(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	peer1.AddAllowedEndpoint(*network)
+	peer2.AddAllowedEndpoint(*network)
+
+	allowed, err := conn.CreateEndpoint("192.0.2.1:51820")
+	assertNil(t, err)
+	disallowed, err := conn.CreateEndpoint("198.51.100.1:51820")
+	assertNil(t, err)
+
+	// messages replayed from disallowed endpoints leave the handshake untouched
+
+	initiation, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if peer, err := dev2.consumeMessageInitiation(initiation, disallowed); peer != peer1 || err != errDisallowedEndpoint {
+		t.Fatal("initiation from disallowed endpoint not rejected")
+	}
+	if peer, err := dev2.consumeMessageInitiation(initiation, allowed); peer != peer1 || err != nil {
+		t.Fatal("initiation rejected after replay from disallowed endpoint")
+	}
+
+	response, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if peer, err := dev1.consumeMessageResponse(response, disallowed); peer != peer2 || err != errDisallowedEndpoint {
+		t.Fatal("response from disallowed endpoint not rejected")
+	}
+	if peer, err := dev1.consumeMessageResponse(response, allowed); peer != peer2 || err != nil {
+		t.Fatal("response rejected after replay from disallowed endpoint")
+	}
+
+	assertNil(t, peer1.BeginSymmetricSession())
+	assertNil(t, peer2.BeginSymmetricSession())
+	if peer1.keypairs.loadNext() == nil || peer2.keypairs.Current() == nil {
+		t.Fatal("handshake did not complete")
+	}
+}
@@ -0,0 +1,494 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Packet capture
+ *
+ * Packets are written in the pcapng format, with two interfaces:
+ * "tun" carrying inner plaintext packets at the TUN boundary
+ * and "bind" carrying outer datagrams at the bind boundary.
+ * The bind does not expose the IP and UDP headers of datagrams,
+ * hence these are synthesized from the endpoint (with a zero UDP checksum).
+ *
+ * Each packet is annotated with its direction and, where known,
+ * the public key of the peer in a comment.
+ */
+
+const (
+	captureInterfaceTUN  = 0
+	captureInterfaceBind = 1
+)
+
+const (
+	pcapngBlockSection          = 0x0a0d0d0a
+	pcapngBlockInterface        = 0x00000001
+	pcapngBlockEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic        = 0x1a2b3c4d
+	pcapngLinkTypeRaw           = 101
+	pcapngOptionEnd             = 0
+	pcapngOptionComment         = 1
+	pcapngOptionIfName          = 2 // interface description block
+	pcapngOptionUserApplication = 4 // section header block
+	pcapngOptionIfTSResolution  = 9 // interface description block
+	pcapngOptionFlags           = 2 // enhanced packet block
+	pcapngFlagInbound           = 1
+	pcapngFlagOutbound          = 2
+)
+
+type captureConfig struct {
+	inner  bool            // capture packets at the TUN boundary
+	outer  bool            // capture datagrams at the bind boundary
+	peer   *NoisePublicKey // only capture packets of the peer
+	filter *aclRule        // only capture inner packets with matching source or destination
+}
+
+type capturer struct {
+	sync.Mutex
+	active  AtomicBool
+	port    uint32 // atomic, local port of the bind
+	packets uint64
+	config  captureConfig
+	path    string
+	file    io.WriteCloser
+	writer  *bufio.Writer
+	block   []byte
+}
+
+func pcapngOption(block []byte, code uint16, value []byte) []byte {
+	var header [4]byte
+	binary.LittleEndian.PutUint16(header[0:], code)
+	binary.LittleEndian.PutUint16(header[2:], uint16(len(value)))
+	block = append(block, header[:]...)
+	block = append(block, value...)
+	for len(block)%4 != 0 {
+		block = append(block, 0)
+	}
+	return block
+}
+
+/* Writes the block of the type with the body,
+ * filling in the leading and trailing block lengths
+ *
+ * Must hold capture.Mutex
+ */
+func (capture *capturer) unsafeWriteBlock(blockType uint32, body func(block []byte) []byte) error {
+	block := capture.block[:0]
+	block = append(block, make([]byte, 8)...)
+	block = body(block)
+	block = append(block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(block[0:], blockType)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(block)))
+	binary.LittleEndian.PutUint32(block[len(block)-4:], uint32(len(block)))
+	capture.block = block
+	_, err := capture.writer.Write(block)
+	return err
+}
+
+/* Must hold capture.Mutex
+ */
+func (capture *capturer) unsafeWriteHeader() error {
+	err := capture.unsafeWriteBlock(pcapngBlockSection, func(block []byte) []byte {
+		var header [16]byte
+		binary.LittleEndian.PutUint32(header[0:], pcapngByteOrderMagic)
+		binary.LittleEndian.PutUint16(header[4:], 1)
+		binary.LittleEndian.PutUint16(header[6:], 0)
+		binary.LittleEndian.PutUint64(header[8:], ^uint64(0)) // unspecified section length
+		block = append(block, header[:]...)
+		block = pcapngOption(block, pcapngOptionUserApplication, []byte("wireguard-go"))
+		return pcapngOption(block, pcapngOptionEnd, nil)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"tun", "bind"} {
+		err := capture.unsafeWriteBlock(pcapngBlockInterface, func(block []byte) []byte {
+			var header [8]byte
+			binary.LittleEndian.PutUint16(header[0:], pcapngLinkTypeRaw)
+			binary.LittleEndian.PutUint32(header[4:], 0) // no snapshot length
+			block = append(block, header[:]...)
+			block = pcapngOption(block, pcapngOptionIfName, []byte(name))
+			block = pcapngOption(block, pcapngOptionIfTSResolution, []byte{9}) // nanoseconds
+			return pcapngOption(block, pcapngOptionEnd, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return capture.writer.Flush()
+}
+
+/* Must hold capture.Mutex
+ */
+func (capture *capturer) unsafeWritePacket(iface uint32, peer *Peer, outbound bool, parts ...[]byte) error {
+	return capture.unsafeWriteBlock(pcapngBlockEnhancedPacket, func(block []byte) []byte {
+		size := 0
+		for _, part := range parts {
+			size += len(part)
+		}
+		timestamp := uint64(time.Now().UnixNano())
+
+		var header [20]byte
+		binary.LittleEndian.PutUint32(header[0:], iface)
+		binary.LittleEndian.PutUint32(header[4:], uint32(timestamp>>32))
+		binary.LittleEndian.PutUint32(header[8:], uint32(timestamp))
+		binary.LittleEndian.PutUint32(header[12:], uint32(size))
+		binary.LittleEndian.PutUint32(header[16:], uint32(size))
+		block = append(block, header[:]...)
+		for _, part := range parts {
+			block = append(block, part...)
+		}
+		for len(block)%4 != 0 {
+			block = append(block, 0)
+		}
+
+		var flags [4]byte
+		if outbound {
+			binary.LittleEndian.PutUint32(flags[:], pcapngFlagOutbound)
+		} else {
+			binary.LittleEndian.PutUint32(flags[:], pcapngFlagInbound)
+		}
+		block = pcapngOption(block, pcapngOptionFlags, flags[:])
+		if peer != nil {
+			comment := "peer=" + base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
+			block = pcapngOption(block, pcapngOptionComment, []byte(comment))
+		}
+		return pcapngOption(block, pcapngOptionEnd, nil)
+	})
+}
+
+/* Must hold capture.Mutex
+ */
+func (capture *capturer) unsafeMatchesPeer(peer *Peer) bool {
+	if capture.config.peer == nil {
+		return true
+	}
+	return peer != nil && peer.handshake.remoteStatic.Equals(*capture.config.peer)
+}
+
+/* Starts writing a capture to the file, which is closed by the capture from then on,
+ * also if it fails to start
+ */
+func (capture *capturer) start(file io.WriteCloser, path string, config captureConfig) error {
+	capture.Lock()
+	defer capture.Unlock()
+
+	if capture.file != nil {
+		file.Close()
+		return errors.New("capture already running")
+	}
+	capture.file = file
+	capture.writer = bufio.NewWriter(file)
+	if err := capture.unsafeWriteHeader(); err != nil {
+		capture.unsafeStop()
+		return err
+	}
+	capture.path = path
+	capture.config = config
+	capture.packets = 0
+	capture.active.Set(true)
+	return nil
+}
+
+/* Must hold capture.Mutex
+ */
+func (capture *capturer) unsafeStop() error {
+	if capture.file == nil {
+		return nil
+	}
+	capture.active.Set(false)
+	err := capture.writer.Flush()
+	if closeErr := capture.file.Close(); err == nil {
+		err = closeErr
+	}
+	capture.file = nil
+	capture.writer = nil
+	capture.path = ""
+	capture.config = captureConfig{}
+	return err
+}
+
+func (capture *capturer) running() bool {
+	capture.Lock()
+	defer capture.Unlock()
+	return capture.file != nil
+}
+
+func (capture *capturer) stop() error {
+	capture.Lock()
+	defer capture.Unlock()
+	return capture.unsafeStop()
+}
+
+/* Returns the file written to and the number of packets captured,
+ * or an empty path if no capture is running
+ */
+func (capture *capturer) status() (path string, packets uint64) {
+	capture.Lock()
+	defer capture.Unlock()
+	return capture.path, capture.packets
+}
+
+func (capture *capturer) setPort(port uint16) {
+	atomic.StoreUint32(&capture.port, uint32(port))
+}
+
+/* Builds the IP and UDP headers of an outer datagram
+ * between the local port and the endpoint
+ */
+func (capture *capturer) outerHeader(endpoint conn.Endpoint, size int, outbound bool) []byte {
+	remote := endpoint.DstIP()
+	local := endpoint.SrcIP()
+	var remotePort uint64
+	if _, port, err := net.SplitHostPort(endpoint.DstToString()); err == nil {
+		remotePort, _ = strconv.ParseUint(port, 10, 16)
+	}
+
+	var header []byte
+	var udp []byte
+	if remote4 := remote.To4(); remote4 != nil {
+		header = make([]byte, ipv4.HeaderLen+udpHeaderLen)
+		ip := header[:ipv4.HeaderLen]
+		ip[0] = ipv4.Version<<4 | ipv4.HeaderLen>>2
+		binary.BigEndian.PutUint16(ip[IPv4offsetTotalLength:], uint16(len(header)+size))
+		ip[IPv4offsetTTL] = 64
+		ip[IPv4offsetProtocol] = ipProtocolUDP
+		src, dst := ip[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len], ip[IPv4offsetDst:IPv4offsetDst+net.IPv4len]
+		if outbound {
+			src, dst = dst, src
+		}
+		copy(src, remote4)
+		if local4 := local.To4(); local4 != nil {
+			copy(dst, local4)
+		}
+		binary.BigEndian.PutUint16(ip[IPv4offsetChecksum:], checksumFold(checksumAdd(0, ip)))
+		udp = header[ipv4.HeaderLen:]
+	} else {
+		header = make([]byte, ipv6.HeaderLen+udpHeaderLen)
+		ip := header[:ipv6.HeaderLen]
+		ip[0] = ipv6.Version << 4
+		binary.BigEndian.PutUint16(ip[IPv6offsetPayloadLength:], uint16(udpHeaderLen+size))
+		ip[IPv6offsetNextHeader] = ipProtocolUDP
+		ip[IPv6offsetHopLimit] = 64
+		src, dst := ip[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len], ip[IPv6offsetDst:IPv6offsetDst+net.IPv6len]
+		if outbound {
+			src, dst = dst, src
+		}
+		copy(src, remote.To16())
+		if len(local) == net.IPv6len && local.To4() == nil {
+			copy(dst, local)
+		}
+		udp = header[ipv6.HeaderLen:]
+	}
+
+	srcPort, dstPort := uint16(remotePort), uint16(atomic.LoadUint32(&capture.port))
+	if outbound {
+		srcPort, dstPort = dstPort, srcPort
+	}
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLen+size))
+	return header
+}
+
+/* Captures an inner packet read from or written to the TUN device
+ */
+func (device *Device) captureInner(peer *Peer, packet []byte, outbound bool) {
+	capture := &device.capture
+	if !capture.active.Get() {
+		return
+	}
+	capture.Lock()
+	defer capture.Unlock()
+
+	if !capture.config.inner || !capture.unsafeMatchesPeer(peer) {
+		return
+	}
+	if filter := capture.config.filter; filter != nil {
+		var tuple FiveTuple
+		if !parseFiveTuple(packet, &tuple) {
+			return
+		}
+		if !filter.matches(tuple.Src, tuple.Protocol, tuple.SrcPort) &&
+			!filter.matches(tuple.Dst, tuple.Protocol, tuple.DstPort) {
+			return
+		}
+	}
+	device.unsafeCapture(captureInterfaceTUN, peer, outbound, packet)
+}
+
+/* Captures an outer datagram sent to or received from the endpoint
+ */
+func (device *Device) captureOuter(peer *Peer, endpoint conn.Endpoint, packet []byte, outbound bool) {
+	capture := &device.capture
+	if !capture.active.Get() {
+		return
+	}
+
+	// attribute received transport messages to their peer
+
+	if peer == nil && len(packet) >= MessageTransportSize &&
+		binary.LittleEndian.Uint32(packet[:4]) == MessageTransportType {
+		receiver := binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+		peer = device.indexTable.Lookup(receiver).peer
+	}
+
+	capture.Lock()
+	defer capture.Unlock()
+
+	if !capture.config.outer || !capture.unsafeMatchesPeer(peer) {
+		return
+	}
+	header := capture.outerHeader(endpoint, len(packet), outbound)
+	device.unsafeCapture(captureInterfaceBind, peer, outbound, header, packet)
+}
+
+/* Must hold device.capture.Mutex
+ */
+func (device *Device) unsafeCapture(iface uint32, peer *Peer, outbound bool, parts ...[]byte) {
+	capture := &device.capture
+	if capture.file == nil {
+		return
+	}
+	if err := capture.unsafeWritePacket(iface, peer, outbound, parts...); err != nil {
+		device.log.Error.Println("Failed to write capture, stopping:", err)
+		capture.unsafeStop()
+		return
+	}
+	capture.packets++
+}
+
+/* Starts or stops a capture, configured by the lines read:
+ *
+ * file=<path>   starts writing a capture to the file (absolute path)
+ * inner=<bool>  captures packets at the TUN boundary (default true)
+ * outer=<bool>  captures datagrams at the bind boundary (default true)
+ * peer=<hex>    only captures packets of the peer
+ * filter=<rule> only captures inner packets matching the rule (as for acl_allow)
+ * stop=true     stops the running capture
+ */
+func (device *Device) IpcCaptureOperation(socket *bufio.Reader) error {
+	scanner := bufio.NewScanner(socket)
+	logError := device.log.Error
+	logInfo := device.log.Info
+
+	config := captureConfig{inner: true, outer: true}
+	var path string
+	var stop bool
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 {
+			return &IPCError{ipc.IpcErrorProtocol}
+		}
+		key := parts[0]
+		value := parts[1]
+
+		switch key {
+		case "file":
+			if !filepath.IsAbs(value) {
+				logError.Println("Capture file must be an absolute path:", value)
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+			path = value
+
+		case "inner", "outer":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				logError.Println("Failed to set capture", key, "invalid value:", value)
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+			if key == "inner" {
+				config.inner = enabled
+			} else {
+				config.outer = enabled
+			}
+
+		case "peer":
+			config.peer = new(NoisePublicKey)
+			if err := config.peer.FromHex(value); err != nil {
+				logError.Println("Failed to set capture peer:", err)
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+
+		case "filter":
+			filter, err := parseACLRule(value, true)
+			if err != nil {
+				logError.Println("Failed to set capture filter:", err, ":", value)
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+			config.filter = filter
+
+		case "stop":
+			if value != "true" {
+				logError.Println("Failed to stop capture, invalid value:", value)
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+			stop = true
+
+		default:
+			logError.Println("Invalid UAPI capture key:", key)
+			return &IPCError{ipc.IpcErrorInvalid}
+		}
+	}
+
+	if stop {
+		logInfo.Println("UAPI: Stopping capture")
+		if err := device.capture.stop(); err != nil {
+			logError.Println("Failed to finish capture:", err)
+			return &IPCError{ipc.IpcErrorIO}
+		}
+		return nil
+	}
+
+	if path == "" {
+		logError.Println("No capture file given")
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+	if device.capture.running() {
+		logError.Println("Failed to start capture: capture already running")
+		return &IPCError{ipc.IpcErrorIO}
+	}
+
+	// never overwrite or follow links to existing files
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|captureOpenNoFollow, 0600)
+	if err != nil {
+		logError.Println("Failed to create capture file:", err)
+		return &IPCError{ipc.IpcErrorIO}
+	}
+	if err := device.capture.start(file, path, config); err != nil {
+		os.Remove(path)
+		logError.Println("Failed to start capture:", err)
+		return &IPCError{ipc.IpcErrorIO}
+	}
+	logInfo.Println("UAPI: Capturing to", path)
+	return nil
+}
@@ -0,0 +1,10 @@
+// +build !linux,!darwin,!freebsd,!openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+const captureOpenNoFollow = 0
@@ -0,0 +1,193 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+type captureBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (buffer *captureBuffer) Close() error {
+	buffer.closed = true
+	return nil
+}
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func parsePcapng(t *testing.T, data []byte) []pcapngBlock {
+	var blocks []pcapngBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block of %d bytes", len(data))
+		}
+		blockType := binary.LittleEndian.Uint32(data[0:])
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("invalid length %d of block type %#x", length, blockType)
+		}
+		blocks = append(blocks, pcapngBlock{blockType, data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestCapture(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := testPeer(t, device)
+	endpoint, err := conn.CreateEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := parseACLRule("icmp:10.0.0.2/32", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer captureBuffer
+	err = device.capture.start(&buffer, "test.pcapng", captureConfig{inner: true, outer: true, filter: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping := tuntest.Ping(net.IPv4(10, 0, 1, 1), net.IPv4(10, 0, 0, 2))
+	device.captureInner(peer, ping, true)
+	device.captureInner(peer, tuntest.Ping(net.IPv4(10, 0, 1, 1), net.IPv4(10, 0, 0, 3)), true)
+	device.captureOuter(peer, endpoint, make([]byte, MessageKeepaliveSize), true)
+	if _, packets := device.capture.status(); packets != 2 {
+		t.Errorf("captured %d packets, expected 2", packets)
+	}
+	if err := device.capture.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if !buffer.closed {
+		t.Error("capture file not closed")
+	}
+	device.captureInner(peer, ping, false)
+
+	blocks := parsePcapng(t, buffer.Bytes())
+	if len(blocks) != 5 {
+		t.Fatalf("got %d blocks, expected 5", len(blocks))
+	}
+	types := []uint32{pcapngBlockSection, pcapngBlockInterface, pcapngBlockInterface, pcapngBlockEnhancedPacket, pcapngBlockEnhancedPacket}
+	for i, block := range blocks {
+		if block.blockType != types[i] {
+			t.Fatalf("block %d of type %#x, expected %#x", i, block.blockType, types[i])
+		}
+	}
+
+	comment := []byte("peer=" + base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:]))
+
+	inner := blocks[3].body
+	if binary.LittleEndian.Uint32(inner[0:]) != captureInterfaceTUN {
+		t.Error("inner packet not on TUN interface")
+	}
+	if size := binary.LittleEndian.Uint32(inner[12:]); !bytes.Equal(inner[20:20+size], ping) {
+		t.Error("inner packet not captured verbatim")
+	}
+	if !bytes.Contains(inner, comment) {
+		t.Error("inner packet lacks peer annotation")
+	}
+
+	outer := blocks[4].body
+	if binary.LittleEndian.Uint32(outer[0:]) != captureInterfaceBind {
+		t.Error("outer datagram not on bind interface")
+	}
+	if size := binary.LittleEndian.Uint32(outer[12:]); size != 20+udpHeaderLen+MessageKeepaliveSize {
+		t.Errorf("outer datagram of %d bytes", size)
+	}
+	var tuple FiveTuple
+	if !parseFiveTuple(outer[20:], &tuple) || tuple.Protocol != ipProtocolUDP || tuple.DstPort != 51820 ||
+		!tuple.Dst.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("unexpected outer header %+v", tuple)
+	}
+}
+
+type failingCaptureFile struct {
+	closes int
+}
+
+func (file *failingCaptureFile) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left")
+}
+
+func (file *failingCaptureFile) Close() error {
+	file.closes++
+	return nil
+}
+
+func TestCaptureOperation(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	dir, err := ioutil.TempDir("", "capture")
+	assertNil(t, err)
+	defer os.RemoveAll(dir)
+	capture := func(path string) error {
+		return device.IpcCaptureOperation(bufio.NewReader(strings.NewReader("file=" + path + "\n")))
+	}
+
+	// existing files and links are not overwritten
+
+	existing := filepath.Join(dir, "existing")
+	assertNil(t, ioutil.WriteFile(existing, []byte("data"), 0600))
+	paths := []string{existing}
+	link := filepath.Join(dir, "link")
+	if os.Symlink(filepath.Join(dir, "target"), link) == nil {
+		paths = append(paths, link)
+	}
+	for _, path := range paths {
+		if capture(path) == nil {
+			t.Errorf("capture to %s started", path)
+			device.capture.stop()
+		}
+	}
+	if data, _ := ioutil.ReadFile(existing); string(data) != "data" {
+		t.Error("existing file overwritten")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "target")); err == nil {
+		t.Error("link followed")
+	}
+
+	// a running capture is not replaced, and no file created for it
+
+	assertNil(t, capture(filepath.Join(dir, "first")))
+	if capture(filepath.Join(dir, "second")) == nil {
+		t.Error("second capture started")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "second")); err == nil {
+		t.Error("file created for second capture")
+	}
+	assertNil(t, device.capture.stop())
+
+	// files failing to start are closed once
+
+	var file failingCaptureFile
+	if device.capture.start(&file, "failing", captureConfig{}) == nil {
+		t.Error("capture started without header")
+	}
+	if file.closes != 1 {
+		t.Errorf("capture file closed %d times", file.closes)
+	}
+}
@@ -0,0 +1,14 @@
+// +build linux darwin freebsd openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const captureOpenNoFollow = unix.O_NOFOLLOW
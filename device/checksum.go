@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+)
+
+/* Internet checksum (RFC 1071) helpers for rewriting inner packets
+ */
+
+func checksumAdd(sum uint32, buf []byte) uint32 {
+	for len(buf) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf))
+		buf = buf[2:]
+	}
+	if len(buf) == 1 {
+		sum += uint32(buf[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+/* Incrementally updates the checksum stored at buf[checksumOffset:]
+ * for buf[offset:] being overwritten with value (RFC 1624, eqn. 3)
+ *
+ * The rewritten range may start at an odd offset,
+ * but must lie within 16-bit words of buf.
+ */
+func checksumRewrite(buf []byte, checksumOffset int, offset int, value []byte) {
+	start := offset &^ 1
+	end := (offset + len(value) + 1) &^ 1
+
+	sum := uint32(^binary.BigEndian.Uint16(buf[checksumOffset:]))
+	for i := start; i < end; i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(buf[i:]))
+	}
+	copy(buf[offset:], value)
+	for i := start; i < end; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i:]))
+	}
+	binary.BigEndian.PutUint16(buf[checksumOffset:], checksumFold(sum))
+}
+
+/* Incrementally updates the checksum stored at checksum[0:2]
+ * for the 16-bit words old being replaced by new elsewhere,
+ * such as in the pseudo-header of a transport checksum
+ *
+ * Must be called before old is overwritten.
+ */
+func checksumReplace(checksum []byte, old, new []byte) {
+	sum := uint32(^binary.BigEndian.Uint16(checksum))
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	binary.BigEndian.PutUint16(checksum, checksumFold(sum))
+}
@@ -20,6 +20,10 @@ import (
 )
 
 type Device struct {
+	// Accessed atomically, hence placed first for 64-bit alignment
+	// on 32-bit platforms, like the stats of each peer.
+	drops dropCounters
+
 	isUp     AtomicBool // device is (going) up
 	isClosed AtomicBool // device is closed? (acting as guard)
 	log      *Logger
@@ -38,18 +42,27 @@ type Device struct {
 		starting sync.WaitGroup
 		stopping sync.WaitGroup
 		sync.RWMutex
-		bind          conn.Bind // bind interface
+		bind          conn.Bind   // bind interface
+		shared        *SharedBind // bind is attached to, if any
 		netlinkCancel *rwcancel.RWCancel
 		port          uint16 // listening port
 		fwmark        uint32 // mark value (0 = disabled)
+
+		pathMTUDiscovery AtomicBool // send with don't-fragment and learn the path MTU
 	}
 
 	staticIdentity struct {
 		sync.RWMutex
-		privateKey NoisePrivateKey
-		publicKey  NoisePublicKey
+		*identitySecrets              // privateKey in secure memory, zero if delegated
+		secrets          *secureBlock // holding identitySecrets
+		delegate         StaticKey    // performs the static key operations, if not nil
+		publicKey        NoisePublicKey
+		previous         previousIdentity // accepted during rotation
+		grace            time.Duration    // of rotations through UAPI
 	}
 
+	keyLog keyLog
+
 	peers struct {
 		sync.RWMutex
 		keyMap map[NoisePublicKey]*Peer
@@ -60,6 +73,9 @@ type Device struct {
 	allowedips    AllowedIPs
 	indexTable    IndexTable
 	cookieChecker CookieChecker
+	filter        atomic.Value // packetFilterHolder
+	resolver      atomic.Value // peerResolverHolder
+	psk           atomic.Value // pskProviderHolder
 
 	rate struct {
 		underLoadUntil atomic.Value
@@ -76,18 +92,35 @@ type Device struct {
 	}
 
 	queue struct {
-		encryption chan *QueueOutboundElement
-		decryption chan *QueueInboundElement
-		handshake  chan QueueHandshakeElement
+		encryption   chan *QueueOutboundElement
+		decryption   chan *QueueInboundElement
+		handshake    chan QueueHandshakeElement
+		fairQueueing AtomicBool // schedule packets to each peer by fq_codel
 	}
 
 	signals struct {
 		stop chan struct{}
 	}
 
+	hub struct {
+		enabled AtomicBool // forward packets between peers inside the device
+	}
+
+	trace   tracer
+	capture capturer
+	flows   flowTable
+	nat     natTable
+
+	onDemand    onDemandPeers
+	resolutions peerResolutions
+	expiry      peerExpiry
+	events      peerEvents
+
 	tun struct {
-		device tun.Device
-		mtu    int32
+		device          tun.Device
+		mtu             int32
+		clampMSS        AtomicBool // rewrite MSS of TCP SYN segments to fit the MTU
+		icmpUnreachable AtomicBool // answer packets which cannot be sent with ICMP unreachable
 	}
 }
 
@@ -101,6 +134,7 @@ func unsafeRemovePeer(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
 
 	device.allowedips.RemoveByPeer(peer)
+	device.onDemand.forget(peer)
 	peer.Stop()
 
 	// remove from peer map
@@ -201,15 +235,29 @@ func (device *Device) IsUnderLoad() bool {
 }
 
 func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
+	return device.RotatePrivateKey(sk, 0)
+}
+
+/* Sets the private key, accepting initiations for the previous key
+ * during the grace period and keeping current sessions, if not 0
+ */
+func (device *Device) RotatePrivateKey(sk NoisePrivateKey, grace time.Duration) error {
 	// lock required resources
 
 	device.staticIdentity.Lock()
 	defer device.staticIdentity.Unlock()
 
-	if sk.Equals(device.staticIdentity.privateKey) {
+	if device.staticIdentity.delegate == nil && sk.Equals(device.staticIdentity.privateKey) {
 		return nil
 	}
+	return device.unsafeRotateIdentity(sk, nil, grace)
+}
 
+/* Replaces the private key, or its delegate if not nil, of the static identity
+ *
+ * Must hold device.staticIdentity.Mutex
+ */
+func (device *Device) unsafeRotateIdentity(sk NoisePrivateKey, delegate StaticKey, grace time.Duration) error {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
@@ -222,15 +270,34 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// remove peers with matching public keys
 
 	publicKey := sk.publicKey()
+	if delegate != nil {
+		publicKey = delegate.PublicKey()
+	}
 	for key, peer := range device.peers.keyMap {
 		if peer.handshake.remoteStatic.Equals(publicKey) {
 			unsafeRemovePeer(device, peer, key)
 		}
 	}
 
+	// keep previous identity during grace period
+
+	previous := &device.staticIdentity.previous
+	rotating := grace > 0 && (device.staticIdentity.delegate != nil || !device.staticIdentity.privateKey.IsZero())
+	if rotating {
+		previous.privateKey = device.staticIdentity.privateKey
+		previous.delegate = device.staticIdentity.delegate
+		previous.publicKey = device.staticIdentity.publicKey
+		previous.until = time.Now().Add(grace)
+		previous.cookieChecker.Init(previous.publicKey)
+		previous.schedule(grace, device.expirePreviousIdentity)
+	} else {
+		previous.unsafeClear()
+	}
+
 	// update key material
 
 	device.staticIdentity.privateKey = sk
+	device.staticIdentity.delegate = delegate
 	device.staticIdentity.publicKey = publicKey
 	device.cookieChecker.Init(publicKey)
 
@@ -239,8 +306,11 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	expiredPeers := make([]*Peer, 0, len(device.peers.keyMap))
 	for _, peer := range device.peers.keyMap {
 		handshake := &peer.handshake
-		handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
-		expiredPeers = append(expiredPeers, peer)
+		device.unsafePrecomputeStaticStatic(handshake, rotating)
+		handshake.previousIdentityInitiations = 0
+		if !rotating {
+			expiredPeers = append(expiredPeers, peer)
+		}
 	}
 
 	for _, peer := range lockedPeers {
@@ -271,8 +341,22 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 
+	// allocate key material in secure memory
+
+	identity := &device.staticIdentity
+	identity.identitySecrets, identity.secrets, err = newIdentitySecrets()
+	if err != nil {
+		logger.Error.Println("Failed to protect key material in memory:", err)
+	}
+	previous := &identity.previous
+	previous.identitySecrets, previous.secrets, err = newIdentitySecrets()
+	if err != nil {
+		logger.Error.Println("Failed to protect previous key material in memory:", err)
+	}
+
 	device.rate.limiter.Init()
 	device.rate.underLoadUntil.Store(time.Time{})
+	device.resolutions.limiter.Init()
 
 	device.indexTable.Init()
 	device.allowedips.Reset()
@@ -307,10 +391,11 @@ func NewDevice(tunDevice tun.Device, logger *Logger) *Device {
 		go device.RoutineHandshake()
 	}
 
-	device.state.starting.Add(2)
-	device.state.stopping.Add(2)
+	device.state.starting.Add(3)
+	device.state.stopping.Add(3)
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
+	go device.RoutinePeerExpiry()
 
 	device.state.starting.Wait()
 
@@ -387,9 +472,21 @@ func (device *Device) Close() {
 
 	device.RemoveAllPeers()
 
+	device.staticIdentity.Lock()
+	setZero(device.staticIdentity.privateKey[:])
+	device.staticIdentity.previous.unsafeClear()
+	device.staticIdentity.Unlock()
+
 	device.FlushPacketQueues()
 
 	device.rate.limiter.Close()
+	device.resolutions.limiter.Close()
+
+	if err := device.capture.stop(); err != nil {
+		device.log.Error.Println("Failed to finish capture:", err)
+	}
+	device.SetFlowCollector("")
+	device.flushPendingDestinations()
 
 	device.state.changing.Set(false)
 	device.log.Info.Println("Interface closed")
@@ -490,7 +587,11 @@ func (device *Device) BindUpdate() error {
 
 		var err error
 		netc := &device.net
-		netc.bind, netc.port, err = conn.CreateBind(netc.port)
+		if netc.shared != nil {
+			netc.bind, netc.port, err = netc.shared.attach(device)
+		} else {
+			netc.bind, netc.port, err = conn.CreateBind(netc.port)
+		}
 		if err != nil {
 			netc.bind = nil
 			netc.port = 0
@@ -503,6 +604,7 @@ func (device *Device) BindUpdate() error {
 			netc.port = 0
 			return err
 		}
+		device.capture.setPort(netc.port)
 
 		// set fwmark
 
@@ -513,6 +615,19 @@ func (device *Device) BindUpdate() error {
 			}
 		}
 
+		// enable path MTU discovery
+
+		if netc.pathMTUDiscovery.Get() {
+			if pmtud, ok := netc.bind.(conn.PathMTUDiscovery); ok {
+				err = pmtud.SetPathMTUDiscovery(true)
+				if err != nil {
+					return err
+				}
+			} else {
+				device.log.Info.Println("Path MTU discovery not supported by bind")
+			}
+		}
+
 		// clear cached source addresses
 
 		device.peers.RLock()
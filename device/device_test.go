@@ -118,3 +118,15 @@ func randDevice(t *testing.T) *Device {
 	device.SetPrivateKey(sk)
 	return device
 }
+
+func testPeer(t *testing.T, device *Device) *Peer {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := device.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
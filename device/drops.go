@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+/* Drop accounting
+ *
+ * Every packet discarded by the device is counted by the reason it was discarded for,
+ * on the device and, where the packet can be attributed to one, on the peer.
+ */
+
+type DropReason int
+
+const (
+	DropNoPeer               DropReason = iota // no peer with matching allowed IPs
+	DropNoEndpoint                             // peer without known endpoint
+	DropInvalidPacket                          // malformed inner packet
+	DropDisallowedSource                       // inner source not in allowed IPs of peer
+	DropReplay                                 // counter rejected by replay filter
+	DropExpiredKeypair                         // keypair past RejectAfterTime
+	DropUnknownIndex                           // no keypair for receiver index
+	DropDecryptionFailed                       // authentication of transport message failed
+	DropQueueFull                              // queue overflow
+	DropHandshakeRateLimited                   // handshake ratelimited or cookie required under load
+	DropHandshakeInvalidMAC                    // handshake with invalid mac1
+	DropHandshakeInvalid                       // handshake failed to be consumed
+	DropTooBig                                 // inner packet exceeds tunnel MTU
+	DropFiltered                               // rejected by access list, packet filter or hub policy
+	DropRateLimited                            // exceeds bandwidth limit of peer
+	DropCoDel                                  // dropped by CoDel from a standing queue
+	DropNAT                                    // not translatable or no NAT mapping available
+	DropDisallowedEndpoint                     // outer source not in allowed endpoints of peer
+	dropReasonCount
+)
+
+var dropReasonNames = [dropReasonCount]string{
+	DropNoPeer:               "no_peer",
+	DropNoEndpoint:           "no_endpoint",
+	DropInvalidPacket:        "invalid_packet",
+	DropDisallowedSource:     "disallowed_source",
+	DropReplay:               "replay",
+	DropExpiredKeypair:       "expired_keypair",
+	DropUnknownIndex:         "unknown_index",
+	DropDecryptionFailed:     "decryption_failed",
+	DropQueueFull:            "queue_full",
+	DropHandshakeRateLimited: "handshake_ratelimited",
+	DropHandshakeInvalidMAC:  "handshake_invalid_mac",
+	DropHandshakeInvalid:     "handshake_invalid",
+	DropTooBig:               "too_big",
+	DropFiltered:             "filtered",
+	DropRateLimited:          "rate_limited",
+	DropCoDel:                "codel",
+	DropNAT:                  "nat",
+	DropDisallowedEndpoint:   "disallowed_endpoint",
+}
+
+func (reason DropReason) String() string {
+	if reason < 0 || reason >= dropReasonCount {
+		return "unknown"
+	}
+	return dropReasonNames[reason]
+}
+
+type dropCounters [dropReasonCount]uint64
+
+func (counters *dropCounters) snapshot() map[DropReason]uint64 {
+	drops := make(map[DropReason]uint64)
+	counters.forEach(func(reason DropReason, count uint64) {
+		drops[reason] = count
+	})
+	return drops
+}
+
+func (counters *dropCounters) forEach(fn func(reason DropReason, count uint64)) {
+	for reason := range counters {
+		if count := atomic.LoadUint64(&counters[reason]); count != 0 {
+			fn(DropReason(reason), count)
+		}
+	}
+}
+
+func (device *Device) drop(reason DropReason) {
+	atomic.AddUint64(&device.drops[reason], 1)
+}
+
+func (peer *Peer) drop(reason DropReason) {
+	atomic.AddUint64(&peer.stats.drops[reason], 1)
+	atomic.AddUint64(&peer.device.drops[reason], 1)
+}
+
+/* Counts a packet to or from the peer dropped by a token bucket,
+ * which holds the count of the peer
+ */
+func (peer *Peer) dropRateLimited() {
+	atomic.AddUint64(&peer.device.drops[DropRateLimited], 1)
+}
+
+/* Returns the drop counters of the peer,
+ * including the drops counted by its token buckets
+ */
+func (peer *Peer) dropCounters() (counters dropCounters) {
+	for reason := range counters {
+		counters[reason] = atomic.LoadUint64(&peer.stats.drops[reason])
+	}
+	_, _, txDrops := peer.rateLimit.tx.Get()
+	_, _, rxDrops := peer.rateLimit.rx.Get()
+	counters[DropRateLimited] += txDrops + rxDrops
+	return
+}
+
+/* Returns the number of packets dropped by the device for each reason,
+ * omitting reasons without drops
+ */
+func (device *Device) DropCounters() map[DropReason]uint64 {
+	return device.drops.snapshot()
+}
+
+/* Returns the number of packets to or from the peer dropped for each reason,
+ * omitting reasons without drops
+ */
+func (peer *Peer) DropCounters() map[DropReason]uint64 {
+	counters := peer.dropCounters()
+	return counters.snapshot()
+}
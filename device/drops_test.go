@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDropReasonNames(t *testing.T) {
+	seen := make(map[string]bool)
+	for reason := DropReason(0); reason < dropReasonCount; reason++ {
+		name := reason.String()
+		if name == "" || seen[name] {
+			t.Errorf("drop reason %d has missing or duplicate name %q", reason, name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestDropCounters(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := testPeer(t, device)
+
+	device.drop(DropNoPeer)
+	peer.drop(DropReplay)
+	peer.drop(DropReplay)
+
+	drops := device.DropCounters()
+	if len(drops) != 2 || drops[DropNoPeer] != 1 || drops[DropReplay] != 2 {
+		t.Errorf("unexpected device drops %v", drops)
+	}
+	drops = peer.DropCounters()
+	if len(drops) != 1 || drops[DropReplay] != 2 {
+		t.Errorf("unexpected peer drops %v", drops)
+	}
+
+	// rate limited drops are counted once, by the token bucket
+
+	peer.rateLimit.rx.Set(8, 0)
+	now := time.Now()
+	for peer.rateLimit.rx.allow(DefaultMTU, now) {
+	}
+	peer.dropRateLimited()
+	if _, _, rxDrops := peer.rateLimit.rx.Get(); rxDrops != 1 {
+		t.Errorf("token bucket counted %d drops, expected 1", rxDrops)
+	}
+	if drops := peer.DropCounters(); drops[DropRateLimited] != 1 {
+		t.Errorf("peer counted %d rate limited drops, expected 1", drops[DropRateLimited])
+	}
+	if drops := device.DropCounters(); drops[DropRateLimited] != 1 {
+		t.Errorf("device counted %d rate limited drops, expected 1", drops[DropRateLimited])
+	}
+}
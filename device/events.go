@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+/* Peer events
+ *
+ * Changes of peers made by the device itself, rather than through its configuration,
+ * are published to all subscribers. Events are dropped for subscribers
+ * not keeping up with PeerEventQueueSize pending events.
+ */
+
+const PeerEventQueueSize = 64
+
+type PeerEventType int
+
+const (
+	PeerEventExpired PeerEventType = iota // removed at its expiry time
+	PeerEventIdle                         // removed after being idle
+	PeerEventRoamed                       // endpoint changed to the source of a received packet
+)
+
+var peerEventTypeNames = [...]string{
+	PeerEventExpired: "expired",
+	PeerEventIdle:    "idle",
+	PeerEventRoamed:  "roamed",
+}
+
+func (eventType PeerEventType) String() string {
+	if eventType < 0 || int(eventType) >= len(peerEventTypeNames) {
+		return "unknown"
+	}
+	return peerEventTypeNames[eventType]
+}
+
+type PeerEvent struct {
+	Type      PeerEventType
+	PublicKey NoisePublicKey
+	Time      time.Time
+	Endpoint  string // changed to, of PeerEventRoamed
+}
+
+type PeerEventSubscription struct {
+	events chan PeerEvent
+	device *Device
+}
+
+type peerEvents struct {
+	sync.Mutex
+	subscriptions map[*PeerEventSubscription]struct{}
+}
+
+func (device *Device) SubscribePeerEvents() *PeerEventSubscription {
+	subscription := &PeerEventSubscription{
+		events: make(chan PeerEvent, PeerEventQueueSize),
+		device: device,
+	}
+	events := &device.events
+	events.Lock()
+	defer events.Unlock()
+	if events.subscriptions == nil {
+		events.subscriptions = make(map[*PeerEventSubscription]struct{})
+	}
+	events.subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+/* Returns the channel events are delivered on,
+ * which is closed when the subscription is closed
+ */
+func (subscription *PeerEventSubscription) Events() <-chan PeerEvent {
+	return subscription.events
+}
+
+func (subscription *PeerEventSubscription) Close() {
+	events := &subscription.device.events
+	events.Lock()
+	defer events.Unlock()
+	if _, ok := events.subscriptions[subscription]; ok {
+		delete(events.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+func (device *Device) publishPeerEvent(peer *Peer, eventType PeerEventType, endpoint string) {
+	event := PeerEvent{
+		Type:      eventType,
+		PublicKey: peer.handshake.remoteStatic,
+		Time:      time.Now(),
+		Endpoint:  endpoint,
+	}
+	if endpoint != "" {
+		device.log.Info.Println(peer, "- Event:", eventType, endpoint)
+	} else {
+		device.log.Info.Println(peer, "- Event:", eventType)
+	}
+
+	events := &device.events
+	events.Lock()
+	defer events.Unlock()
+	for subscription := range events.subscriptions {
+		select {
+		case subscription.events <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Peer expiry
+ *
+ * A peer is removed once its expiry time has passed,
+ * or once nothing has been sent to or received from it for its idle timeout,
+ * publishing PeerEventExpired or PeerEventIdle respectively.
+ */
+
+const PeerExpiryScanInterval = time.Second
+
+type peerExpiry struct {
+	sync.Mutex
+	peers map[*Peer]struct{} // peers with expiry time or idle timeout
+}
+
+/* Must hold device.expiry.Mutex
+ */
+func (device *Device) unsafeUpdateExpiry(peer *Peer) {
+	table := &device.expiry
+	if peer.expiry.expiresAt.IsZero() && peer.expiry.idleTimeout == 0 {
+		delete(table.peers, peer)
+		return
+	}
+	if table.peers == nil {
+		table.peers = make(map[*Peer]struct{})
+	}
+	table.peers[peer] = struct{}{}
+}
+
+/* Sets the time the peer is removed at, the zero time keeps it
+ */
+func (device *Device) SetPeerExpiry(peer *Peer, expiresAt time.Time) {
+	device.expiry.Lock()
+	defer device.expiry.Unlock()
+	peer.expiry.expiresAt = expiresAt
+	device.unsafeUpdateExpiry(peer)
+}
+
+/* Sets the time without traffic in either direction after which the peer is removed,
+ * 0 keeps it
+ */
+func (device *Device) SetPeerIdleTimeout(peer *Peer, timeout time.Duration) {
+	device.expiry.Lock()
+	defer device.expiry.Unlock()
+	peer.expiry.idleTimeout = timeout
+	peer.expiry.traffic = peer.traffic()
+	peer.expiry.active = time.Now()
+	device.unsafeUpdateExpiry(peer)
+}
+
+/* Returns the bytes sent to and received from the peer
+ */
+func (peer *Peer) traffic() uint64 {
+	return atomic.LoadUint64(&peer.stats.txBytes) + atomic.LoadUint64(&peer.stats.rxBytes)
+}
+
+func (device *Device) peerExpiry(peer *Peer) (expiresAt time.Time, idleTimeout time.Duration) {
+	device.expiry.Lock()
+	defer device.expiry.Unlock()
+	return peer.expiry.expiresAt, peer.expiry.idleTimeout
+}
+
+func (device *Device) RoutinePeerExpiry() {
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: peer expiry - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: peer expiry - started")
+	device.state.starting.Done()
+
+	ticker := time.NewTicker(PeerExpiryScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+			device.expirePeers(time.Now())
+		}
+	}
+}
+
+/* Removes the peers past their expiry time or idle timeout
+ */
+func (device *Device) expirePeers(now time.Time) {
+	type expired struct {
+		peer      *Peer
+		eventType PeerEventType
+	}
+	var removals []expired
+
+	device.expiry.Lock()
+	for peer := range device.expiry.peers {
+		if device.LookupPeer(peer.handshake.remoteStatic) != peer {
+			delete(device.expiry.peers, peer) // removed meanwhile
+			continue
+		}
+
+		expiry := &peer.expiry
+		if !expiry.expiresAt.IsZero() && !now.Before(expiry.expiresAt) {
+			removals = append(removals, expired{peer, PeerEventExpired})
+			delete(device.expiry.peers, peer)
+			continue
+		}
+
+		if expiry.idleTimeout == 0 {
+			continue
+		}
+		traffic := peer.traffic()
+		if traffic != expiry.traffic {
+			expiry.traffic = traffic
+			expiry.active = now
+		} else if now.Sub(expiry.active) >= expiry.idleTimeout {
+			removals = append(removals, expired{peer, PeerEventIdle})
+			delete(device.expiry.peers, peer)
+		}
+	}
+	device.expiry.Unlock()
+
+	for _, removal := range removals {
+		if device.removeExpiredPeer(removal.peer) {
+			device.publishPeerEvent(removal.peer, removal.eventType, "")
+		}
+	}
+}
+
+/* Removes the peer, unless it has been removed or replaced
+ * since it expired, returns whether it was removed
+ */
+func (device *Device) removeExpiredPeer(peer *Peer) bool {
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	key := peer.handshake.remoteStatic
+	if device.peers.keyMap[key] != peer {
+		return false
+	}
+	unsafeRemovePeer(device, peer, key)
+	return true
+}
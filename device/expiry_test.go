@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerExpiry(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	subscription := device.SubscribePeerEvents()
+	defer subscription.Close()
+
+	expiring := testPeer(t, device)
+	idle := testPeer(t, device)
+	now := time.Now()
+
+	// configure through UAPI
+
+	expiresAt := now.Add(time.Hour).Unix()
+	config := fmt.Sprintf("public_key=%s\nexpires_at=%d\npublic_key=%s\nidle_timeout=60\n",
+		hex.EncodeToString(expiring.handshake.remoteStatic[:]), expiresAt,
+		hex.EncodeToString(idle.handshake.remoteStatic[:]))
+	if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	if !strings.Contains(buf.String(), fmt.Sprintf("expires_at=%d\n", expiresAt)) ||
+		!strings.Contains(buf.String(), "idle_timeout=60\n") {
+		t.Fatal("expiry missing from configuration")
+	}
+
+	// packets received or sent reset the idle timeout
+
+	device.expirePeers(now.Add(time.Second * 30))
+	atomic.AddUint64(&idle.stats.rxBytes, 32)
+	device.expirePeers(now.Add(time.Second * 61))
+	if device.LookupPeer(idle.handshake.remoteStatic) == nil {
+		t.Fatal("peer removed despite receiving")
+	}
+	atomic.AddUint64(&idle.stats.txBytes, 32)
+	device.expirePeers(now.Add(time.Second * 92))
+	if device.LookupPeer(idle.handshake.remoteStatic) == nil {
+		t.Fatal("peer removed despite sending")
+	}
+	device.expirePeers(now.Add(time.Second * 153))
+	if device.LookupPeer(idle.handshake.remoteStatic) != nil {
+		t.Error("idle peer not removed")
+	}
+
+	device.expirePeers(now.Add(time.Hour * 2))
+	if device.LookupPeer(expiring.handshake.remoteStatic) != nil {
+		t.Error("expired peer not removed")
+	}
+
+	for _, expected := range []struct {
+		peer      *Peer
+		eventType PeerEventType
+	}{{idle, PeerEventIdle}, {expiring, PeerEventExpired}} {
+		select {
+		case event := <-subscription.Events():
+			if event.Type != expected.eventType || event.PublicKey != expected.peer.handshake.remoteStatic {
+				t.Errorf("unexpected %v event", event.Type)
+			}
+		default:
+			t.Errorf("no %v event", expected.eventType)
+		}
+	}
+}
+
+func TestPeerExpiryReplaced(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	// a peer replaced after it expired is kept
+
+	expired := testPeer(t, device)
+	key := expired.handshake.remoteStatic
+	device.RemovePeer(key)
+	replacement, err := device.NewPeer(key)
+	assertNil(t, err)
+	if device.removeExpiredPeer(expired) || device.LookupPeer(key) != replacement {
+		t.Error("replacement of expired peer removed")
+	}
+	if !device.removeExpiredPeer(replacement) || device.LookupPeer(key) != nil {
+		t.Error("expired peer not removed")
+	}
+}
@@ -0,0 +1,237 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Inner packet filtering
+ *
+ * A PacketFilter installed on the device is consulted for every inner packet:
+ * outbound packets after the peer has been looked up from the destination address,
+ * inbound packets after the source address has been verified against the allowed IPs of the peer.
+ *
+ * Rejected outbound packets are answered with an ICMP "administratively prohibited" error
+ * written back to the TUN device, rejected inbound packets with the same error
+ * sent back through the tunnel to the peer.
+ */
+
+type FilterVerdict int
+
+const (
+	FilterAccept FilterVerdict = iota
+	FilterDrop
+	FilterReject
+)
+
+/* The addresses, transport protocol and ports of an inner packet
+ *
+ * The ports are zero for protocols other than TCP and UDP,
+ * and for fragments other than the first.
+ * Src and Dst refer to the packet buffer and are only valid during the call to the filter.
+ */
+type FiveTuple struct {
+	Src      net.IP
+	Dst      net.IP
+	Protocol uint8
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+type PacketFilter interface {
+	FilterOutbound(peer *Peer, tuple FiveTuple, packet []byte) FilterVerdict
+	FilterInbound(peer *Peer, tuple FiveTuple, packet []byte) FilterVerdict
+}
+
+type packetFilterHolder struct {
+	PacketFilter
+}
+
+/* Installs a packet filter on the device,
+ * a nil filter accepts all packets
+ */
+func (device *Device) SetPacketFilter(filter PacketFilter) {
+	device.filter.Store(packetFilterHolder{filter})
+}
+
+func (device *Device) packetFilter() PacketFilter {
+	holder, _ := device.filter.Load().(packetFilterHolder)
+	return holder.PacketFilter
+}
+
+const (
+	ipv6ExtensionHopByHop    = 0
+	ipv6ExtensionRouting     = 43
+	ipv6ExtensionFragment    = 44
+	ipv6ExtensionDestination = 60
+)
+
+/* Locates the transport header of an IPv4 or IPv6 packet,
+ * skipping over IPv6 extension headers
+ *
+ * The transport header is nil for fragments other than the first.
+ */
+func ipTransport(packet []byte) (protocol uint8, transport []byte, fragmented bool, ok bool) {
+	if len(packet) == 0 {
+		return
+	}
+
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return
+		}
+		headerLen := int(packet[0]&0x0f) << 2
+		if headerLen < ipv4.HeaderLen || headerLen > len(packet) {
+			return
+		}
+		protocol = packet[IPv4offsetProtocol]
+		flags := binary.BigEndian.Uint16(packet[IPv4offsetFlagsFragment:])
+		fragmented = flags&(ipv4FlagMoreFragments|ipv4FragmentOffsetMask) != 0
+		if flags&ipv4FragmentOffsetMask == 0 {
+			transport = packet[headerLen:]
+		}
+
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return
+		}
+		protocol = packet[IPv6offsetNextHeader]
+		transport = packet[ipv6.HeaderLen:]
+
+		// walk extension headers
+
+	extensions:
+		for transport != nil {
+			switch protocol {
+			case ipv6ExtensionHopByHop, ipv6ExtensionRouting, ipv6ExtensionDestination:
+				if len(transport) < 8 {
+					return
+				}
+				size := (int(transport[1]) + 1) << 3
+				if size > len(transport) {
+					return
+				}
+				protocol = transport[0]
+				transport = transport[size:]
+
+			case ipv6ExtensionFragment:
+				if len(transport) < 8 {
+					return
+				}
+				protocol = transport[0]
+				fragmented = true
+				if binary.BigEndian.Uint16(transport[2:])&^0x7 != 0 {
+					transport = nil
+				} else {
+					transport = transport[8:]
+				}
+
+			default:
+				break extensions
+			}
+		}
+
+	default:
+		return
+	}
+
+	ok = true
+	return
+}
+
+/* Parses the 5-tuple of an IPv4 or IPv6 packet
+ */
+func parseFiveTuple(packet []byte, tuple *FiveTuple) bool {
+	protocol, transport, _, ok := ipTransport(packet)
+	if !ok {
+		return false
+	}
+
+	if packet[0]>>4 == ipv4.Version {
+		tuple.Src = packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		tuple.Dst = packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+	} else {
+		tuple.Src = packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		tuple.Dst = packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+	}
+	tuple.Protocol = protocol
+
+	tuple.SrcPort = 0
+	tuple.DstPort = 0
+	if (protocol == ipProtocolTCP || protocol == ipProtocolUDP) && len(transport) >= 4 {
+		tuple.SrcPort = binary.BigEndian.Uint16(transport[0:])
+		tuple.DstPort = binary.BigEndian.Uint16(transport[2:])
+	}
+	return true
+}
+
+/* Consults the access list of the peer and the packet filter
+ * for a packet read from the TUN device
+ */
+func (device *Device) filterOutbound(peer *Peer, packet []byte) FilterVerdict {
+	acl := peer.accessList()
+	filter := device.packetFilter()
+	if acl == nil && filter == nil {
+		return FilterAccept
+	}
+	var tuple FiveTuple
+	if !parseFiveTuple(packet, &tuple) {
+		return FilterDrop
+	}
+	if acl != nil && !peer.aclAllowsOutbound(acl, &tuple, packet) {
+		return FilterDrop
+	}
+	if filter == nil {
+		return FilterAccept
+	}
+	verdict := filter.FilterOutbound(peer, tuple, packet)
+	if verdict == FilterReject {
+		device.sendICMPError(
+			packet,
+			icmpv4TypeDestinationUnreachable, icmpv4CodeAdminProhibited,
+			icmpv6TypeDestinationUnreachable, icmpv6CodeAdminProhibited,
+			0,
+		)
+	}
+	return verdict
+}
+
+/* Consults the access list of the peer and the packet filter
+ * for a packet received from the peer
+ */
+func (device *Device) filterInbound(peer *Peer, packet []byte) FilterVerdict {
+	acl := peer.accessList()
+	filter := device.packetFilter()
+	if acl == nil && filter == nil {
+		return FilterAccept
+	}
+	var tuple FiveTuple
+	if !parseFiveTuple(packet, &tuple) {
+		return FilterDrop
+	}
+	if acl != nil && !peer.aclAllowsInbound(acl, &tuple, packet) {
+		return FilterDrop
+	}
+	if filter == nil {
+		return FilterAccept
+	}
+	verdict := filter.FilterInbound(peer, tuple, packet)
+	if verdict == FilterReject {
+		peer.sendICMPError(
+			packet,
+			icmpv4TypeDestinationUnreachable, icmpv4CodeAdminProhibited,
+			icmpv6TypeDestinationUnreachable, icmpv6CodeAdminProhibited,
+			0,
+		)
+	}
+	return verdict
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestParseFiveTuple(t *testing.T) {
+	var tuple FiveTuple
+
+	packet := testTCPSyn(ipv4.Version, nil)
+	if !parseFiveTuple(packet, &tuple) {
+		t.Fatal("failed to parse IPv4 TCP packet")
+	}
+	if !tuple.Src.Equal(net.IPv4(10, 0, 0, 1)) || !tuple.Dst.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("unexpected addresses %v -> %v", tuple.Src, tuple.Dst)
+	}
+	if tuple.Protocol != ipProtocolTCP || tuple.SrcPort != 40000 || tuple.DstPort != 443 {
+		t.Errorf("unexpected tuple %+v", tuple)
+	}
+
+	// non-initial fragments carry no ports
+
+	binary.BigEndian.PutUint16(packet[IPv4offsetFlagsFragment:], 100)
+	if !parseFiveTuple(packet, &tuple) || tuple.SrcPort != 0 || tuple.DstPort != 0 {
+		t.Errorf("unexpected ports for fragment %+v", tuple)
+	}
+
+	// UDP behind a destination options header
+
+	packet = testIPv6Packet(net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), ipv6ExtensionDestination, 16)
+	packet[ipv6.HeaderLen] = ipProtocolUDP
+	binary.BigEndian.PutUint16(packet[ipv6.HeaderLen+8:], 53)
+	binary.BigEndian.PutUint16(packet[ipv6.HeaderLen+10:], 5353)
+	if !parseFiveTuple(packet, &tuple) {
+		t.Fatal("failed to parse IPv6 UDP packet")
+	}
+	if tuple.Protocol != ipProtocolUDP || tuple.SrcPort != 53 || tuple.DstPort != 5353 {
+		t.Errorf("unexpected tuple %+v", tuple)
+	}
+
+	// truncated extension header
+
+	packet = testIPv6Packet(net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), ipv6ExtensionHopByHop, 4)
+	if parseFiveTuple(packet, &tuple) {
+		t.Error("parsed truncated extension header")
+	}
+}
+
+func TestFilterRejectFairQueued(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := testPeer(t, device)
+
+	// a running peer without routines, so that queues are not drained
+
+	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
+	peer.isRunning.Set(true)
+	defer peer.isRunning.Set(false)
+
+	// ICMP errors for rejected packets are fair queued, and shaped like other packets by the nonce worker
+
+	rejected := tuntest.Ping(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2))
+	reject := func() {
+		peer.sendICMPError(rejected,
+			icmpv4TypeDestinationUnreachable, icmpv4CodeAdminProhibited,
+			icmpv6TypeDestinationUnreachable, icmpv6CodeAdminProhibited,
+			0,
+		)
+	}
+	device.queue.fairQueueing.Set(true)
+	reject()
+	if peer.queue.fq.backlog() != 1 || len(peer.queue.nonce) != 0 {
+		t.Error("ICMP error not fair queued")
+	}
+	peer.queue.fq.flush()
+}
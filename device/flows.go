@@ -0,0 +1,405 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipfix"
+)
+
+/* Flow accounting
+ *
+ * While a collector is configured, inner packets crossing the TUN boundary are
+ * accounted to flows by peer and 5-tuple, which are exported as IPFIX (RFC 7011)
+ * records over UDP: once idle for FlowIdleTimeout, and every FlowActiveTimeout while active.
+ *
+ * Each flow is exported as up to two unidirectional records,
+ * for packets sent to the peer (egress) and received from the peer (ingress),
+ * carrying the public key of the peer as user name.
+ *
+ * Packets sent are accounted once handed to the encryption queue, so that packets
+ * dropped before are not. Flows are spread over flowShards tables by their addresses
+ * and ports, so that packets of different flows rarely contend for the same lock.
+ */
+
+const (
+	FlowActiveTimeout = time.Second * 60
+	FlowIdleTimeout   = time.Second * 15
+	FlowScanInterval  = time.Second
+	FlowTableSize     = 1 << 16 // packets of new flows are not accounted beyond
+	flowShards        = 64      // power of two
+	flowMessageSize   = 1400
+	flowRecordMaxSize = 2*net.IPv6len + 1 + 2*2 + 4*8 + 1 + 1 + 44
+)
+
+const (
+	flowTemplateIPv4 = ipfix.MinDataSetID + iota
+	flowTemplateIPv6
+)
+
+const (
+	flowDirectionIngress = 0
+	flowDirectionEgress  = 1
+)
+
+func flowTemplate(id uint16, addressIDs [2]uint16, addressLen uint16) ipfix.Template {
+	return ipfix.Template{
+		ID: id,
+		Fields: []ipfix.Field{
+			{ID: addressIDs[0], Length: addressLen},
+			{ID: addressIDs[1], Length: addressLen},
+			{ID: ipfix.ProtocolIdentifier, Length: 1},
+			{ID: ipfix.SourceTransportPort, Length: 2},
+			{ID: ipfix.DestinationTransportPort, Length: 2},
+			{ID: ipfix.OctetDeltaCount, Length: 8},
+			{ID: ipfix.PacketDeltaCount, Length: 8},
+			{ID: ipfix.FlowStartMilliseconds, Length: 8},
+			{ID: ipfix.FlowEndMilliseconds, Length: 8},
+			{ID: ipfix.FlowDirection, Length: 1},
+			{ID: ipfix.UserName, Length: ipfix.VariableLength},
+		},
+	}
+}
+
+var flowTemplates = [...]ipfix.Template{
+	flowTemplate(flowTemplateIPv4, [2]uint16{ipfix.SourceIPv4Address, ipfix.DestinationIPv4Address}, net.IPv4len),
+	flowTemplate(flowTemplateIPv6, [2]uint16{ipfix.SourceIPv6Address, ipfix.DestinationIPv6Address}, net.IPv6len),
+}
+
+type flowKey struct {
+	peer       *Peer
+	local      [net.IPv6len]byte
+	remote     [net.IPv6len]byte
+	localPort  uint16
+	remotePort uint16
+	protocol   uint8
+	ipv6       bool
+}
+
+type flowCounters struct {
+	bytes   uint64
+	packets uint64
+}
+
+type flowRecord struct {
+	tx       flowCounters // sent to the peer
+	rx       flowCounters // received from the peer
+	first    time.Time
+	last     time.Time
+	exported time.Time // start of the current active timeout interval
+}
+
+type flowExport struct {
+	key    flowKey
+	record flowRecord
+}
+
+type flowExporter struct {
+	collector string
+	conn      net.Conn
+	sequence  uint32 // number of data records sent
+	buffer    []byte
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type flowShard struct {
+	sync.Mutex
+	flows map[flowKey]*flowRecord
+}
+
+type flowTable struct {
+	sync.Mutex             // protects exporter
+	configuring sync.Mutex // serializes changes of the exporter
+	enabled     AtomicBool
+	exporter    *flowExporter
+	shards      [flowShards]flowShard // holding up to FlowTableSize / flowShards flows each
+}
+
+/* Returns the shard of the table holding the flow
+ */
+func (table *flowTable) shard(key *flowKey) *flowShard {
+	hash := uint32(2166136261) // FNV-1a
+	for _, b := range key.remote {
+		hash = (hash ^ uint32(b)) * 16777619
+	}
+	for _, b := range key.local[net.IPv6len-4:] {
+		hash = (hash ^ uint32(b)) * 16777619
+	}
+	hash = (hash ^ uint32(key.remotePort)) * 16777619
+	hash = (hash ^ uint32(key.localPort)) * 16777619
+	return &table.shards[hash&(flowShards-1)]
+}
+
+/* Accounts an inner packet sent to or received from the peer
+ */
+func (device *Device) accountFlow(peer *Peer, packet []byte, outbound bool) {
+	if key, ok := device.flowKey(peer, packet, outbound); ok {
+		device.flows.account(&key, len(packet), outbound)
+	}
+}
+
+/* Returns the flow of an inner packet, false if flows are not accounted
+ */
+func (device *Device) flowKey(peer *Peer, packet []byte, outbound bool) (key flowKey, ok bool) {
+	if !device.flows.enabled.Get() {
+		return
+	}
+	var tuple FiveTuple
+	if !parseFiveTuple(packet, &tuple) {
+		return
+	}
+
+	key = flowKey{
+		peer:     peer,
+		protocol: tuple.Protocol,
+		ipv6:     tuple.Src.To4() == nil,
+	}
+	if outbound {
+		copy(key.local[:], tuple.Src.To16())
+		copy(key.remote[:], tuple.Dst.To16())
+		key.localPort, key.remotePort = tuple.SrcPort, tuple.DstPort
+	} else {
+		copy(key.local[:], tuple.Dst.To16())
+		copy(key.remote[:], tuple.Src.To16())
+		key.localPort, key.remotePort = tuple.DstPort, tuple.SrcPort
+	}
+	return key, true
+}
+
+/* Accounts a packet of the given size to the flow
+ */
+func (table *flowTable) account(key *flowKey, size int, outbound bool) {
+	now := time.Now()
+	shard := table.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	record, ok := shard.flows[*key]
+	if !ok {
+		if shard.flows == nil || len(shard.flows) >= FlowTableSize/flowShards {
+			return
+		}
+		record = &flowRecord{first: now, exported: now}
+		shard.flows[*key] = record
+	}
+	counters := &record.rx
+	if outbound {
+		counters = &record.tx
+	}
+	counters.bytes += uint64(size)
+	counters.packets++
+	record.last = now
+}
+
+/* Removes the flows which are due for export,
+ * or all flows if final
+ */
+func (table *flowTable) expire(now time.Time, final bool) []flowExport {
+	var exports []flowExport
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.Lock()
+		for key, record := range shard.flows {
+			switch {
+			case final || now.Sub(record.last) >= FlowIdleTimeout:
+				exports = append(exports, flowExport{key, *record})
+				delete(shard.flows, key)
+			case now.Sub(record.exported) >= FlowActiveTimeout:
+				exports = append(exports, flowExport{key, *record})
+				record.tx = flowCounters{}
+				record.rx = flowCounters{}
+				record.exported = now
+			}
+		}
+		shard.Unlock()
+	}
+	return exports
+}
+
+/* Sends the flows to the collector as IPFIX messages
+ */
+func (exporter *flowExporter) export(exports []flowExport, now time.Time) error {
+	var message *ipfix.Message
+	records := uint32(0)
+
+	send := func() error {
+		if records == 0 {
+			return nil
+		}
+		_, err := exporter.conn.Write(message.Bytes())
+		exporter.sequence += records
+		records = 0
+		return err
+	}
+
+	for i := range exports {
+		export := &exports[i]
+		for _, direction := range []uint8{flowDirectionEgress, flowDirectionIngress} {
+			counters := export.record.rx
+			if direction == flowDirectionEgress {
+				counters = export.record.tx
+			}
+			if counters.packets == 0 {
+				continue
+			}
+
+			if message != nil && message.Len()+flowRecordMaxSize > flowMessageSize {
+				if err := send(); err != nil {
+					return err
+				}
+				message = nil
+			}
+			if message == nil {
+				message = ipfix.NewMessage(exporter.buffer, 0, exporter.sequence, now)
+				for i := range flowTemplates {
+					message.AddTemplate(&flowTemplates[i])
+				}
+			}
+
+			key := &export.key
+			local, remote := net.IP(key.local[:]), net.IP(key.remote[:])
+			localPort, remotePort := key.localPort, key.remotePort
+			src, dst, srcPort, dstPort := remote, local, remotePort, localPort
+			if direction == flowDirectionEgress {
+				src, dst, srcPort, dstPort = local, remote, localPort, remotePort
+			}
+
+			if key.ipv6 {
+				message.StartRecord(flowTemplateIPv6)
+				message.IPv6(src)
+				message.IPv6(dst)
+			} else {
+				message.StartRecord(flowTemplateIPv4)
+				message.IPv4(src)
+				message.IPv4(dst)
+			}
+			message.Uint8(key.protocol)
+			message.Uint16(srcPort)
+			message.Uint16(dstPort)
+			message.Uint64(counters.bytes)
+			message.Uint64(counters.packets)
+			message.Milliseconds(export.record.first)
+			message.Milliseconds(export.record.last)
+			message.Uint8(direction)
+			if key.peer != nil {
+				message.String(base64.StdEncoding.EncodeToString(key.peer.handshake.remoteStatic[:]))
+			} else {
+				message.String("")
+			}
+			records++
+		}
+	}
+	return send()
+}
+
+func (device *Device) RoutineFlowExport(exporter *flowExporter) {
+	logDebug := device.log.Debug
+	logError := device.log.Error
+
+	defer func() {
+		exporter.conn.Close()
+		logDebug.Println("Routine: flow exporter - stopped")
+		close(exporter.done)
+	}()
+	logDebug.Println("Routine: flow exporter - started")
+
+	ticker := time.NewTicker(FlowScanInterval)
+	defer ticker.Stop()
+
+	for {
+		final := false
+		select {
+		case <-exporter.stop:
+			final = true
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		exports := device.flows.expire(now, final)
+		if err := exporter.export(exports, now); err != nil {
+			logError.Println("Failed to export flows to", exporter.collector, ":", err)
+		}
+		if final {
+			return
+		}
+	}
+}
+
+/* Sets the address of the IPFIX collector flows are exported to,
+ * exporting all current flows to the previous collector.
+ * An empty address disables flow accounting.
+ */
+func (device *Device) SetFlowCollector(collector string) error {
+	table := &device.flows
+	table.configuring.Lock()
+	defer table.configuring.Unlock()
+
+	var exporter *flowExporter
+	if collector != "" {
+		conn, err := net.Dial("udp", collector)
+		if err != nil {
+			return err
+		}
+		exporter = &flowExporter{
+			collector: collector,
+			conn:      conn,
+			buffer:    make([]byte, 0, flowMessageSize),
+			stop:      make(chan struct{}),
+			done:      make(chan struct{}),
+		}
+	}
+
+	table.Lock()
+	previous := table.exporter
+	table.exporter = exporter
+	table.Unlock()
+
+	if previous != nil {
+		close(previous.stop)
+		<-previous.done
+	}
+
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.Lock()
+		if exporter == nil {
+			shard.flows = nil
+		} else if shard.flows == nil {
+			shard.flows = make(map[flowKey]*flowRecord)
+		}
+		shard.Unlock()
+	}
+	table.enabled.Set(exporter != nil)
+
+	if exporter != nil {
+		go device.RoutineFlowExport(exporter)
+	}
+	return nil
+}
+
+/* Returns the address of the collector and the number of flows tracked
+ */
+func (device *Device) FlowCollector() (collector string, flows int) {
+	table := &device.flows
+	table.Lock()
+	exporter := table.exporter
+	table.Unlock()
+	if exporter == nil {
+		return "", 0
+	}
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.Lock()
+		flows += len(shard.flows)
+		shard.Unlock()
+	}
+	return exporter.collector, flows
+}
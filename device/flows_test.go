@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipfix"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestFlowExport(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := testPeer(t, device)
+
+	// local stand-in for the collector
+
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	if err := device.SetFlowCollector(collector.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	request := tuntest.Ping(remote, local)
+	reply := tuntest.Ping(local, remote)
+	device.accountFlow(peer, request, true)
+	device.accountFlow(peer, request, true)
+	device.accountFlow(peer, reply, false)
+
+	// ICMP flows are keyed by addresses only, so the pings and the reply are one flow
+
+	if _, flows := device.FlowCollector(); flows != 1 {
+		t.Errorf("tracking %d flows, expected 1", flows)
+	}
+
+	// disabling the exporter flushes all flows
+
+	if err := device.SetFlowCollector(""); err != nil {
+		t.Fatal(err)
+	}
+	device.accountFlow(peer, request, true)
+
+	collector.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 2048)
+	n, err := collector.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, sets, err := ipfix.ParseMessage(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Sequence != 0 {
+		t.Errorf("first message with sequence number %d", header.Sequence)
+	}
+	if len(sets) != 2 || sets[0].ID != ipfix.TemplateSetID || sets[1].ID != flowTemplateIPv4 {
+		t.Fatalf("unexpected sets %+v", sets)
+	}
+
+	user := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
+	recordSize := 2*net.IPv4len + 1 + 2*2 + 4*8 + 1 + 1 + len(user)
+	records := sets[1].Records
+	if len(records) != 2*recordSize {
+		t.Fatalf("data set of %d bytes, expected two records", len(records))
+	}
+
+	bytes := map[uint8]uint64{}
+	packets := map[uint8]uint64{}
+	for ; len(records) > 0; records = records[recordSize:] {
+		record := records[:recordSize]
+		src, dst := net.IP(record[0:4]), net.IP(record[4:8])
+		direction := record[recordSize-len(user)-2]
+		if direction == flowDirectionEgress && (!src.Equal(local) || !dst.Equal(remote)) ||
+			direction == flowDirectionIngress && (!src.Equal(remote) || !dst.Equal(local)) {
+			t.Errorf("record of direction %d from %v to %v", direction, src, dst)
+		}
+		bytes[direction] = binary.BigEndian.Uint64(record[13:])
+		packets[direction] = binary.BigEndian.Uint64(record[21:])
+		if string(record[recordSize-len(user):]) != user {
+			t.Error("record lacks public key of peer")
+		}
+	}
+	if packets[flowDirectionEgress] != 2 || bytes[flowDirectionEgress] != uint64(2*len(request)) {
+		t.Errorf("egress record of %d packets, %d bytes", packets[flowDirectionEgress], bytes[flowDirectionEgress])
+	}
+	if packets[flowDirectionIngress] != 1 || bytes[flowDirectionIngress] != uint64(len(reply)) {
+		t.Errorf("ingress record of %d packets, %d bytes", packets[flowDirectionIngress], bytes[flowDirectionIngress])
+	}
+}
+
+func TestFlowAccounting(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := testPeer(t, device)
+	peer.Start()
+
+	collector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	if err := device.SetFlowCollector(collector.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer device.SetFlowCollector("")
+
+	// packets sent are not accounted while awaiting a handshake
+
+	elem := device.NewOutboundElement()
+	elem.packet = append(elem.buffer[MessageTransportHeaderSize:MessageTransportHeaderSize],
+		tuntest.Ping(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1))...)
+	if !device.sendOutbound(peer, elem) {
+		t.Fatal("packet not queued")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if _, flows := device.FlowCollector(); flows != 0 {
+		t.Errorf("tracking %d flows before any packet was encrypted", flows)
+	}
+
+	// flows are spread over the shards, and counted together
+
+	for i := 0; i < 256; i++ {
+		device.accountFlow(peer, tuntest.Ping(net.IPv4(10, 1, 0, byte(i)), net.IPv4(10, 0, 0, 1)), true)
+	}
+	if _, flows := device.FlowCollector(); flows != 256 {
+		t.Errorf("tracking %d flows, expected 256", flows)
+	}
+	used := 0
+	for i := range device.flows.shards {
+		shard := &device.flows.shards[i]
+		shard.Lock()
+		if len(shard.flows) != 0 {
+			used++
+		}
+		shard.Unlock()
+	}
+	if used < flowShards/2 {
+		t.Errorf("flows spread over %d of %d shards", used, flowShards)
+	}
+}
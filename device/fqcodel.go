@@ -0,0 +1,340 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/* Fair queueing with CoDel (RFC 8290)
+ *
+ * With fair queueing enabled, packets read from the TUN device are not put
+ * directly into the nonce queue of the peer, but hashed by their 5-tuple into one of
+ * FQFlows flows, which the nonce worker serves with deficit round robin.
+ * Each flow is managed by CoDel (RFC 8289), dropping packets from its head
+ * while their queueing delay persistently exceeds CoDelTarget.
+ *
+ * Keepalives and other control packets bypass the flows.
+ */
+
+const (
+	FQFlows       = 64
+	FQLimit       = QueueOutboundSize // maximum number of packets across all flows
+	FQQuantum     = 1514              // bytes served per flow and round
+	CoDelTarget   = time.Millisecond * 5
+	CoDelInterval = time.Millisecond * 100
+)
+
+type fqEntry struct {
+	elem   *QueueOutboundElement
+	queued time.Time
+}
+
+type codelState struct {
+	firstAboveTime time.Time
+	dropNext       time.Time
+	count          uint32
+	lastCount      uint32
+	dropping       bool
+}
+
+type fqFlow struct {
+	queue   []fqEntry
+	backlog int // bytes
+	deficit int
+	listed  bool // on the list of new or old flows
+	codel   codelState
+}
+
+type fqCodel struct {
+	sync.Mutex
+	peer     *Peer
+	flows    [FQFlows]fqFlow
+	newFlows []*fqFlow
+	oldFlows []*fqFlow
+	packets  int
+	seed     uint32
+	notify   chan struct{} // signaled when packets are available
+
+	stats struct {
+		overlimitDrops uint64
+		codelDrops     uint64
+		delay          time.Duration // queueing delay of the last dequeued packet
+	}
+}
+
+func newFQCodel(peer *Peer) *fqCodel {
+	return &fqCodel{
+		peer:   peer,
+		seed:   rand.Uint32(),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+/* Hashes the 5-tuple of the packet (FNV-1a),
+ * perturbed by a random seed
+ */
+func (fq *fqCodel) hash(packet []byte) uint32 {
+	var tuple FiveTuple
+	hash := uint32(2166136261) ^ fq.seed
+	if !parseFiveTuple(packet, &tuple) {
+		return hash
+	}
+	mix := func(b byte) {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	for _, b := range tuple.Src {
+		mix(b)
+	}
+	for _, b := range tuple.Dst {
+		mix(b)
+	}
+	mix(tuple.Protocol)
+	mix(byte(tuple.SrcPort >> 8))
+	mix(byte(tuple.SrcPort))
+	mix(byte(tuple.DstPort >> 8))
+	mix(byte(tuple.DstPort))
+	return hash
+}
+
+func (fq *fqCodel) signal() {
+	select {
+	case fq.notify <- struct{}{}:
+	default:
+	}
+}
+
+/* Must hold fq.Mutex
+ */
+func (fq *fqCodel) unsafeDrop(elem *QueueOutboundElement) {
+	fq.peer.device.PutMessageBuffer(elem.buffer)
+	fq.peer.device.PutOutboundElement(elem)
+}
+
+func (flow *fqFlow) pop() (fqEntry, bool) {
+	if len(flow.queue) == 0 {
+		return fqEntry{}, false
+	}
+	entry := flow.queue[0]
+	flow.queue[0] = fqEntry{}
+	flow.queue = flow.queue[1:]
+	flow.backlog -= len(entry.elem.packet)
+	return entry, true
+}
+
+func (fq *fqCodel) enqueue(elem *QueueOutboundElement, now time.Time) {
+	fq.Lock()
+
+	flow := &fq.flows[fq.hash(elem.packet)%FQFlows]
+	flow.queue = append(flow.queue, fqEntry{elem: elem, queued: now})
+	flow.backlog += len(elem.packet)
+	fq.packets++
+	if !flow.listed {
+		flow.listed = true
+		flow.deficit = FQQuantum
+		fq.newFlows = append(fq.newFlows, flow)
+	}
+
+	// drop from the head of the fattest flow when over the limit
+
+	if fq.packets > FQLimit {
+		fattest := &fq.flows[0]
+		for i := range fq.flows {
+			if fq.flows[i].backlog > fattest.backlog {
+				fattest = &fq.flows[i]
+			}
+		}
+		if entry, ok := fattest.pop(); ok {
+			fq.packets--
+			fq.stats.overlimitDrops++
+			fq.peer.drop(DropQueueFull)
+			entry.elem.trace.drop(DropQueueFull)
+			fq.unsafeDrop(entry.elem)
+		}
+	}
+
+	fq.Unlock()
+	fq.signal()
+}
+
+/* Must hold fq.Mutex
+ */
+func (fq *fqCodel) unsafeShouldDrop(flow *fqFlow, entry fqEntry, now time.Time) bool {
+	sojourn := now.Sub(entry.queued)
+	fq.stats.delay = sojourn
+	if sojourn < CoDelTarget || flow.backlog <= FQQuantum {
+		flow.codel.firstAboveTime = time.Time{}
+		return false
+	}
+	if flow.codel.firstAboveTime.IsZero() {
+		flow.codel.firstAboveTime = now.Add(CoDelInterval)
+		return false
+	}
+	return !now.Before(flow.codel.firstAboveTime)
+}
+
+func codelControlLaw(t time.Time, count uint32) time.Time {
+	return t.Add(time.Duration(float64(CoDelInterval) / math.Sqrt(float64(count))))
+}
+
+/* Dequeues the next packet of the flow subject to CoDel
+ *
+ * Must hold fq.Mutex
+ */
+func (fq *fqCodel) unsafeDequeueFlow(flow *fqFlow, now time.Time) *QueueOutboundElement {
+	codel := &flow.codel
+
+	entry, ok := flow.pop()
+	if !ok {
+		codel.dropping = false
+		return nil
+	}
+	fq.packets--
+	drop := fq.unsafeShouldDrop(flow, entry, now)
+
+	if codel.dropping {
+		if !drop {
+			codel.dropping = false
+		}
+		for codel.dropping && !now.Before(codel.dropNext) {
+			fq.stats.codelDrops++
+			fq.peer.drop(DropCoDel)
+			entry.elem.trace.drop(DropCoDel)
+			fq.unsafeDrop(entry.elem)
+			codel.count++
+			entry, ok = flow.pop()
+			if !ok {
+				codel.dropping = false
+				return nil
+			}
+			fq.packets--
+			if fq.unsafeShouldDrop(flow, entry, now) {
+				codel.dropNext = codelControlLaw(codel.dropNext, codel.count)
+			} else {
+				codel.dropping = false
+			}
+		}
+	} else if drop {
+		fq.stats.codelDrops++
+		fq.peer.drop(DropCoDel)
+		entry.elem.trace.drop(DropCoDel)
+		fq.unsafeDrop(entry.elem)
+		entry, ok = flow.pop()
+		if !ok {
+			return nil
+		}
+		fq.packets--
+		fq.unsafeShouldDrop(flow, entry, now)
+		codel.dropping = true
+		delta := codel.count - codel.lastCount
+		if delta > 1 && now.Sub(codel.dropNext) < 16*CoDelInterval {
+			codel.count = delta
+		} else {
+			codel.count = 1
+		}
+		codel.lastCount = codel.count
+		codel.dropNext = codelControlLaw(now, codel.count)
+	}
+	return entry.elem
+}
+
+/* Dequeues the next packet by deficit round robin over the flows,
+ * returns nil if all flows are empty
+ */
+func (fq *fqCodel) dequeue(now time.Time) *QueueOutboundElement {
+	fq.Lock()
+	defer fq.Unlock()
+
+	for {
+		list := &fq.newFlows
+		if len(*list) == 0 {
+			list = &fq.oldFlows
+			if len(*list) == 0 {
+				return nil
+			}
+		}
+		flow := (*list)[0]
+
+		if flow.deficit <= 0 {
+			flow.deficit += FQQuantum
+			*list = (*list)[1:]
+			fq.oldFlows = append(fq.oldFlows, flow)
+			continue
+		}
+
+		elem := fq.unsafeDequeueFlow(flow, now)
+		if elem == nil {
+
+			// empty new flows are moved to the old flows to prevent starvation
+
+			*list = (*list)[1:]
+			if list == &fq.newFlows && len(fq.oldFlows) > 0 {
+				fq.oldFlows = append(fq.oldFlows, flow)
+			} else {
+				flow.listed = false
+			}
+			continue
+		}
+
+		flow.deficit -= len(elem.packet)
+		if fq.packets > 0 {
+			fq.signal()
+		}
+		return elem
+	}
+}
+
+func (fq *fqCodel) flush() {
+	fq.Lock()
+	defer fq.Unlock()
+
+	for i := range fq.flows {
+		flow := &fq.flows[i]
+		for {
+			entry, ok := flow.pop()
+			if !ok {
+				break
+			}
+			fq.unsafeDrop(entry.elem)
+		}
+		flow.listed = false
+		flow.codel = codelState{}
+	}
+	fq.newFlows = nil
+	fq.oldFlows = nil
+	fq.packets = 0
+}
+
+/* Returns the number of packets queued
+ */
+func (fq *fqCodel) backlog() int {
+	fq.Lock()
+	defer fq.Unlock()
+	return fq.packets
+}
+
+func (fq *fqCodel) Stats() (overlimitDrops, codelDrops uint64, delay time.Duration) {
+	fq.Lock()
+	defer fq.Unlock()
+	return fq.stats.overlimitDrops, fq.stats.codelDrops, fq.stats.delay
+}
+
+/* Puts a packet read from the TUN device into the nonce queue of the peer,
+ * through fair queueing if enabled
+ */
+func (peer *Peer) queueOutbound(elem *QueueOutboundElement) {
+	device := peer.device
+	elem.trace.record(traceNonceQueue)
+	if device.queue.fairQueueing.Get() {
+		peer.queue.fq.enqueue(elem, time.Now())
+		return
+	}
+	addToNonceQueue(peer.queue.nonce, elem, peer)
+}
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func testFQElement(device *Device, src net.IP, size int) *QueueOutboundElement {
+	elem := device.NewOutboundElement()
+	packet := tuntest.Ping(net.IPv4(10, 0, 0, 1), src)
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+	copy(elem.packet, packet)
+	return elem
+}
+
+func TestFQCodelFlowIsolation(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	fq := newFQCodel(testPeer(t, device))
+	now := time.Now()
+
+	bulk := testFQElement(device, net.IPv4(10, 0, 0, 2), 1400)
+	probe := testFQElement(device, net.IPv4(10, 0, 0, 3), 100)
+	for i := byte(4); fq.hash(probe.packet)%FQFlows == fq.hash(bulk.packet)%FQFlows; i++ {
+		copy(probe.packet[IPv4offsetSrc:], net.IPv4(10, 0, 0, i).To4())
+	}
+	fq.enqueue(bulk, now)
+	for i := 1; i < 100; i++ {
+		fq.enqueue(testFQElement(device, net.IPv4(10, 0, 0, 2), 1400), now)
+	}
+	fq.enqueue(probe, now)
+
+	position := -1
+	for i := 0; ; i++ {
+		elem := fq.dequeue(now)
+		if elem == nil {
+			break
+		}
+		if elem == probe {
+			position = i
+		}
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}
+	if position < 0 || position > 2 {
+		t.Errorf("interactive packet dequeued at position %d behind bulk flow", position)
+	}
+}
+
+func TestFQCodelLimit(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	fq := newFQCodel(testPeer(t, device))
+	now := time.Now()
+
+	for i := 0; i < FQLimit+10; i++ {
+		fq.enqueue(testFQElement(device, net.IPv4(10, 0, 1, byte(i%4)), 1000), now)
+	}
+	if overlimitDrops, _, _ := fq.Stats(); overlimitDrops != 10 {
+		t.Errorf("dropped %d packets over limit, expected 10", overlimitDrops)
+	}
+	fq.flush()
+	if fq.dequeue(now) != nil {
+		t.Error("dequeued packet after flush")
+	}
+}
+
+func TestFQCodelDropsStandingQueue(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	fq := newFQCodel(testPeer(t, device))
+	start := time.Now()
+	src := net.IPv4(10, 0, 0, 2)
+
+	// keep a standing queue of about 50ms
+
+	now := start
+	for i := 0; i < 50; i++ {
+		fq.enqueue(testFQElement(device, src, 1000), now)
+		now = now.Add(time.Millisecond)
+	}
+	for now.Before(start.Add(time.Second)) {
+		fq.enqueue(testFQElement(device, src, 1000), now)
+		if elem := fq.dequeue(now); elem != nil {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+		}
+		now = now.Add(time.Millisecond)
+	}
+
+	_, codelDrops, delay := fq.Stats()
+	if codelDrops == 0 {
+		t.Error("no packets dropped from standing queue")
+	}
+	if delay < CoDelTarget {
+		t.Errorf("queue delay %v below target with standing queue", delay)
+	}
+	fq.flush()
+}
+
+func TestFQCodelKeepalive(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := testPeer(t, device)
+
+	// a running peer without routines, so that queues are not drained
+
+	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
+	peer.isRunning.Set(true)
+	defer peer.isRunning.Set(false)
+
+	peer.queue.fq.enqueue(testFQElement(device, net.IPv4(10, 0, 0, 2), 100), time.Now())
+	if peer.SendKeepalive() {
+		t.Error("keepalive sent with packets in the fair queue")
+	}
+	peer.queue.fq.flush()
+	if !peer.SendKeepalive() {
+		t.Error("keepalive not sent with empty queues")
+	}
+}
@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Hub mode
+ *
+ * In hub mode, a packet received from one peer and destined for the allowed IPs of another
+ * is moved directly onto the nonce queue of the other peer,
+ * rather than being written to the TUN device only for the kernel to route it straight back.
+ *
+ * Packets which the kernel would have to answer with an ICMP error
+ * (expiring TTL, exceeding the MTU) are still delivered through the TUN device.
+ * Peers with forwarding disabled neither send nor receive forwarded packets.
+ */
+
+type hubVerdict int
+
+const (
+	hubDeliver   hubVerdict = iota // write to the TUN device
+	hubDrop                        // discard the packet
+	hubForwarded                   // ownership of the buffer passed to the destination peer
+)
+
+/* Must be called with a packet received from src
+ * and verified against its allowed IPs
+ */
+func (device *Device) hubForward(src *Peer, elem *QueueInboundElement) hubVerdict {
+	if !device.hub.enabled.Get() {
+		return hubDeliver
+	}
+
+	var dst *Peer
+	var ttl byte
+	packet := elem.packet
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		dst = device.allowedips.LookupIPv4(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+		ttl = packet[IPv4offsetTTL]
+	case ipv6.Version:
+		dst = device.allowedips.LookupIPv6(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+		ttl = packet[IPv6offsetHopLimit]
+	}
+
+	if dst == nil || dst == src || !dst.isRunning.Get() {
+		return hubDeliver
+	}
+	if src.hubIsolated.Get() || dst.hubIsolated.Get() {
+		device.log.Debug.Println(src, "- Forwarding to", dst, "not permitted")
+		src.drop(DropFiltered)
+		elem.trace.drop(DropFiltered)
+		return hubDrop
+	}
+	if device.filterOutbound(dst, packet) != FilterAccept {
+		dst.drop(DropFiltered)
+		elem.trace.drop(DropFiltered)
+		return hubDrop
+	}
+
+	mtu := dst.enforcedMTU()
+	if ttl <= 1 || packetExceedsMTU(packet, mtu, !device.net.pathMTUDiscovery.Get()) {
+		return hubDeliver
+	}
+
+	// decrement TTL / hop limit
+
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		checksumRewrite(packet, IPv4offsetChecksum, IPv4offsetTTL, []byte{ttl - 1})
+	case ipv6.Version:
+		packet[IPv6offsetHopLimit] = ttl - 1
+	}
+
+	if device.tun.clampMSS.Get() {
+		clampTCPMSS(packet, mtu)
+	}
+
+	// hand the buffer over to the destination peer
+
+	out := device.NewOutboundElement()
+	device.PutMessageBuffer(out.buffer)
+	out.buffer = elem.buffer
+	out.packet = packet
+	out.trace = elem.trace
+	out.trace.record(traceHubForward)
+	elem.trace = nil
+
+	if dst.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		dst.SendHandshakeInitiation(false)
+	}
+	dst.queueOutbound(out)
+	return hubForwarded
+}
@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestHubForwarding(t *testing.T) {
+	newKey := func() NoisePrivateKey {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sk
+	}
+	newDevice := func(name string, config string) (*Device, *tuntest.ChannelTUN) {
+		tun := tuntest.NewChannelTUN()
+		device := NewDevice(tun.TUN(), NewLogger(LogLevelError, name+": "))
+		device.Up()
+		if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			t.Fatal(err)
+		}
+		return device, tun
+	}
+
+	// two spokes reaching each other through the hub
+
+	hubKey, key1, key2 := newKey(), newKey(), newKey()
+	hubPort, port1, port2 := getFreePort(t), getFreePort(t), getFreePort(t)
+	hub, hubTUN := newDevice("hub", fmt.Sprintf(
+		"private_key=%s\nlisten_port=%s\nhub_mode=true\n"+
+			"public_key=%s\nallowed_ip=1.0.0.1/32\nendpoint=127.0.0.1:%s\n"+
+			"public_key=%s\nallowed_ip=1.0.0.2/32\nendpoint=127.0.0.1:%s\n",
+		hubKey.ToHex(), hubPort, key1.publicKey().ToHex(), port1, key2.publicKey().ToHex(), port2))
+	defer hub.Close()
+	var spokeTUNs [2]*tuntest.ChannelTUN
+	for i, key := range []NoisePrivateKey{key1, key2} {
+		port := []string{port1, port2}[i]
+		var spoke *Device
+		spoke, spokeTUNs[i] = newDevice(fmt.Sprintf("spoke%d", i+1), fmt.Sprintf(
+			"private_key=%s\nlisten_port=%s\npublic_key=%s\nallowed_ip=1.0.0.0/24\nendpoint=127.0.0.1:%s\n",
+			key.ToHex(), port, hubKey.publicKey().ToHex(), hubPort))
+		defer spoke.Close()
+	}
+
+	for i := range hub.flows.shards {
+		hub.flows.shards[i].flows = make(map[flowKey]*flowRecord)
+	}
+	hub.flows.enabled.Set(true)
+
+	// packets between the spokes bypass the TUN device of the hub
+
+	ping := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	spokeTUNs[0].Outbound <- ping
+	select {
+	case received := <-spokeTUNs[1].Inbound:
+		if !bytes.Equal(received[ipv4.HeaderLen:], ping[ipv4.HeaderLen:]) || received[IPv4offsetTTL] != ping[IPv4offsetTTL]-1 {
+			t.Error("forwarded ping did not transit correctly")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("ping not forwarded")
+	}
+	select {
+	case <-hubTUN.Inbound:
+		t.Error("forwarded ping written to the TUN device of the hub")
+	default:
+	}
+
+	// and are accounted to both peers
+
+	peer1, peer2 := hub.LookupPeer(key1.publicKey()), hub.LookupPeer(key2.publicKey())
+	var rx, tx uint64
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		rx, tx = 0, 0
+		for i := range hub.flows.shards {
+			shard := &hub.flows.shards[i]
+			shard.Lock()
+			for key, record := range shard.flows {
+				if key.peer == peer1 {
+					rx += record.rx.packets
+				}
+				if key.peer == peer2 {
+					tx += record.tx.packets
+				}
+			}
+			shard.Unlock()
+		}
+		if tx != 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if rx != 1 || tx != 1 {
+		t.Errorf("forwarded ping accounted %d times from the source and %d times to the destination", rx, tx)
+	}
+}
@@ -0,0 +1,300 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Synthesised ICMP errors
+ *
+ * Packets which cannot be sent through the tunnel are answered
+ * with an ICMP(v6) error written back to the TUN device,
+ * so that the sending host learns about the problem immediately.
+ *
+ * The error appears to originate from the destination of the offending packet,
+ * since the device has no address of its own on the inner network.
+ */
+
+const (
+	icmpv4TypeDestinationUnreachable = 3
+	icmpv4CodeHostUnreachable        = 1
+	icmpv4CodeFragmentationNeeded    = 4
+	icmpv4CodeAdminProhibited        = 13
+
+	icmpv6TypeDestinationUnreachable = 1
+	icmpv6CodeAdminProhibited        = 1
+	icmpv6CodeAddressUnreachable     = 3
+	icmpv6TypePacketTooBig           = 2
+)
+
+const (
+	icmpHeaderSize     = 8
+	icmpv4ErrorMaxSize = 576  // RFC 1812, section 4.3.2.3
+	icmpv6ErrorMaxSize = 1280 // RFC 4443, section 2.4 (c)
+)
+
+/* Reports whether an ICMP error may be sent in response to the packet
+ * (RFC 1812, section 4.3.2.7 and RFC 4443, section 2.4 (e))
+ */
+func mayRespondWithICMP(packet []byte) bool {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return false
+		}
+		headerLen := int(packet[0]&0x0f) << 2
+		if headerLen < ipv4.HeaderLen || headerLen > len(packet) {
+			return false
+		}
+		src := net.IP(packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len])
+		dst := net.IP(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+		if src.IsUnspecified() || src.IsMulticast() || src.Equal(net.IPv4bcast) || dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+			return false
+		}
+		flags := binary.BigEndian.Uint16(packet[IPv4offsetFlagsFragment:])
+		if flags&ipv4FragmentOffsetMask != 0 {
+			return false
+		}
+		if packet[IPv4offsetProtocol] == ipProtocolICMPv4 {
+
+			// only respond to ICMP queries, never to other errors
+
+			if len(packet) < headerLen+1 {
+				return false
+			}
+			switch packet[headerLen] {
+			case 0, 8, 13, 14, 15, 16, 17, 18: // echo, timestamp, info & mask
+			default:
+				return false
+			}
+		}
+		return true
+
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return false
+		}
+		src := net.IP(packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len])
+		dst := net.IP(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+		if src.IsUnspecified() || src.IsMulticast() || dst.IsMulticast() {
+			return false
+		}
+		if packet[IPv6offsetNextHeader] == ipProtocolICMPv6 {
+			if len(packet) < ipv6.HeaderLen+1 || packet[ipv6.HeaderLen] < 128 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+/* Writes an ICMPv4 error in response to packet into dst
+ * and returns its length
+ *
+ * The info field occupies the 4 bytes following the checksum.
+ */
+func createICMPv4Error(dst []byte, packet []byte, icmpType, icmpCode uint8, info uint32) int {
+	quote := len(packet)
+	if max := icmpv4ErrorMaxSize - ipv4.HeaderLen - icmpHeaderSize; quote > max {
+		quote = max
+	}
+	size := ipv4.HeaderLen + icmpHeaderSize + quote
+	if len(dst) < size {
+		return 0
+	}
+	dst = dst[:size]
+
+	// IPv4 header, addressed back at the source of the packet
+
+	header := dst[:ipv4.HeaderLen]
+	for i := range header {
+		header[i] = 0
+	}
+	header[0] = ipv4.Version<<4 | ipv4.HeaderLen>>2
+	binary.BigEndian.PutUint16(header[IPv4offsetTotalLength:], uint16(size))
+	header[IPv4offsetTTL] = 64
+	header[IPv4offsetProtocol] = ipProtocolICMPv4
+	copy(header[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len], packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len])
+	copy(header[IPv4offsetDst:IPv4offsetDst+net.IPv4len], packet[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len])
+	binary.BigEndian.PutUint16(header[IPv4offsetChecksum:], checksumFold(checksumAdd(0, header)))
+
+	// ICMP header followed by as much of the packet as fits
+
+	icmp := dst[ipv4.HeaderLen:]
+	icmp[0] = icmpType
+	icmp[1] = icmpCode
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint32(icmp[4:], info)
+	copy(icmp[icmpHeaderSize:], packet[:quote])
+	binary.BigEndian.PutUint16(icmp[2:], checksumFold(checksumAdd(0, icmp)))
+
+	return size
+}
+
+/* Writes an ICMPv6 error in response to packet into dst
+ * and returns its length
+ */
+func createICMPv6Error(dst []byte, packet []byte, icmpType, icmpCode uint8, info uint32) int {
+	quote := len(packet)
+	if max := icmpv6ErrorMaxSize - ipv6.HeaderLen - icmpHeaderSize; quote > max {
+		quote = max
+	}
+	size := ipv6.HeaderLen + icmpHeaderSize + quote
+	if len(dst) < size {
+		return 0
+	}
+	dst = dst[:size]
+
+	// IPv6 header, addressed back at the source of the packet
+
+	header := dst[:ipv6.HeaderLen]
+	for i := range header {
+		header[i] = 0
+	}
+	header[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(header[IPv6offsetPayloadLength:], uint16(size-ipv6.HeaderLen))
+	header[IPv6offsetNextHeader] = ipProtocolICMPv6
+	header[IPv6offsetHopLimit] = 64
+	copy(header[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len], packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len])
+	copy(header[IPv6offsetDst:IPv6offsetDst+net.IPv6len], packet[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len])
+
+	// ICMPv6 header followed by as much of the packet as fits
+
+	icmp := dst[ipv6.HeaderLen:]
+	icmp[0] = icmpType
+	icmp[1] = icmpCode
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint32(icmp[4:], info)
+	copy(icmp[icmpHeaderSize:], packet[:quote])
+
+	// checksum includes the pseudo-header (RFC 8200, section 8.1)
+
+	var pseudo [8]byte
+	binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(icmp)))
+	pseudo[7] = ipProtocolICMPv6
+	sum := checksumAdd(0, header[IPv6offsetSrc:IPv6offsetDst+net.IPv6len])
+	sum = checksumAdd(sum, pseudo[:])
+	sum = checksumAdd(sum, icmp)
+	binary.BigEndian.PutUint16(icmp[2:], checksumFold(sum))
+
+	return size
+}
+
+/* Writes an ICMP(v6) error in response to packet into dst and returns its length,
+ * using the ICMPv4 or ICMPv6 type and code depending on the IP version of the packet
+ */
+func createICMPError(dst []byte, packet []byte, v4Type, v4Code, v6Type, v6Code uint8, info uint32) int {
+	if !mayRespondWithICMP(packet) {
+		return 0
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		return createICMPv4Error(dst, packet, v4Type, v4Code, info)
+	case ipv6.Version:
+		return createICMPv6Error(dst, packet, v6Type, v6Code, info)
+	}
+	return 0
+}
+
+/* Writes an ICMP(v6) error for the packet to the TUN device
+ */
+func (device *Device) sendICMPError(packet []byte, v4Type, v4Code, v6Type, v6Code uint8, info uint32) {
+	buffer := device.GetMessageBuffer()
+	defer device.PutMessageBuffer(buffer)
+
+	offset := MessageTransportOffsetContent
+	size := createICMPError(buffer[offset:], packet, v4Type, v4Code, v6Type, v6Code, info)
+	if size == 0 {
+		return
+	}
+
+	_, err := device.tun.device.Write(buffer[:offset+size], offset)
+	if err == nil {
+		err = device.tun.device.Flush()
+	}
+	if err != nil && !device.isClosed.Get() {
+		device.log.Error.Println("Failed to write ICMP error to TUN device:", err)
+	}
+}
+
+/* Sends an ICMP(v6) error for a packet received from the peer
+ * back through the tunnel, like packets read from the TUN device
+ */
+func (peer *Peer) sendICMPError(packet []byte, v4Type, v4Code, v6Type, v6Code uint8, info uint32) {
+	if !peer.isRunning.Get() {
+		return
+	}
+
+	device := peer.device
+	elem := device.NewOutboundElement()
+	offset := MessageTransportHeaderSize
+	size := createICMPError(elem.buffer[offset:], packet, v4Type, v4Code, v6Type, v6Code, info)
+	if size == 0 {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+		return
+	}
+
+	elem.packet = elem.buffer[offset : offset+size]
+	if !peer.queueShaped(elem) {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}
+}
+
+/* Answers a packet which exceeds the tunnel MTU with
+ * ICMP "fragmentation needed" or ICMPv6 "packet too big"
+ */
+func (device *Device) sendICMPPacketTooBig(packet []byte, mtu int) {
+	if packet[0]>>4 == ipv6.Version && mtu < icmpv6ErrorMaxSize {
+		mtu = icmpv6ErrorMaxSize
+	}
+	device.sendICMPError(
+		packet,
+		icmpv4TypeDestinationUnreachable, icmpv4CodeFragmentationNeeded,
+		icmpv6TypePacketTooBig, 0,
+		uint32(mtu),
+	)
+}
+
+/* Answers a packet which cannot be routed to any peer, or only to a peer without a known endpoint,
+ * with ICMP "host unreachable" or ICMPv6 "address unreachable"
+ */
+func (device *Device) sendICMPHostUnreachable(packet []byte) {
+	device.sendICMPError(
+		packet,
+		icmpv4TypeDestinationUnreachable, icmpv4CodeHostUnreachable,
+		icmpv6TypeDestinationUnreachable, icmpv6CodeAddressUnreachable,
+		0,
+	)
+}
+
+/* Reports whether the packet must not be sent because it is larger than mtu:
+ * IPv4 packets without the DF bit set may still be sent if fragmentOuter,
+ * as the outer UDP datagram is fragmented instead
+ */
+func packetExceedsMTU(packet []byte, mtu int, fragmentOuter bool) bool {
+	if len(packet) <= mtu {
+		return false
+	}
+	if len(packet) > MaxContentSize {
+		return true
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		flags := binary.BigEndian.Uint16(packet[IPv4offsetFlagsFragment:])
+		return flags&ipv4FlagDontFragment != 0 || !fragmentOuter
+	case ipv6.Version:
+		return true
+	}
+	return false
+}
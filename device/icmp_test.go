@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func testIPv6Packet(src, dst net.IP, nextHeader uint8, payloadSize int) []byte {
+	packet := make([]byte, ipv6.HeaderLen+payloadSize)
+	packet[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], uint16(payloadSize))
+	packet[IPv6offsetNextHeader] = nextHeader
+	packet[IPv6offsetHopLimit] = 64
+	copy(packet[IPv6offsetSrc:], src.To16())
+	copy(packet[IPv6offsetDst:], dst.To16())
+	return packet
+}
+
+func TestICMPv4FragmentationNeeded(t *testing.T) {
+	src := net.ParseIP("10.0.0.1")
+	dst := net.ParseIP("10.0.0.2")
+	packet := tuntest.Ping(dst, src)
+	packet = append(packet, make([]byte, 1000)...)
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[IPv4offsetFlagsFragment:], ipv4FlagDontFragment)
+
+	if !packetExceedsMTU(packet, 576, true) {
+		t.Fatal("packet with DF set not detected as exceeding MTU")
+	}
+
+	var buf [MaxMessageSize]byte
+	size := createICMPv4Error(buf[:], packet, icmpv4TypeDestinationUnreachable, icmpv4CodeFragmentationNeeded, 576)
+	if size != icmpv4ErrorMaxSize {
+		t.Fatalf("unexpected error size %d", size)
+	}
+	reply := buf[:size]
+
+	if checksumFold(checksumAdd(0, reply[:ipv4.HeaderLen])) != 0 {
+		t.Error("invalid IPv4 header checksum")
+	}
+	if checksumFold(checksumAdd(0, reply[ipv4.HeaderLen:])) != 0 {
+		t.Error("invalid ICMP checksum")
+	}
+	if !net.IP(reply[IPv4offsetSrc:IPv4offsetSrc+4]).Equal(dst) || !net.IP(reply[IPv4offsetDst:IPv4offsetDst+4]).Equal(src) {
+		t.Error("error not addressed back at sender")
+	}
+	icmp := reply[ipv4.HeaderLen:]
+	if icmp[0] != icmpv4TypeDestinationUnreachable || icmp[1] != icmpv4CodeFragmentationNeeded {
+		t.Errorf("unexpected type %d code %d", icmp[0], icmp[1])
+	}
+	if mtu := binary.BigEndian.Uint16(icmp[6:]); mtu != 576 {
+		t.Errorf("unexpected next-hop MTU %d", mtu)
+	}
+	if !bytes.Equal(icmp[icmpHeaderSize:], packet[:len(icmp)-icmpHeaderSize]) {
+		t.Error("offending packet not quoted")
+	}
+
+	// without DF the outer datagram is fragmented instead,
+	// unless it is sent with DF set for path MTU discovery
+
+	binary.BigEndian.PutUint16(packet[IPv4offsetFlagsFragment:], 0)
+	if packetExceedsMTU(packet, 576, true) {
+		t.Error("packet without DF must not exceed MTU")
+	}
+	if !packetExceedsMTU(packet, 576, false) {
+		t.Error("packet without DF not detected as exceeding MTU during path MTU discovery")
+	}
+}
+
+func TestICMPv6PacketTooBig(t *testing.T) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+	packet := testIPv6Packet(src, dst, 17, 1400)
+
+	if !packetExceedsMTU(packet, 1280, true) {
+		t.Fatal("IPv6 packet not detected as exceeding MTU")
+	}
+
+	var buf [MaxMessageSize]byte
+	size := createICMPv6Error(buf[:], packet, icmpv6TypePacketTooBig, 0, 1280)
+	if size != icmpv6ErrorMaxSize {
+		t.Fatalf("unexpected error size %d", size)
+	}
+	reply := buf[:size]
+	icmp := reply[ipv6.HeaderLen:]
+
+	var pseudo [8]byte
+	binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(icmp)))
+	pseudo[7] = ipProtocolICMPv6
+	sum := checksumAdd(0, reply[IPv6offsetSrc:IPv6offsetDst+net.IPv6len])
+	sum = checksumAdd(sum, pseudo[:])
+	if checksumFold(checksumAdd(sum, icmp)) != 0 {
+		t.Error("invalid ICMPv6 checksum")
+	}
+	if int(binary.BigEndian.Uint16(reply[IPv6offsetPayloadLength:])) != len(icmp) {
+		t.Error("invalid payload length")
+	}
+	if icmp[0] != icmpv6TypePacketTooBig || binary.BigEndian.Uint32(icmp[4:]) != 1280 {
+		t.Error("unexpected ICMPv6 type or MTU")
+	}
+}
+
+func TestICMPNoErrorForErrors(t *testing.T) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+
+	packet := testIPv6Packet(src, dst, ipProtocolICMPv6, 8)
+	packet[ipv6.HeaderLen] = icmpv6TypePacketTooBig
+	if mayRespondWithICMP(packet) {
+		t.Error("responding to ICMPv6 error")
+	}
+	packet[ipv6.HeaderLen] = 128 // echo request
+	if !mayRespondWithICMP(packet) {
+		t.Error("not responding to ICMPv6 echo request")
+	}
+
+	packet = testIPv6Packet(src, net.ParseIP("ff02::1"), 17, 8)
+	if mayRespondWithICMP(packet) {
+		t.Error("responding to multicast packet")
+	}
+
+	packet = tuntest.Ping(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1"))
+	packet[ipv4.HeaderLen] = icmpv4TypeDestinationUnreachable
+	if mayRespondWithICMP(packet) {
+		t.Error("responding to ICMP error")
+	}
+}
+
+func TestICMPUnreachable(t *testing.T) {
+	sk1, err := newPrivateKey()
+	assertNil(t, err)
+	sk2, err := newPrivateKey()
+	assertNil(t, err)
+
+	// a peer without endpoint
+
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), NewLogger(LogLevelError, "dev: "))
+	device.Up()
+	defer device.Close()
+	config := func(config string) {
+		if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config(fmt.Sprintf("private_key=%s\nlisten_port=%s\nicmp_unreachable=true\npublic_key=%s\nallowed_ip=10.0.0.2/32\nallowed_ip=fd00::2/128\n",
+		sk1.ToHex(), getFreePort(t), sk2.publicKey().ToHex()))
+
+	expectUnreachable := func(packet []byte, src, dst net.IP) {
+		t.Helper()
+		tun.Outbound <- packet
+		var reply []byte
+		select {
+		case reply = <-tun.Inbound:
+		case <-time.After(time.Second):
+			t.Fatalf("no ICMP unreachable for packet to %v", dst)
+		}
+		if reply[0]>>4 == ipv4.Version {
+			icmp := reply[ipv4.HeaderLen:]
+			if reply[IPv4offsetProtocol] != ipProtocolICMPv4 || icmp[0] != icmpv4TypeDestinationUnreachable || icmp[1] != icmpv4CodeHostUnreachable {
+				t.Errorf("unexpected reply to packet to %v: %x", dst, reply)
+			}
+			if !net.IP(reply[IPv4offsetSrc:IPv4offsetSrc+4]).Equal(dst) || !net.IP(reply[IPv4offsetDst:IPv4offsetDst+4]).Equal(src) {
+				t.Errorf("reply to packet to %v not addressed back at sender", dst)
+			}
+		} else {
+			icmp := reply[ipv6.HeaderLen:]
+			if reply[IPv6offsetNextHeader] != ipProtocolICMPv6 || icmp[0] != icmpv6TypeDestinationUnreachable || icmp[1] != icmpv6CodeAddressUnreachable {
+				t.Errorf("unexpected reply to packet to %v: %x", dst, reply)
+			}
+			if !net.IP(reply[IPv6offsetSrc:IPv6offsetSrc+16]).Equal(dst) || !net.IP(reply[IPv6offsetDst:IPv6offsetDst+16]).Equal(src) {
+				t.Errorf("reply to packet to %v not addressed back at sender", dst)
+			}
+		}
+	}
+
+	// packets to destinations without peer, or to a peer without endpoint, are answered
+
+	src4, src6 := net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")
+	for _, dst := range []net.IP{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.2")} {
+		expectUnreachable(tuntest.Ping(dst, src4), src4, dst)
+	}
+	for _, dst := range []net.IP{net.ParseIP("fd00::3"), net.ParseIP("fd00::2")} {
+		expectUnreachable(testIPv6Packet(src6, dst, ipProtocolUDP, 8), src6, dst)
+	}
+
+	// unless disabled
+
+	config("icmp_unreachable=false\n")
+	drops := device.DropCounters()[DropNoPeer]
+	tun.Outbound <- tuntest.Ping(net.ParseIP("10.0.0.3"), src4)
+	tun.Outbound <- testIPv6Packet(src6, net.ParseIP("fd00::3"), ipProtocolUDP, 8)
+	for deadline := time.Now().Add(time.Second); device.DropCounters()[DropNoPeer] < drops+2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("packets without peer not dropped")
+		}
+	}
+	select {
+	case reply := <-tun.Inbound:
+		t.Errorf("ICMP unreachable sent while disabled: %x", reply)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
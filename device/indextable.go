@@ -20,6 +20,17 @@ type IndexTableEntry struct {
 type IndexTable struct {
 	sync.RWMutex
 	table map[uint32]IndexTableEntry
+	space *indexSpace // shared with other tables, if not nil
+}
+
+/* An index space shared by several index tables, such as those of the devices attached to
+ * a shared bind, so that each index is held by one table only
+ *
+ * Lock order: IndexTable before indexSpace
+ */
+type indexSpace struct {
+	sync.RWMutex
+	tables map[uint32]*IndexTable
 }
 
 func randUint32() (uint32, error) {
@@ -38,9 +49,62 @@ func (table *IndexTable) Init() {
 func (table *IndexTable) Delete(index uint32) {
 	table.Lock()
 	defer table.Unlock()
+	if _, ok := table.table[index]; ok && table.space != nil {
+		table.space.Lock()
+		delete(table.space.tables, index)
+		table.space.Unlock()
+	}
 	delete(table.table, index)
 }
 
+/* Moves the indices of the table into the shared index space,
+ * dropping those already held by other tables
+ */
+func (table *IndexTable) join(space *indexSpace) {
+	table.Lock()
+	defer table.Unlock()
+	space.Lock()
+	defer space.Unlock()
+
+	if space.tables == nil {
+		space.tables = make(map[uint32]*IndexTable)
+	}
+	for index := range table.table {
+		if _, ok := space.tables[index]; ok {
+			delete(table.table, index)
+			continue
+		}
+		space.tables[index] = table
+	}
+	table.space = space
+}
+
+/* Removes the indices of the table from its shared index space
+ */
+func (table *IndexTable) leave() {
+	table.Lock()
+	defer table.Unlock()
+	space := table.space
+	if space == nil {
+		return
+	}
+	space.Lock()
+	defer space.Unlock()
+
+	for index := range table.table {
+		if space.tables[index] == table {
+			delete(space.tables, index)
+		}
+	}
+	table.space = nil
+}
+
+func (space *indexSpace) lookup(index uint32) *IndexTable {
+	space.RLock()
+	defer space.RUnlock()
+	return space.tables[index]
+}
+
 func (table *IndexTable) SwapIndexForKeypair(index uint32, keypair *Keypair) {
 	table.Lock()
 	defer table.Unlock()
@@ -77,7 +141,7 @@ func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake)
 
 		table.Lock()
 		_, found := table.table[index]
-		if found {
+		if found || !table.claim(index) {
 			table.Unlock()
 			continue
 		}
@@ -91,6 +155,23 @@ func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake)
 	}
 }
 
+/* Claims the index in the shared index space, if any
+ *
+ * Must hold table.Mutex
+ */
+func (table *IndexTable) claim(index uint32) bool {
+	if table.space == nil {
+		return true
+	}
+	table.space.Lock()
+	defer table.space.Unlock()
+	if _, ok := table.space.tables[index]; ok {
+		return false
+	}
+	table.space.tables[index] = table
+	return true
+}
+
 func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
 	table.RLock()
 	defer table.RUnlock()
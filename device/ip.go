@@ -10,13 +10,32 @@ import (
 )
 
 const (
-	IPv4offsetTotalLength = 2
-	IPv4offsetSrc         = 12
-	IPv4offsetDst         = IPv4offsetSrc + net.IPv4len
+	IPv4offsetTotalLength   = 2
+	IPv4offsetFlagsFragment = 6
+	IPv4offsetTTL           = 8
+	IPv4offsetProtocol      = 9
+	IPv4offsetChecksum      = 10
+	IPv4offsetSrc           = 12
+	IPv4offsetDst           = IPv4offsetSrc + net.IPv4len
 )
 
 const (
 	IPv6offsetPayloadLength = 4
+	IPv6offsetNextHeader    = 6
+	IPv6offsetHopLimit      = 7
 	IPv6offsetSrc           = 8
 	IPv6offsetDst           = IPv6offsetSrc + net.IPv6len
 )
+
+const (
+	ipv4FlagDontFragment   = 0x4000
+	ipv4FlagMoreFragments  = 0x2000
+	ipv4FragmentOffsetMask = 0x1fff
+)
+
+const (
+	ipProtocolICMPv4 = 1
+	ipProtocolTCP    = 6
+	ipProtocolUDP    = 17
+	ipProtocolICMPv6 = 58
+)
@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/* Key logging
+ *
+ * For decrypting captures with the WireGuard dissector of Wireshark,
+ * the keys of every handshake can be written to a key log,
+ * in the format it reads (as written by contrib/extract-handshakes):
+ *
+ * LOCAL_STATIC_PRIVATE_KEY = <base64>
+ * REMOTE_STATIC_PUBLIC_KEY = <base64>
+ * LOCAL_EPHEMERAL_PRIVATE_KEY = <base64>
+ * PRESHARED_KEY = <base64>
+ *
+ * The local static private key is the one the handshake is made with,
+ * the previous one for initiations consumed for it during rotation.
+ *
+ * The key log defeats the confidentiality and forward secrecy of all sessions,
+ * it is disabled unless a writer is explicitly set, and must only be used for testing.
+ */
+
+type keyLog struct {
+	sync.Mutex
+	enabled AtomicBool
+	writer  io.Writer
+}
+
+/* Sets the writer the keys of all subsequent handshakes are logged to,
+ * nil disables the key log
+ *
+ * For debugging only: the writer receives the static private key and the secrets
+ * of every session, anyone reading it can decrypt all traffic of the device
+ * and impersonate it. Never set it in production.
+ */
+func (device *Device) SetKeyLogWriter(writer io.Writer) {
+	device.keyLog.Lock()
+	defer device.keyLog.Unlock()
+
+	device.keyLog.writer = writer
+	if writer != nil {
+		device.log.Error.Println("Key log enabled, all sessions may be decrypted by its readers")
+	}
+	device.keyLog.enabled.Set(writer != nil)
+}
+
+/* Logs the keys of the handshake once the preshared key it uses is known,
+ * when creating a response or consuming one
+ *
+ * Must hold device.staticIdentity.RLock and handshake.mutex
+ */
+func (device *Device) logHandshakeKeys(handshake *Handshake, presharedKey *NoiseSymmetricKey) {
+	if !device.keyLog.enabled.Get() {
+		return
+	}
+	log := &device.keyLog
+	log.Lock()
+	defer log.Unlock()
+
+	if log.writer == nil {
+		return
+	}
+	encode := base64.StdEncoding.EncodeToString
+
+	// a delegated static key is not known
+
+	privateKey := &device.staticIdentity.privateKey
+	if handshake.previousIdentity {
+		privateKey = &device.staticIdentity.previous.privateKey
+	}
+	localStatic := ""
+	if !privateKey.IsZero() {
+		localStatic = "LOCAL_STATIC_PRIVATE_KEY = " + encode(privateKey[:]) + "\n"
+	}
+	_, err := fmt.Fprintf(log.writer,
+		"%sREMOTE_STATIC_PUBLIC_KEY = %s\nLOCAL_EPHEMERAL_PRIVATE_KEY = %s\nPRESHARED_KEY = %s\n",
+		localStatic,
+		encode(handshake.remoteStatic[:]),
+		encode(handshake.localEphemeral[:]),
+		encode(presharedKey[:]),
+	)
+	if err != nil {
+		device.log.Error.Println("Failed to write key log:", err)
+	}
+}
@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+func TestKeyLog(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	var log1, log2 bytes.Buffer
+	dev1.SetKeyLogWriter(&log1)
+	dev2.SetKeyLogWriter(&log2)
+
+	handshake := func() {
+		peer1.handshake.mutex.Lock()
+		peer1.handshake.lastInitiationConsumption = time.Time{}
+		peer1.handshake.lastTimestamp = tai64n.Timestamp{}
+		peer1.handshake.mutex.Unlock()
+		log1.Reset()
+		log2.Reset()
+
+		msg1, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		if dev2.ConsumeMessageInitiation(msg1) == nil {
+			t.Fatal("handshake failed at initiation message")
+		}
+		msg2, err := dev2.CreateMessageResponse(peer1)
+		assertNil(t, err)
+		if dev1.ConsumeMessageResponse(msg2) == nil {
+			t.Fatal("handshake failed at response message")
+		}
+	}
+
+	encode := base64.StdEncoding.EncodeToString
+	check := func(log string, localStatic NoisePrivateKey, peer *Peer, presharedKey NoiseSymmetricKey) {
+		lines := []string{
+			"LOCAL_STATIC_PRIVATE_KEY = " + encode(localStatic[:]),
+			"REMOTE_STATIC_PUBLIC_KEY = " + encode(peer.handshake.remoteStatic[:]),
+			"LOCAL_EPHEMERAL_PRIVATE_KEY = " + encode(peer.handshake.localEphemeral[:]),
+			"PRESHARED_KEY = " + encode(presharedKey[:]),
+		}
+		if log != strings.Join(lines, "\n")+"\n" {
+			t.Errorf("unexpected key log:\n%s", log)
+		}
+	}
+
+	// both sides log the keys of completed handshakes
+
+	presharedKey := NoiseSymmetricKey{1}
+	peer1.handshake.presharedKey = presharedKey
+	peer2.handshake.presharedKey = presharedKey
+	handshake()
+	check(log1.String(), dev1.staticIdentity.privateKey, peer2, presharedKey)
+	check(log2.String(), dev2.staticIdentity.privateKey, peer1, presharedKey)
+
+	// with the preshared key used during its rotation
+
+	peer2.handshake.previousPresharedKey = presharedKey
+	peer2.handshake.previousPresharedKeyUntil = time.Now().Add(time.Minute)
+	peer2.handshake.presharedKey = NoiseSymmetricKey{2}
+	handshake()
+	check(log1.String(), dev1.staticIdentity.privateKey, peer2, presharedKey)
+
+	// with the static key used during its rotation
+
+	peer2.handshake.presharedKey = presharedKey
+	previous := dev2.staticIdentity.privateKey
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.RotatePrivateKey(sk, time.Minute))
+	handshake()
+	check(log2.String(), previous, peer1, presharedKey)
+
+	dev1.SetKeyLogWriter(nil)
+	handshake()
+	if log1.Len() != 0 {
+		t.Error("handshake logged after disabling key log")
+	}
+}
@@ -15,8 +15,9 @@ import (
 	"golang.zx2c4.com/wireguard/replay"
 )
 
-/* Due to limitations in Go and /x/crypto there is currently
- * no way to ensure that key material is securely ereased in memory.
+/* While the key material of handshakes is held in secure memory,
+ * the AEADs of /x/crypto keep copies of the keys of a keypair in memory
+ * allocated by Go, which can neither be locked nor securely erased.
  *
  * Since this may harm the forward secrecy property,
  * we plan to resolve this issue; whenever Go allows us to do so.
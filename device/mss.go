@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	tcpHeaderLen        = 20
+	tcpOffsetDataOffset = 12
+	tcpOffsetFlags      = 13
+	tcpOffsetChecksum   = 16
+	tcpFlagSYN          = 0x02
+	tcpOptionEnd        = 0
+	tcpOptionNOP        = 1
+	tcpOptionMSS        = 2
+	tcpOptionMSSLen     = 4
+	tcpMinimumMSS       = 88 // TCP_MIN_MSS of Linux
+)
+
+/* Lowers the MSS option of a TCP SYN segment in the packet
+ * to the largest segment fitting into mtu,
+ * such that hosts behind broken path MTU discovery agree on a segment size
+ * which does not need to be fragmented by the tunnel.
+ *
+ * Reports whether the packet was modified.
+ */
+func clampTCPMSS(packet []byte, mtu int) bool {
+	var segment []byte
+	var maxMSS int
+
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[IPv4offsetProtocol] != ipProtocolTCP {
+			return false
+		}
+		flags := binary.BigEndian.Uint16(packet[IPv4offsetFlagsFragment:])
+		if flags&(ipv4FragmentOffsetMask|ipv4FlagMoreFragments) != 0 {
+			return false
+		}
+		headerLen := int(packet[0]&0x0f) << 2
+		if headerLen < ipv4.HeaderLen || headerLen > len(packet) {
+			return false
+		}
+		segment = packet[headerLen:]
+		maxMSS = mtu - ipv4.HeaderLen - tcpHeaderLen
+
+	case ipv6.Version:
+
+		// segments behind extension headers are left alone
+
+		if len(packet) < ipv6.HeaderLen || packet[IPv6offsetNextHeader] != ipProtocolTCP {
+			return false
+		}
+		segment = packet[ipv6.HeaderLen:]
+		maxMSS = mtu - ipv6.HeaderLen - tcpHeaderLen
+
+	default:
+		return false
+	}
+
+	if maxMSS < tcpMinimumMSS {
+		maxMSS = tcpMinimumMSS
+	}
+
+	if len(segment) < tcpHeaderLen || segment[tcpOffsetFlags]&tcpFlagSYN == 0 {
+		return false
+	}
+	dataOffset := int(segment[tcpOffsetDataOffset]>>4) << 2
+	if dataOffset < tcpHeaderLen || dataOffset > len(segment) {
+		return false
+	}
+
+	// walk options looking for the MSS
+
+	options := segment[:dataOffset]
+	for i := tcpHeaderLen; i < len(options); {
+		switch options[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(options) {
+			return false
+		}
+		optionLen := int(options[i+1])
+		if optionLen < 2 || i+optionLen > len(options) {
+			return false
+		}
+		if options[i] == tcpOptionMSS && optionLen == tcpOptionMSSLen {
+			mss := int(binary.BigEndian.Uint16(options[i+2:]))
+			if mss <= maxMSS {
+				return false
+			}
+			var value [2]byte
+			binary.BigEndian.PutUint16(value[:], uint16(maxMSS))
+			checksumRewrite(segment, tcpOffsetChecksum, i+2, value[:])
+			return true
+		}
+		i += optionLen
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func testTCPSyn(version int, options []byte) []byte {
+	var header []byte
+	if version == ipv4.Version {
+		header = make([]byte, ipv4.HeaderLen)
+		header[0] = ipv4.Version<<4 | ipv4.HeaderLen>>2
+		header[IPv4offsetTTL] = 64
+		header[IPv4offsetProtocol] = ipProtocolTCP
+		copy(header[IPv4offsetSrc:], net.IPv4(10, 0, 0, 1).To4())
+		copy(header[IPv4offsetDst:], net.IPv4(10, 0, 0, 2).To4())
+	} else {
+		header = testIPv6Packet(net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), ipProtocolTCP, 0)
+	}
+
+	segment := make([]byte, tcpHeaderLen+len(options))
+	binary.BigEndian.PutUint16(segment[0:], 40000)
+	binary.BigEndian.PutUint16(segment[2:], 443)
+	segment[tcpOffsetDataOffset] = byte(len(segment)>>2) << 4
+	segment[tcpOffsetFlags] = tcpFlagSYN
+	copy(segment[tcpHeaderLen:], options)
+
+	packet := append(header, segment...)
+	if version == ipv4.Version {
+		binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(len(packet)))
+	} else {
+		binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], uint16(len(segment)))
+	}
+	binary.BigEndian.PutUint16(packet[len(header)+tcpOffsetChecksum:], tcpChecksum(packet))
+	return packet
+}
+
+func tcpChecksum(packet []byte) uint16 {
+	var pseudo [12]byte
+	var sum uint32
+	var segment []byte
+	if packet[0]>>4 == ipv4.Version {
+		segment = packet[ipv4.HeaderLen:]
+		sum = checksumAdd(0, packet[IPv4offsetSrc:IPv4offsetDst+net.IPv4len])
+		pseudo[1] = ipProtocolTCP
+		binary.BigEndian.PutUint16(pseudo[2:], uint16(len(segment)))
+		sum = checksumAdd(sum, pseudo[:4])
+	} else {
+		segment = packet[ipv6.HeaderLen:]
+		sum = checksumAdd(0, packet[IPv6offsetSrc:IPv6offsetDst+net.IPv6len])
+		binary.BigEndian.PutUint32(pseudo[0:], uint32(len(segment)))
+		pseudo[7] = ipProtocolTCP
+		sum = checksumAdd(sum, pseudo[:8])
+	}
+	return checksumFold(checksumAdd(sum, segment))
+}
+
+func TestClampTCPMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		options []byte
+		offset  int
+		mtu     int
+		mss     uint16
+	}{
+		{"IPv4", ipv4.Version, []byte{tcpOptionMSS, 4, 0x05, 0xb4}, 0, 1420, 1380},
+		{"IPv6", ipv6.Version, []byte{tcpOptionMSS, 4, 0x05, 0xa0}, 0, 1420, 1360},
+		{"unaligned", ipv4.Version, []byte{tcpOptionNOP, tcpOptionMSS, 4, 0x05, 0xb4, tcpOptionNOP, tcpOptionNOP, tcpOptionNOP}, 1, 1280, 1240},
+		{"below", ipv4.Version, []byte{tcpOptionMSS, 4, 0x02, 0x18}, 0, 1420, 536},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := testTCPSyn(test.version, test.options)
+			clampTCPMSS(packet, test.mtu)
+
+			headerLen := ipv4.HeaderLen
+			if test.version == ipv6.Version {
+				headerLen = ipv6.HeaderLen
+			}
+			option := packet[headerLen+tcpHeaderLen+test.offset:]
+			if mss := binary.BigEndian.Uint16(option[2:]); mss != test.mss {
+				t.Errorf("MSS is %d, expected %d", mss, test.mss)
+			}
+			if tcpChecksum(packet) != 0 {
+				t.Error("invalid TCP checksum after clamping")
+			}
+		})
+	}
+
+	// segments without SYN are untouched
+
+	packet := testTCPSyn(ipv4.Version, []byte{tcpOptionMSS, 4, 0x05, 0xb4})
+	packet[ipv4.HeaderLen+tcpOffsetFlags] = 0x10
+	if clampTCPMSS(packet, 1280) {
+		t.Error("clamped MSS of segment without SYN")
+	}
+}
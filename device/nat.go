@@ -0,0 +1,493 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+/* Masquerading
+ *
+ * With a NAT source address configured for an IP version, packets received from peers
+ * are written to the TUN device with their source rewritten to the NAT source address,
+ * and packets read from the TUN device addressed to a translated port are rewritten back
+ * before the peer is looked up.
+ *
+ * Connections are tracked by the source address and port of the peer
+ * (endpoint-independent mapping, RFC 4787), for TCP, UDP and ICMP echo,
+ * where the echo identifier takes the role of the port.
+ * ICMP errors quoting a translated packet are translated along with it.
+ * Fragments and other protocols cannot be translated and are dropped.
+ */
+
+const (
+	NATTimeoutTCPEstablished = time.Hour*2 + time.Minute*4 // RFC 5382, REQ-5
+	NATTimeoutTCPTransitory  = time.Minute * 4
+	NATTimeoutUDP            = time.Minute * 5 // RFC 4787, REQ-5
+	NATTimeoutICMP           = time.Minute     // RFC 5508, REQ-1
+	NATTableSize             = 1 << 16         // mappings per IP version
+	NATPortMin               = 1024
+	natSweepInterval         = time.Second * 10
+)
+
+const (
+	icmpv4TypeEchoReply        = 0
+	icmpv4TypeEchoRequest      = 8
+	icmpv4TypeTimeExceeded     = 11
+	icmpv4TypeParameterProblem = 12
+	icmpv6TypeTimeExceeded     = 3
+	icmpv6TypeParameterProblem = 4
+	icmpv6TypeEchoRequest      = 128
+	icmpv6TypeEchoReply        = 129
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+)
+
+type natEndpoint struct {
+	protocol uint8
+	addr     [net.IPv6len]byte
+	port     uint16 // or ICMP echo identifier
+}
+
+type natMapping struct {
+	inside  natEndpoint // of the peer
+	outside natEndpoint // on the NAT source address
+	expires time.Time
+}
+
+type natTable struct {
+	sync.Mutex
+	enabled   AtomicBool
+	source4   net.IP
+	source6   net.IP
+	inside    map[natEndpoint]*natMapping
+	outside   map[natEndpoint]*natMapping
+	count     [2]int // mappings per IP version
+	lastSweep time.Time
+}
+
+/* The fields of a packet subject to translation, referring to the packet buffer
+ */
+type natView struct {
+	ipv6      bool
+	protocol  uint8
+	src       []byte
+	dst       []byte
+	srcPort   []byte // nil if none, the identifier of ICMP echo requests
+	dstPort   []byte // nil if none, the identifier of ICMP echo replies
+	checksum  []byte // transport checksum, nil if absent
+	pseudo    bool   // transport checksum covers the addresses
+	transport []byte
+	quoted    []byte // packet quoted by an ICMP error
+}
+
+/* Parses the packet for translation,
+ * leniently for truncated packets quoted by ICMP errors
+ */
+func natParse(packet []byte, view *natView, quoted bool) bool {
+	protocol, transport, fragmented, ok := ipTransport(packet)
+	if !ok || fragmented {
+		return false
+	}
+	*view = natView{protocol: protocol, transport: transport}
+	if packet[0]>>4 == ipv4.Version {
+		view.src = packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		view.dst = packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+	} else {
+		view.ipv6 = true
+		view.src = packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		view.dst = packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+	}
+
+	field := func(offset int) []byte {
+		if len(transport) < offset+2 {
+			return nil
+		}
+		return transport[offset : offset+2]
+	}
+
+	switch protocol {
+	case ipProtocolTCP, ipProtocolUDP:
+		if len(transport) < 4 || !quoted && len(transport) < udpHeaderLen {
+			return false
+		}
+		view.srcPort = transport[0:2]
+		view.dstPort = transport[2:4]
+		view.pseudo = true
+		if protocol == ipProtocolTCP {
+			view.checksum = field(tcpOffsetChecksum)
+			if !quoted && len(transport) < tcpHeaderLen {
+				return false
+			}
+		} else {
+			view.checksum = field(6)
+			if !view.ipv6 && view.checksum != nil && binary.BigEndian.Uint16(view.checksum) == 0 {
+				view.checksum = nil // checksum disabled
+			}
+		}
+
+	case ipProtocolICMPv4, ipProtocolICMPv6:
+		if len(transport) < icmpHeaderSize {
+			return false
+		}
+		if view.ipv6 != (protocol == ipProtocolICMPv6) {
+			return false
+		}
+		view.checksum = transport[2:4]
+		view.pseudo = view.ipv6
+		echoRequest, echoReply := uint8(icmpv4TypeEchoRequest), uint8(icmpv4TypeEchoReply)
+		if view.ipv6 {
+			echoRequest, echoReply = icmpv6TypeEchoRequest, icmpv6TypeEchoReply
+		}
+		switch transport[0] {
+		case echoRequest:
+			view.srcPort = transport[4:6]
+		case echoReply:
+			view.dstPort = transport[4:6]
+		default:
+			if quoted || !isICMPError(protocol, transport[0]) {
+				return false
+			}
+			view.quoted = transport[icmpHeaderSize:]
+		}
+
+	default:
+		return false
+	}
+	return true
+}
+
+func isICMPError(protocol uint8, icmpType uint8) bool {
+	if protocol == ipProtocolICMPv4 {
+		switch icmpType {
+		case icmpv4TypeDestinationUnreachable, icmpv4TypeTimeExceeded, icmpv4TypeParameterProblem:
+			return true
+		}
+		return false
+	}
+	switch icmpType {
+	case icmpv6TypeDestinationUnreachable, icmpv6TypePacketTooBig, icmpv6TypeTimeExceeded, icmpv6TypeParameterProblem:
+		return true
+	}
+	return false
+}
+
+/* Replaces the address field of the packet,
+ * updating the IPv4 header checksum and the transport checksum covering it
+ */
+func natRewriteAddress(packet []byte, view *natView, field []byte, addr []byte) {
+	if !view.ipv6 {
+		checksumReplace(packet[IPv4offsetChecksum:], field, addr)
+	}
+	if view.checksum != nil && view.pseudo {
+		checksumReplace(view.checksum, field, addr)
+	}
+	copy(field, addr)
+}
+
+func natRewritePort(view *natView, field []byte, port uint16) {
+	var value [2]byte
+	binary.BigEndian.PutUint16(value[:], port)
+	if view.checksum != nil {
+		checksumReplace(view.checksum, field, value[:])
+	}
+	copy(field, value[:])
+}
+
+/* Recomputes the checksum of an ICMP error after translating the quoted packet
+ */
+func natICMPChecksum(view *natView) {
+	icmp := view.transport
+	icmp[2], icmp[3] = 0, 0
+	sum := checksumAdd(0, icmp)
+	if view.ipv6 {
+		var pseudo [8]byte
+		binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(icmp)))
+		pseudo[7] = ipProtocolICMPv6
+		sum = checksumAdd(sum, view.src)
+		sum = checksumAdd(sum, view.dst)
+		sum = checksumAdd(sum, pseudo[:])
+	}
+	binary.BigEndian.PutUint16(icmp[2:], checksumFold(sum))
+}
+
+func natTimeout(view *natView) time.Duration {
+	switch view.protocol {
+	case ipProtocolTCP:
+		if view.transport[tcpOffsetFlags]&(tcpFlagFIN|tcpFlagSYN|tcpFlagRST) != 0 {
+			return NATTimeoutTCPTransitory
+		}
+		return NATTimeoutTCPEstablished
+	case ipProtocolUDP:
+		return NATTimeoutUDP
+	default:
+		return NATTimeoutICMP
+	}
+}
+
+func newNATEndpoint(protocol uint8, addr []byte, port []byte) natEndpoint {
+	endpoint := natEndpoint{
+		protocol: protocol,
+		port:     binary.BigEndian.Uint16(port),
+	}
+	copy(endpoint.addr[:], net.IP(addr).To16())
+	return endpoint
+}
+
+func (endpoint *natEndpoint) address(ipv6 bool) []byte {
+	if ipv6 {
+		return endpoint.addr[:]
+	}
+	return endpoint.addr[12:]
+}
+
+func natFamily(ipv6 bool) int {
+	if ipv6 {
+		return 1
+	}
+	return 0
+}
+
+/* Must hold table.Mutex
+ */
+func (table *natTable) unsafeSource(ipv6 bool) net.IP {
+	if ipv6 {
+		return table.source6
+	}
+	return table.source4
+}
+
+/* Must hold table.Mutex
+ */
+func (table *natTable) unsafeRemove(mapping *natMapping) {
+	delete(table.inside, mapping.inside)
+	delete(table.outside, mapping.outside)
+	table.count[natFamily(net.IP(mapping.outside.addr[:]).To4() == nil)]--
+}
+
+/* Looks up a mapping, removing it if expired
+ *
+ * Must hold table.Mutex
+ */
+func (table *natTable) unsafeLookup(mappings map[natEndpoint]*natMapping, endpoint natEndpoint, now time.Time) *natMapping {
+	mapping := mappings[endpoint]
+	if mapping != nil && now.After(mapping.expires) {
+		table.unsafeRemove(mapping)
+		return nil
+	}
+	return mapping
+}
+
+/* Must hold table.Mutex
+ */
+func (table *natTable) unsafeSweep(now time.Time) {
+	if now.Sub(table.lastSweep) < natSweepInterval {
+		return
+	}
+	table.lastSweep = now
+	for _, mapping := range table.inside {
+		if now.After(mapping.expires) {
+			table.unsafeRemove(mapping)
+		}
+	}
+}
+
+/* Creates a mapping for the endpoint of a peer,
+ * preserving its port if possible
+ *
+ * Must hold table.Mutex
+ */
+func (table *natTable) unsafeAllocate(inside natEndpoint, ipv6 bool, now time.Time) *natMapping {
+	table.unsafeSweep(now)
+	family := natFamily(ipv6)
+	if table.count[family] >= NATTableSize {
+		return nil
+	}
+
+	outside := natEndpoint{protocol: inside.protocol}
+	copy(outside.addr[:], table.unsafeSource(ipv6).To16())
+
+	free := func(port uint16) bool {
+		outside.port = port
+		return table.unsafeLookup(table.outside, outside, now) == nil
+	}
+	if !(inside.port >= NATPortMin || inside.protocol != ipProtocolTCP && inside.protocol != ipProtocolUDP) || !free(inside.port) {
+		ports := 1<<16 - NATPortMin
+		offset := rand.Intn(ports)
+		found := false
+		for i := 0; i < ports && !found; i++ {
+			found = free(uint16(NATPortMin + (offset+i)%ports))
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	mapping := &natMapping{inside: inside, outside: outside}
+	table.inside[inside] = mapping
+	table.outside[outside] = mapping
+	table.count[family]++
+	return mapping
+}
+
+/* Translates the source of a packet received from a peer,
+ * returns false if the packet is to be dropped
+ */
+func (table *natTable) masquerade(packet []byte) bool {
+	if !table.enabled.Get() || len(packet) == 0 {
+		return true
+	}
+	ipv6 := packet[0]>>4 != ipv4.Version
+
+	table.Lock()
+	defer table.Unlock()
+
+	source := table.unsafeSource(ipv6)
+	if source == nil {
+		return true
+	}
+	var view natView
+	if !natParse(packet, &view, false) {
+		return false
+	}
+	now := time.Now()
+
+	// translate the destination of the quoted packet back to the NAT source
+
+	if view.quoted != nil {
+		var quoted natView
+		if !natParse(view.quoted, &quoted, true) || quoted.dstPort == nil {
+			return false
+		}
+		mapping := table.unsafeLookup(table.inside, newNATEndpoint(quoted.protocol, quoted.dst, quoted.dstPort), now)
+		if mapping == nil {
+			return false
+		}
+		natRewriteAddress(view.quoted, &quoted, quoted.dst, mapping.outside.address(ipv6))
+		natRewritePort(&quoted, quoted.dstPort, mapping.outside.port)
+		natRewriteAddress(packet, &view, view.src, mapping.outside.address(ipv6))
+		natICMPChecksum(&view)
+		return true
+	}
+
+	if view.srcPort == nil {
+		return false
+	}
+	inside := newNATEndpoint(view.protocol, view.src, view.srcPort)
+	mapping := table.unsafeLookup(table.inside, inside, now)
+	if mapping == nil {
+		mapping = table.unsafeAllocate(inside, ipv6, now)
+		if mapping == nil {
+			return false
+		}
+	}
+	mapping.expires = now.Add(natTimeout(&view))
+
+	natRewriteAddress(packet, &view, view.src, mapping.outside.address(ipv6))
+	natRewritePort(&view, view.srcPort, mapping.outside.port)
+	return true
+}
+
+/* Translates the destination of a packet read from the TUN device
+ * addressed to the NAT source, returns false if the packet is to be dropped
+ */
+func (table *natTable) unmasquerade(packet []byte) bool {
+	if !table.enabled.Get() || len(packet) == 0 {
+		return true
+	}
+	ipv6 := packet[0]>>4 != ipv4.Version
+
+	table.Lock()
+	defer table.Unlock()
+
+	source := table.unsafeSource(ipv6)
+	if source == nil {
+		return true
+	}
+	var view natView
+	if !natParse(packet, &view, false) || !source.Equal(view.dst) {
+		return true
+	}
+	now := time.Now()
+
+	// translate the source of the quoted packet back to the peer
+
+	if view.quoted != nil {
+		var quoted natView
+		if !natParse(view.quoted, &quoted, true) || quoted.srcPort == nil {
+			return true
+		}
+		mapping := table.unsafeLookup(table.outside, newNATEndpoint(quoted.protocol, quoted.src, quoted.srcPort), now)
+		if mapping == nil {
+			return true
+		}
+		natRewriteAddress(view.quoted, &quoted, quoted.src, mapping.inside.address(ipv6))
+		natRewritePort(&quoted, quoted.srcPort, mapping.inside.port)
+		natRewriteAddress(packet, &view, view.dst, mapping.inside.address(ipv6))
+		natICMPChecksum(&view)
+		return true
+	}
+
+	if view.dstPort == nil {
+		return true
+	}
+	mapping := table.unsafeLookup(table.outside, newNATEndpoint(view.protocol, view.dst, view.dstPort), now)
+	if mapping == nil {
+		return true
+	}
+	mapping.expires = now.Add(natTimeout(&view))
+
+	natRewriteAddress(packet, &view, view.dst, mapping.inside.address(ipv6))
+	natRewritePort(&view, view.dstPort, mapping.inside.port)
+	return true
+}
+
+/* Sets the NAT source address for its IP version, removing all mappings.
+ * A nil address disables masquerading for both IP versions.
+ */
+func (device *Device) SetNATSource(addr net.IP) {
+	table := &device.nat
+	table.Lock()
+	defer table.Unlock()
+
+	switch {
+	case addr == nil:
+		table.source4 = nil
+		table.source6 = nil
+	case addr.To4() != nil:
+		table.source4 = addr.To4()
+	default:
+		table.source6 = addr.To16()
+	}
+	table.inside = make(map[natEndpoint]*natMapping)
+	table.outside = make(map[natEndpoint]*natMapping)
+	table.count = [2]int{}
+	table.enabled.Set(table.source4 != nil || table.source6 != nil)
+}
+
+/* Returns the NAT source addresses and the number of mappings
+ */
+func (device *Device) NATSources() (sources []net.IP, mappings int) {
+	table := &device.nat
+	table.Lock()
+	defer table.Unlock()
+
+	for _, source := range []net.IP{table.source4, table.source6} {
+		if source != nil {
+			sources = append(sources, source)
+		}
+	}
+	return sources, table.count[0] + table.count[1]
+}
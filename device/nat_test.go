@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Swaps the addresses and ports of a TCP segment into its reply,
+ * which leaves all checksums intact
+ */
+func testTCPReply(packet []byte) []byte {
+	reply := append([]byte{}, packet...)
+	view := natView{}
+	natParse(reply, &view, false)
+	src := append([]byte{}, view.src...)
+	copy(view.src, view.dst)
+	copy(view.dst, src)
+	srcPort := append([]byte{}, view.srcPort...)
+	copy(view.srcPort, view.dstPort)
+	copy(view.dstPort, srcPort)
+	return reply
+}
+
+func testNATPacket(version int) []byte {
+	packet := testTCPSyn(version, nil)
+	if version == ipv4.Version {
+		binary.BigEndian.PutUint16(packet[IPv4offsetChecksum:], checksumFold(checksumAdd(0, packet[:ipv4.HeaderLen])))
+	}
+	return packet
+}
+
+func testNATEndpoint(t *testing.T, packet []byte, src bool) (net.IP, uint16) {
+	var view natView
+	if !natParse(packet, &view, false) {
+		t.Fatal("failed to parse translated packet")
+	}
+	if packet[0]>>4 == ipv4.Version && checksumFold(checksumAdd(0, packet[:ipv4.HeaderLen])) != 0 {
+		t.Error("invalid IPv4 header checksum")
+	}
+	if tcpChecksum(packet) != 0 {
+		t.Error("invalid TCP checksum")
+	}
+	if src {
+		return net.IP(view.src), binary.BigEndian.Uint16(view.srcPort)
+	}
+	return net.IP(view.dst), binary.BigEndian.Uint16(view.dstPort)
+}
+
+func TestNATMasquerade(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	for _, version := range []int{ipv4.Version, ipv6.Version} {
+		peer, other, source := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.3"), net.ParseIP("192.168.0.1")
+		if version == ipv6.Version {
+			peer, other, source = net.ParseIP("fd00::1"), net.ParseIP("fd00::3"), net.ParseIP("fd00:1::1")
+		}
+		device.SetNATSource(source)
+
+		// packets from the peer leave with the NAT source, preserving the port
+
+		packet := testNATPacket(version)
+		if !device.nat.masquerade(packet) {
+			t.Fatal("packet from peer dropped")
+		}
+		if addr, port := testNATEndpoint(t, packet, true); !addr.Equal(source) || port != 40000 {
+			t.Errorf("translated to %v port %d", addr, port)
+		}
+
+		// replies are translated back to the peer
+
+		reply := testTCPReply(packet)
+		if !device.nat.unmasquerade(reply) {
+			t.Fatal("reply dropped")
+		}
+		if addr, port := testNATEndpoint(t, reply, false); !addr.Equal(peer) || port != 40000 {
+			t.Errorf("reply translated to %v port %d", addr, port)
+		}
+
+		// another peer using the same port is assigned a different one
+
+		packet = testNATPacket(version)
+		var view natView
+		natParse(packet, &view, false)
+		natRewriteAddress(packet, &view, view.src, other.To16()[16-len(view.src):])
+		if !device.nat.masquerade(packet) {
+			t.Fatal("packet from other peer dropped")
+		}
+		if addr, port := testNATEndpoint(t, packet, true); !addr.Equal(source) || port < NATPortMin || port == 40000 {
+			t.Errorf("other peer translated to %v port %d", addr, port)
+		}
+		if _, mappings := device.NATSources(); mappings != 2 {
+			t.Errorf("%d mappings, expected 2", mappings)
+		}
+	}
+
+	if sources, _ := device.NATSources(); len(sources) != 2 {
+		t.Errorf("%d NAT sources, expected 2", len(sources))
+	}
+	device.SetNATSource(nil)
+	if sources, mappings := device.NATSources(); len(sources) != 0 || mappings != 0 {
+		t.Error("NAT not disabled")
+	}
+}
+
+func TestNATICMPError(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.SetNATSource(net.ParseIP("192.168.0.1"))
+
+	packet := testNATPacket(ipv4.Version)
+	if !device.nat.masquerade(packet) {
+		t.Fatal("packet from peer dropped")
+	}
+
+	// the error quoting the translated packet reaches the peer with the original quoted
+
+	var buf [MaxMessageSize]byte
+	size := createICMPv4Error(buf[:], packet, icmpv4TypeDestinationUnreachable, icmpv4CodeHostUnreachable, 0)
+	icmpError := buf[:size]
+	if !device.nat.unmasquerade(icmpError) {
+		t.Fatal("ICMP error dropped")
+	}
+	if !net.IP(icmpError[IPv4offsetDst : IPv4offsetDst+net.IPv4len]).Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("ICMP error not addressed to peer")
+	}
+	if checksumFold(checksumAdd(0, icmpError[:ipv4.HeaderLen])) != 0 {
+		t.Error("invalid IPv4 header checksum")
+	}
+	if checksumFold(checksumAdd(0, icmpError[ipv4.HeaderLen:])) != 0 {
+		t.Error("invalid ICMP checksum")
+	}
+	quoted := icmpError[ipv4.HeaderLen+icmpHeaderSize:]
+	if addr, port := testNATEndpoint(t, quoted[:len(packet)], true); !addr.Equal(net.ParseIP("10.0.0.1")) || port != 40000 {
+		t.Errorf("quoted packet translated to %v port %d", addr, port)
+	}
+}
+
+func TestNATUntranslatable(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	packet := testNATPacket(ipv4.Version)
+	binary.BigEndian.PutUint16(packet[IPv4offsetFlagsFragment:], ipv4FlagMoreFragments)
+	if !device.nat.masquerade(packet) {
+		t.Error("packet dropped with NAT disabled")
+	}
+
+	device.SetNATSource(net.ParseIP("192.168.0.1"))
+	if device.nat.masquerade(packet) {
+		t.Error("fragment translated")
+	}
+
+	// packets not addressed to the NAT source are left alone
+
+	packet = testNATPacket(ipv4.Version)
+	original := append([]byte{}, packet...)
+	if !device.nat.unmasquerade(packet) || string(packet) != string(original) {
+		t.Error("unrelated packet translated")
+	}
+}
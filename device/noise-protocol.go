@@ -15,9 +15,12 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
 
+	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/tai64n"
 )
 
+var errDisallowedEndpoint = errors.New("endpoint not allowed for peer")
+
 type handshakeState int
 
 // TODO(crawshaw): add commentary describing each state and the transitions
@@ -117,20 +120,23 @@ type MessageCookieReply struct {
 }
 
 type Handshake struct {
-	state                     handshakeState
-	mutex                     sync.RWMutex
-	hash                      [blake2s.Size]byte       // hash value
-	chainKey                  [blake2s.Size]byte       // chain key
-	presharedKey              NoiseSymmetricKey        // psk
-	localEphemeral            NoisePrivateKey          // ephemeral secret key
-	localIndex                uint32                   // used to clear hash-table
-	remoteIndex               uint32                   // index for sending
-	remoteStatic              NoisePublicKey           // long term key
-	remoteEphemeral           NoisePublicKey           // ephemeral public key
-	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
-	lastTimestamp             tai64n.Timestamp
-	lastInitiationConsumption time.Time
-	lastSentHandshake         time.Time
+	state                       handshakeState
+	mutex                       sync.RWMutex
+	presharedKeyRefresh         sync.Mutex         // serializes asking the provider, taken before mutex
+	*handshakeSecrets                              // in secure memory
+	secrets                     *secureBlock       // holding handshakeSecrets
+	hash                        [blake2s.Size]byte // hash value
+	previousPresharedKeyUntil   time.Time          // end of the grace period of previousPresharedKey
+	localIndex                  uint32             // used to clear hash-table
+	remoteIndex                 uint32             // index for sending
+	remoteStatic                NoisePublicKey     // long term key
+	remoteEphemeral             NoisePublicKey     // ephemeral public key
+	previousIdentityInitiations uint64             // initiations consumed for the previous identity
+	previousIdentity            bool               // the initiation consumed is for the previous identity
+	staticStaticPending         bool               // pre-computations with a delegated static key not done
+	lastTimestamp               tai64n.Timestamp
+	lastInitiationConsumption   time.Time
+	lastSentHandshake           time.Time
 }
 
 var (
@@ -178,10 +184,13 @@ func init() {
 func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, error) {
 	var errZeroECDHResult = errors.New("ECDH returned all zeros")
 
+	device.refreshPresharedKey(peer)
+
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
 	handshake := &peer.handshake
+	device.computePendingStaticStatic(handshake)
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
 
@@ -189,6 +198,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	var err error
 	handshake.hash = InitialHash
 	handshake.chainKey = InitialChainKey
+	handshake.previousIdentity = false
 	handshake.localEphemeral, err = newPrivateKey()
 	if err != nil {
 		return nil, err
@@ -248,68 +258,100 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, err := device.consumeMessageInitiation(msg, nil)
+	if err != nil {
+		return nil
+	}
+	return peer
+}
+
+/* Consumes an initiation received from the endpoint, if not nil,
+ * returning the peer with errDisallowedEndpoint before changing its handshake
+ * if the endpoint is not allowed for the peer, and errResolveRateLimited
+ * if an unknown initiator is not resolved for its source address
+ */
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation, endpoint conn.Endpoint) (*Peer, error) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
 	if msg.Type != MessageInitiationType {
-		return nil
+		return nil, nil
 	}
 
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
-	mixHash(&hash, &hash, msg.Ephemeral[:])
-	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
+	// decrypt static key, with the previous identity during rotation
 
-	// decrypt static key
-	var err error
 	var peerPK NoisePublicKey
-	var key [chacha20poly1305.KeySize]byte
-	ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-	if isZero(ss[:]) {
-		return nil
-	}
-	KDF2(&chainKey, &key, chainKey[:], ss[:])
-	aead, _ := chacha20poly1305.New(key[:])
-	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
-	if err != nil {
-		return nil
+	previous := false
+	if !device.openInitiationStatic(msg, false, &peerPK, &hash, &chainKey) {
+		if !device.staticIdentity.previous.accepting(time.Now()) ||
+			!device.openInitiationStatic(msg, true, &peerPK, &hash, &chainKey) {
+			return nil, nil
+		}
+		previous = true
 	}
-	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
 	peer := device.LookupPeer(peerPK)
 	if peer == nil {
-		return nil
+
+		// resolve unknown initiator once authenticated, without holding up changes of the identity
+
+		if !device.openInitiationTimestamp(msg, previous, peerPK, hash, chainKey) {
+			return nil, nil
+		}
+		if endpoint != nil && device.peerResolver() != nil && !device.resolutions.limiter.Allow(endpoint.DstIP()) {
+			return nil, errResolveRateLimited
+		}
+		publicKey := device.staticIdentity.publicKey
+		device.staticIdentity.RUnlock()
+		peer = device.resolvePeer(peerPK)
+		device.staticIdentity.RLock()
+		if peer == nil || device.staticIdentity.publicKey != publicKey {
+			return nil, nil
+		}
+	}
+
+	// check source address before changing the handshake
+
+	if endpoint != nil && !peer.endpointAllowed(endpoint) {
+		return peer, errDisallowedEndpoint
 	}
 
 	handshake := &peer.handshake
+	device.computePendingStaticStatic(handshake)
 
 	// verify identity
 
 	var timestamp tai64n.Timestamp
+	var key [chacha20poly1305.KeySize]byte
 
 	handshake.mutex.RLock()
 
-	if isZero(handshake.precomputedStaticStatic[:]) {
+	precomputedStaticStatic := &handshake.precomputedStaticStatic
+	if previous {
+		precomputedStaticStatic = &handshake.precomputedStaticStaticPrevious
+	}
+	if isZero(precomputedStaticStatic[:]) {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, nil
 	}
 	KDF2(
 		&chainKey,
 		&key,
 		chainKey[:],
-		handshake.precomputedStaticStatic[:],
+		precomputedStaticStatic[:],
 	)
-	aead, _ = chacha20poly1305.New(key[:])
-	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err := aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, nil
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
@@ -320,11 +362,23 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.mutex.RUnlock()
 	if replay {
 		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, timestamp)
-		return nil
+		return nil, nil
 	}
 	if flood {
 		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake flood\n", peer)
-		return nil
+		return nil, nil
+	}
+
+	// ask the provider for the preshared key, without holding up changes of the identity
+
+	if device.pskProvider() != nil {
+		publicKey := device.staticIdentity.publicKey
+		device.staticIdentity.RUnlock()
+		device.refreshPresharedKey(peer)
+		device.staticIdentity.RLock()
+		if device.staticIdentity.publicKey != publicKey {
+			return nil, nil
+		}
 	}
 
 	// update handshake state
@@ -343,16 +397,76 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 		handshake.lastInitiationConsumption = now
 	}
 	handshake.state = handshakeInitiationConsumed
+	handshake.previousIdentity = previous
+	if previous {
+		handshake.previousIdentityInitiations++
+	}
 
 	handshake.mutex.Unlock()
 
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return peer
+	if previous {
+		device.log.Info.Println(peer, "- Received initiation for previous static key")
+	}
+
+	return peer, nil
+}
+
+/* Decrypts the static key of the initiator with the current or the previous identity
+ *
+ * Must hold device.staticIdentity.RLock
+ */
+func (device *Device) openInitiationStatic(msg *MessageInitiation, previous bool, peerPK *NoisePublicKey, hash *[blake2s.Size]byte, chainKey *[blake2s.Size]byte) bool {
+	publicKey := &device.staticIdentity.publicKey
+	if previous {
+		publicKey = &device.staticIdentity.previous.publicKey
+	}
+
+	mixHash(hash, &InitialHash, publicKey[:])
+	mixHash(hash, hash, msg.Ephemeral[:])
+	mixKey(chainKey, &InitialChainKey, msg.Ephemeral[:])
+
+	var key [chacha20poly1305.KeySize]byte
+	ss := device.staticSharedSecret(previous, msg.Ephemeral)
+	if isZero(ss[:]) {
+		return false
+	}
+	KDF2(chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err := aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
+	if err != nil {
+		return false
+	}
+	mixHash(hash, hash, msg.Static[:])
+	return true
+}
+
+/* Authenticates the timestamp of an initiation from a peer not configured on the device
+ *
+ * Must hold device.staticIdentity.RLock
+ */
+func (device *Device) openInitiationTimestamp(msg *MessageInitiation, previous bool, peerPK NoisePublicKey, hash [blake2s.Size]byte, chainKey [blake2s.Size]byte) bool {
+	var timestamp tai64n.Timestamp
+	var key [chacha20poly1305.KeySize]byte
+
+	ss := device.staticSharedSecret(previous, peerPK)
+	defer setZero(ss[:])
+	defer setZero(chainKey[:])
+	if isZero(ss[:]) {
+		return false
+	}
+	KDF2(&chainKey, &key, chainKey[:], ss[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err := aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
+	return err == nil
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
@@ -381,6 +495,8 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	if err != nil {
 		return nil, err
 	}
+	presharedKey := &handshake.presharedKey
+	device.logHandshakeKeys(handshake, presharedKey)
 	msg.Ephemeral = handshake.localEphemeral.publicKey()
 	handshake.mixHash(msg.Ephemeral[:])
 	handshake.mixKey(msg.Ephemeral[:])
@@ -402,7 +518,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		&tau,
 		&key,
 		handshake.chainKey[:],
-		handshake.presharedKey[:],
+		presharedKey[:],
 	)
 
 	handshake.mixHash(tau[:])
@@ -419,16 +535,34 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
-	if msg.Type != MessageResponseType {
+	peer, err := device.consumeMessageResponse(msg, nil)
+	if err != nil {
 		return nil
 	}
+	return peer
+}
+
+/* Consumes a response received from the endpoint, if not nil,
+ * returning the peer with errDisallowedEndpoint before changing its handshake
+ * if the endpoint is not allowed for the peer
+ */
+func (device *Device) consumeMessageResponse(msg *MessageResponse, endpoint conn.Endpoint) (*Peer, error) {
+	if msg.Type != MessageResponseType {
+		return nil, nil
+	}
 
 	// lookup handshake by receiver
 
 	lookup := device.indexTable.Lookup(msg.Receiver)
 	handshake := lookup.handshake
 	if handshake == nil {
-		return nil
+		return nil, nil
+	}
+
+	// check source address before changing the handshake
+
+	if endpoint != nil && !lookup.peer.endpointAllowed(endpoint) {
+		return lookup.peer, errDisallowedEndpoint
 	}
 
 	var (
@@ -438,6 +572,17 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 
 	ok := func() bool {
 
+		// lock private key for reading, and compute its shared secret before locking the handshake
+
+		device.staticIdentity.RLock()
+		defer device.staticIdentity.RUnlock()
+
+		ss := device.staticSharedSecret(false, msg.Ephemeral)
+		defer setZero(ss[:])
+		if isZero(ss[:]) {
+			return false
+		}
+
 		// lock handshake state
 
 		handshake.mutex.RLock()
@@ -447,11 +592,6 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			return false
 		}
 
-		// lock private key for reading
-
-		device.staticIdentity.RLock()
-		defer device.staticIdentity.RUnlock()
-
 		// finish 3-way DH
 
 		mixHash(&hash, &handshake.hash, msg.Ephemeral[:])
@@ -463,38 +603,45 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			setZero(ss[:])
 		}()
 
-		func() {
-			ss := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-			mixKey(&chainKey, &chainKey, ss[:])
-			setZero(ss[:])
-		}()
-
-		// add preshared key (psk)
+		mixKey(&chainKey, &chainKey, ss[:])
 
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
-
-		// authenticate transcript
+		// add preshared key (psk), or the previous one during rotation
 
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			return false
+		presharedKeys := []*NoiseSymmetricKey{&handshake.presharedKey}
+		if time.Now().Before(handshake.previousPresharedKeyUntil) {
+			presharedKeys = append(presharedKeys, &handshake.previousPresharedKey)
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		initialHash, initialChainKey := hash, chainKey
+
+		for _, presharedKey := range presharedKeys {
+			hash, chainKey = initialHash, initialChainKey
+
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			KDF3(
+				&chainKey,
+				&tau,
+				&key,
+				chainKey[:],
+				presharedKey[:],
+			)
+			mixHash(&hash, &hash, tau[:])
+
+			// authenticate transcript
+
+			aead, _ := chacha20poly1305.New(key[:])
+			_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
+			if err == nil {
+				mixHash(&hash, &hash, msg.Empty[:])
+				device.logHandshakeKeys(handshake, presharedKey)
+				return true
+			}
+		}
+		return false
 	}()
 
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	// update handshake state
@@ -511,7 +658,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return lookup.peer
+	return lookup.peer, nil
 }
 
 /* Derives a new keypair from the current handshake state
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.zx2c4.com/wireguard/conn"
@@ -21,15 +22,6 @@ const (
 )
 
 type Peer struct {
-	isRunning                   AtomicBool
-	sync.RWMutex                // Mostly protects endpoint, but is generally taken whenever we modify peer
-	keypairs                    Keypairs
-	handshake                   Handshake
-	device                      *Device
-	endpoint                    conn.Endpoint
-	persistentKeepaliveInterval uint16
-	disableRoaming              bool
-
 	// These fields are accessed with atomic operations, which must be
 	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
 	// allocated struct will be 64-bit aligned. So we place
@@ -39,14 +31,25 @@ type Peer struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
+		drops             dropCounters
 	}
 
+	isRunning                   AtomicBool
+	sync.RWMutex                // Mostly protects endpoint, but is generally taken whenever we modify peer
+	keypairs                    Keypairs
+	handshake                   Handshake
+	device                      *Device
+	endpoint                    conn.Endpoint
+	persistentKeepaliveInterval uint16
+	disableRoaming              bool
+
 	timers struct {
 		retransmitHandshake     *Timer
 		sendKeepalive           *Timer
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		pathMTUProbe            *Timer
 		handshakeAttempts       uint32
 		needAnotherKeepalive    AtomicBool
 		sentLastMinuteHandshake AtomicBool
@@ -61,6 +64,7 @@ type Peer struct {
 		nonce                           chan *QueueOutboundElement // nonce / pre-handshake queue
 		outbound                        chan *QueueOutboundElement // sequential ordering of work
 		inbound                         chan *QueueInboundElement  // sequential ordering of work
+		fq                              *fqCodel                   // fair queueing in front of the nonce queue
 		packetInNonceQueueIsAwaitingKey AtomicBool
 	}
 
@@ -71,6 +75,34 @@ type Peer struct {
 		stop       chan struct{}  // size 0, stop all go routines in peer
 	}
 
+	mtu struct {
+		path   int32      // path MTU towards the endpoint (0 = unknown)
+		tunnel int32      // largest inner packet fitting into the path MTU (0 = unknown)
+		clamp  AtomicBool // limit inner packets to the tunnel MTU of this peer
+	}
+
+	rateLimit struct {
+		tx tokenBucket // egress shaping
+		rx tokenBucket // ingress policing
+	}
+
+	acl              atomic.Value // *accessList
+	aclFlows         aclFlows
+	allowedEndpoints atomic.Value // []net.IPNet, empty accepts any source address
+	hubIsolated      AtomicBool   // excluded from forwarding in hub mode
+
+	roaming struct {
+		disabled AtomicBool     // configured through UAPI, unlike disableRoaming
+		history  roamingHistory // protected by peer.RWMutex
+	}
+
+	expiry struct {
+		expiresAt   time.Time     // removed at, zero if never
+		idleTimeout time.Duration // removed after no traffic for, 0 if never
+		traffic     uint64        // sent and received as of active
+		active      time.Time
+	} // protected by device.expiry.Mutex
+
 	cookieGenerator CookieGenerator
 }
 
@@ -101,6 +133,12 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
+	var err error
+	peer.handshake.handshakeSecrets, peer.handshake.secrets, err = newHandshakeSecrets()
+	if err != nil {
+		device.log.Debug.Println("Failed to protect key material of peer in memory:", err)
+	}
+	peer.queue.fq = newFQCodel(peer)
 	peer.isRunning.Set(false)
 
 	// map public key
@@ -114,8 +152,8 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
-	handshake.precomputedStaticStatic = device.staticIdentity.privateKey.sharedSecret(pk)
 	handshake.remoteStatic = pk
+	device.unsafePrecomputeStaticStatic(handshake, device.staticIdentity.previous.accepting(time.Now()))
 	handshake.mutex.Unlock()
 
 	// reset endpoint
@@ -153,10 +191,17 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 	err := peer.device.net.bind.Send(buffer, peer.endpoint)
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+		peer.device.captureOuter(peer, peer.endpoint, buffer, true)
+	} else if errors.Is(err, syscall.EMSGSIZE) {
+		peer.unsafeUpdatePathMTU(peer.device.net.bind, peer.endpoint)
 	}
 	return err
 }
 
+func (peer *Peer) PublicKey() NoisePublicKey {
+	return peer.handshake.remoteStatic
+}
+
 func (peer *Peer) String() string {
 	base64Key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
 	abbreviatedKey := "invalid"
@@ -290,13 +335,3 @@ func (peer *Peer) Stop() {
 
 	peer.ZeroAndFlushAll()
 }
-
-
-func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
-	if peer.disableRoaming {
-		return
-	}
-	peer.Lock()
-	peer.endpoint = endpoint
-	peer.Unlock()
-}
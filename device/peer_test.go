@@ -40,4 +40,10 @@ func TestPeerAlignment(t *testing.T) {
 
 	checkAlignment(t, "Peer.stats", unsafe.Offsetof(p.stats))
 	checkAlignment(t, "Peer.isRunning", unsafe.Offsetof(p.isRunning))
+	checkAlignment(t, "Peer.stats.drops", unsafe.Offsetof(p.stats)+unsafe.Offsetof(p.stats.drops))
+}
+
+func TestDeviceAlignment(t *testing.T) {
+	var d Device
+	checkAlignment(t, "Device.drops", unsafe.Offsetof(d.drops))
 }
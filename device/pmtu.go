@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Outer path MTU discovery
+ *
+ * With path MTU discovery enabled, datagrams are sent with the don't-fragment bit set,
+ * such that the kernel learns the path MTU towards each endpoint,
+ * both from local EMSGSIZE errors and from ICMP errors returned by routers.
+ *
+ * The path MTU of a peer is refreshed from the bind whenever sending fails with EMSGSIZE,
+ * and periodically, after sending a probe: a keepalive padded to fill the device MTU.
+ * Receivers discard its all-zero plaintext like a keepalive.
+ */
+
+const (
+	PathMTUProbeDelay    = time.Second // delay of the first probe after a handshake
+	PathMTUProbeInterval = time.Minute
+	udpHeaderLen         = 8
+)
+
+func (device *Device) BindSetPathMTUDiscovery(enabled bool) error {
+
+	device.net.Lock()
+	defer device.net.Unlock()
+
+	// check if modified
+
+	if device.net.pathMTUDiscovery.Get() == enabled {
+		return nil
+	}
+
+	// update existing bind
+
+	if device.isUp.Get() && device.net.bind != nil {
+		pmtud, ok := device.net.bind.(conn.PathMTUDiscovery)
+		if !ok {
+			return errors.New("path MTU discovery not supported by bind")
+		}
+		if err := pmtud.SetPathMTUDiscovery(enabled); err != nil {
+			return err
+		}
+	}
+	device.net.pathMTUDiscovery.Set(enabled)
+
+	// forget learned path MTUs
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.resetPathMTU()
+		if enabled && peer.timersActive() {
+			peer.timers.pathMTUProbe.Mod(PathMTUProbeDelay)
+		}
+	}
+	device.peers.RUnlock()
+
+	return nil
+}
+
+func (peer *Peer) resetPathMTU() {
+	atomic.StoreInt32(&peer.mtu.path, 0)
+	atomic.StoreInt32(&peer.mtu.tunnel, 0)
+}
+
+/* Refreshes the path MTU towards the endpoint from the bind
+ *
+ * Must hold peer.device.net.RWMutex and peer.RWMutex (for reading)
+ */
+func (peer *Peer) unsafeUpdatePathMTU(bind conn.Bind, endpoint conn.Endpoint) {
+	pmtud, ok := bind.(conn.PathMTUDiscovery)
+	if !ok {
+		return
+	}
+
+	mtu, err := pmtud.PathMTU(endpoint)
+	if err != nil {
+		peer.device.log.Debug.Println(peer, "- Failed to determine path MTU:", err)
+		return
+	}
+
+	// subtract the outer headers and keep room for padding
+
+	overhead := ipv4.HeaderLen + udpHeaderLen + MessageTransportSize
+	if endpoint.DstIP().To4() == nil {
+		overhead = ipv6.HeaderLen + udpHeaderLen + MessageTransportSize
+	}
+	tunnel := (mtu - overhead) &^ (PaddingMultiple - 1)
+	if tunnel <= 0 {
+		return
+	}
+
+	atomic.StoreInt32(&peer.mtu.tunnel, int32(tunnel))
+	if old := atomic.SwapInt32(&peer.mtu.path, int32(mtu)); int(old) != mtu {
+		peer.device.log.Debug.Println(peer, "- Path MTU updated:", mtu, "(tunnel MTU", tunnel, "bytes)")
+	}
+}
+
+/* Returns the largest inner packet which fits
+ * into the path MTU towards the peer
+ */
+func (peer *Peer) tunnelMTU() int {
+	mtu := peer.device.tunnelMTU()
+	if tunnel := int(atomic.LoadInt32(&peer.mtu.tunnel)); tunnel > 0 && tunnel < mtu {
+		mtu = tunnel
+	}
+	return mtu
+}
+
+/* Returns the MTU enforced on inner packets to and from the peer
+ */
+func (peer *Peer) enforcedMTU() int {
+	if peer.mtu.clamp.Get() {
+		return peer.tunnelMTU()
+	}
+	return peer.device.tunnelMTU()
+}
+
+/* Queues a path MTU probe, a keepalive padded to fill the device MTU,
+ * if a current keypair is available
+ */
+func (peer *Peer) SendPathMTUProbe() bool {
+	if !peer.isRunning.Get() || peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		return false
+	}
+	keypair := peer.keypairs.Current()
+	if keypair == nil || time.Since(keypair.created) >= RejectAfterTime {
+		return false
+	}
+	size := int(atomic.LoadInt32(&peer.device.tun.mtu))
+	if size <= 0 || size > MaxContentSize {
+		return false
+	}
+
+	elem := peer.device.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+size]
+	setZero(elem.packet)
+	select {
+	case peer.queue.nonce <- elem:
+		peer.device.log.Debug.Println(peer, "- Sending path MTU probe of", size, "bytes")
+		return true
+	default:
+		peer.device.PutMessageBuffer(elem.buffer)
+		peer.device.PutOutboundElement(elem)
+		return false
+	}
+}
+
+func expiredPathMTUProbe(peer *Peer) {
+	device := peer.device
+	if !device.net.pathMTUDiscovery.Get() {
+		return
+	}
+
+	// pick up what was learned from the previous probe
+
+	device.net.RLock()
+	peer.RLock()
+	if device.net.bind != nil && peer.endpoint != nil {
+		peer.unsafeUpdatePathMTU(device.net.bind, peer.endpoint)
+	}
+	peer.RUnlock()
+	device.net.RUnlock()
+
+	if peer.SendPathMTUProbe() && peer.timersActive() {
+		peer.timers.pathMTUProbe.Mod(PathMTUProbeInterval)
+	}
+}
@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestPathMTUProbe(t *testing.T) {
+	newKey := func() NoisePrivateKey {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sk
+	}
+	newDevice := func(name string, config string) (*Device, *tuntest.ChannelTUN) {
+		tun := tuntest.NewChannelTUN()
+		device := NewDevice(tun.TUN(), NewLogger(LogLevelError, name+": "))
+		device.Up()
+		if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			t.Fatal(err)
+		}
+		return device, tun
+	}
+
+	sk1, sk2 := newKey(), newKey()
+	port1, port2 := getFreePort(t), getFreePort(t)
+	dev1, tun1 := newDevice("dev1", fmt.Sprintf(
+		"private_key=%s\nlisten_port=%s\npmtu_discovery=true\npublic_key=%s\nallowed_ip=1.0.0.2/32\nendpoint=127.0.0.1:%s\n",
+		sk1.ToHex(), port1, sk2.publicKey().ToHex(), port2))
+	defer dev1.Close()
+	dev2, tun2 := newDevice("dev2", fmt.Sprintf(
+		"private_key=%s\nlisten_port=%s\npmtu_discovery=true\npublic_key=%s\nallowed_ip=1.0.0.1/32\n",
+		sk2.ToHex(), port2, sk1.publicKey().ToHex()))
+	defer dev2.Close()
+	peer2 := dev1.LookupPeer(sk2.publicKey())
+	peer1 := dev2.LookupPeer(sk1.publicKey())
+
+	msg := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tun1.Outbound <- msg
+	select {
+	case received := <-tun2.Inbound:
+		if !bytes.Equal(msg, received) {
+			t.Fatal("ping corrupted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	// probes are keepalives padded to fill the MTU, which receivers discard
+
+	txBytes := atomic.LoadUint64(&peer2.stats.txBytes)
+	rxBytes := atomic.LoadUint64(&peer1.stats.rxBytes)
+	if !peer2.SendPathMTUProbe() {
+		t.Fatal("failed to send path MTU probe")
+	}
+	probeSize := uint64(MessageTransportSize + tuntest.DefaultMTU)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&peer1.stats.rxBytes) < rxBytes+probeSize && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sent := atomic.LoadUint64(&peer2.stats.txBytes) - txBytes; sent != probeSize {
+		t.Errorf("probe of %d bytes, expected %d", sent, probeSize)
+	}
+	if received := atomic.LoadUint64(&peer1.stats.rxBytes) - rxBytes; received < probeSize {
+		t.Errorf("received %d bytes, expected a probe of %d", received, probeSize)
+	}
+	if drops := peer1.DropCounters()[DropInvalidPacket]; drops != 0 {
+		t.Errorf("%d probes dropped as invalid packets", drops)
+	}
+	select {
+	case packet := <-tun2.Inbound:
+		t.Errorf("probe delivered to TUN device: %x", packet)
+	default:
+	}
+
+	// the path MTU towards the endpoint, from its sticky source, is read from the bind
+
+	dev2.net.RLock()
+	bind := dev2.net.bind
+	if _, ok := bind.(conn.PathMTUDiscovery); !ok {
+		dev2.net.RUnlock()
+		t.Skip("path MTU discovery not supported by bind")
+	}
+	peer1.RLock()
+	peer1.unsafeUpdatePathMTU(bind, peer1.endpoint)
+	peer1.RUnlock()
+	dev2.net.RUnlock()
+
+	path := int(atomic.LoadInt32(&peer1.mtu.path))
+	if path <= ipv4.HeaderLen+udpHeaderLen+MessageTransportSize {
+		t.Fatalf("path MTU %d to loopback", path)
+	}
+	tunnel := (path - ipv4.HeaderLen - udpHeaderLen - MessageTransportSize) &^ (PaddingMultiple - 1)
+	if int(atomic.LoadInt32(&peer1.mtu.tunnel)) != tunnel {
+		t.Errorf("tunnel MTU %d, expected %d for path MTU %d", peer1.mtu.tunnel, tunnel, path)
+	}
+	expected := dev2.tunnelMTU()
+	if tunnel < expected {
+		expected = tunnel
+	}
+	if peer1.tunnelMTU() != expected {
+		t.Errorf("peer tunnel MTU %d, expected %d", peer1.tunnelMTU(), expected)
+	}
+}
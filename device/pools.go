@@ -65,6 +65,10 @@ func (device *Device) GetInboundElement() *QueueInboundElement {
 }
 
 func (device *Device) PutInboundElement(msg *QueueInboundElement) {
+	if msg.trace != nil {
+		device.trace.commit(msg.trace)
+		msg.trace = nil
+	}
 	if PreallocatedBuffersPerPool == 0 {
 		device.pool.inboundElementPool.Put(msg)
 	} else {
@@ -81,6 +85,10 @@ func (device *Device) GetOutboundElement() *QueueOutboundElement {
 }
 
 func (device *Device) PutOutboundElement(msg *QueueOutboundElement) {
+	if msg.trace != nil {
+		device.trace.commit(msg.trace)
+		msg.trace = nil
+	}
 	if PreallocatedBuffersPerPool == 0 {
 		device.pool.outboundElementPool.Put(msg)
 	} else {
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/subtle"
+	"time"
+)
+
+/* Preshared key providers
+ *
+ * A PSKProvider installed on the device is asked for the preshared key of a peer
+ * before each handshake initiation created or consumed, replacing the configured one.
+ * The provider is called without holding the locks of the identity or the handshake,
+ * calls for the same peer are serialized so that keys are stored in the order provided.
+ *
+ * Once the key changes, the previous one remains accepted during PresharedKeyGracePeriod:
+ * responses are always created with the current key, and the initiator accepts responses
+ * created with the current or the previous one. The remote peer must rotate
+ * within the grace period.
+ */
+
+const PresharedKeyGracePeriod = RekeyTimeout * 6
+
+type PSKProvider interface {
+	PresharedKey(publicKey NoisePublicKey) (NoiseSymmetricKey, error)
+}
+
+type pskProviderHolder struct {
+	PSKProvider
+}
+
+/* Installs a preshared key provider on the device,
+ * a nil provider keeps the preshared keys last provided
+ */
+func (device *Device) SetPSKProvider(provider PSKProvider) {
+	device.psk.Store(pskProviderHolder{provider})
+}
+
+func (device *Device) pskProvider() PSKProvider {
+	holder, _ := device.psk.Load().(pskProviderHolder)
+	return holder.PSKProvider
+}
+
+/* Updates the preshared key of the peer from the provider,
+ * keeping the current one if the provider fails
+ *
+ * Must not hold device.staticIdentity or peer.handshake.mutex
+ */
+func (device *Device) refreshPresharedKey(peer *Peer) {
+	provider := device.pskProvider()
+	if provider == nil {
+		return
+	}
+
+	handshake := &peer.handshake
+	handshake.presharedKeyRefresh.Lock()
+	defer handshake.presharedKeyRefresh.Unlock()
+
+	psk, err := provider.PresharedKey(handshake.remoteStatic)
+	if err != nil {
+		device.log.Error.Println(peer, "- Failed to obtain preshared key:", err)
+		return
+	}
+
+	handshake.mutex.Lock()
+	defer handshake.mutex.Unlock()
+
+	if subtle.ConstantTimeCompare(psk[:], handshake.presharedKey[:]) == 1 {
+		return
+	}
+	handshake.previousPresharedKey = handshake.presharedKey
+	handshake.previousPresharedKeyUntil = time.Now().Add(PresharedKeyGracePeriod)
+	handshake.presharedKey = psk
+	setZero(psk[:])
+	device.log.Debug.Println(peer, "- Preshared key rotated")
+}
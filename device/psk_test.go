@@ -0,0 +1,122 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+type testPSKProvider struct {
+	sync.Mutex
+	psk NoiseSymmetricKey
+}
+
+func (provider *testPSKProvider) PresharedKey(publicKey NoisePublicKey) (NoiseSymmetricKey, error) {
+	provider.Lock()
+	defer provider.Unlock()
+	return provider.psk, nil
+}
+
+func (provider *testPSKProvider) set(psk NoiseSymmetricKey) {
+	provider.Lock()
+	defer provider.Unlock()
+	provider.psk = psk
+}
+
+func TestPSKProvider(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	provider1 := &testPSKProvider{psk: NoiseSymmetricKey{1}}
+	provider2 := &testPSKProvider{psk: NoiseSymmetricKey{1}}
+	dev1.SetPSKProvider(provider1)
+	dev2.SetPSKProvider(provider2)
+
+	handshake := func() bool {
+		peer1.handshake.mutex.Lock()
+		peer1.handshake.lastInitiationConsumption = time.Time{}
+		peer1.handshake.lastTimestamp = tai64n.Timestamp{}
+		peer1.handshake.mutex.Unlock()
+
+		initiation, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		if dev2.ConsumeMessageInitiation(initiation) != peer1 {
+			t.Fatal("initiation not consumed")
+		}
+		response, err := dev2.CreateMessageResponse(peer1)
+		assertNil(t, err)
+		return dev1.ConsumeMessageResponse(response) == peer2
+	}
+	endGracePeriods := func() {
+		for _, peer := range []*Peer{peer1, peer2} {
+			peer.handshake.mutex.Lock()
+			peer.handshake.previousPresharedKeyUntil = time.Now()
+			peer.handshake.mutex.Unlock()
+		}
+	}
+
+	// providers are asked before each handshake
+
+	if !handshake() {
+		t.Fatal("handshake with provided preshared key failed")
+	}
+	if peer1.handshake.presharedKey != (NoiseSymmetricKey{1}) || peer2.handshake.presharedKey != (NoiseSymmetricKey{1}) {
+		t.Fatal("preshared key not taken from provider")
+	}
+	endGracePeriods()
+
+	// the initiator rotating first accepts the previous key
+
+	provider1.set(NoiseSymmetricKey{2})
+	if !handshake() {
+		t.Error("handshake failed with initiator rotating first")
+	}
+	provider2.set(NoiseSymmetricKey{2})
+	if !handshake() {
+		t.Error("handshake failed after rotation")
+	}
+	endGracePeriods()
+
+	// the responder rotating later responds with the current key,
+	// even once the grace period of the initiator has ended
+
+	provider1.set(NoiseSymmetricKey{3})
+	if !handshake() {
+		t.Error("handshake failed with initiator rotating first")
+	}
+	provider2.set(NoiseSymmetricKey{3})
+	peer2.handshake.mutex.Lock()
+	peer2.handshake.previousPresharedKeyUntil = time.Now()
+	peer2.handshake.mutex.Unlock()
+	if !handshake() {
+		t.Error("handshake failed after the grace period of the initiator")
+	}
+	endGracePeriods()
+
+	// the previous key is no longer accepted after the grace period
+
+	provider1.set(NoiseSymmetricKey{4})
+	if !handshake() {
+		t.Error("handshake failed with initiator rotating first")
+	}
+	endGracePeriods()
+	if handshake() {
+		t.Error("handshake with previous key succeeded after grace period")
+	}
+
+	provider2.set(NoiseSymmetricKey{4})
+	if !handshake() {
+		t.Error("handshake failed after rotation")
+	}
+}
@@ -34,7 +34,9 @@ type QueueInboundElement struct {
 	packet   []byte
 	counter  uint64
 	keypair  *Keypair
+	peer     *Peer
 	endpoint conn.Endpoint
+	trace    *packetTrace // stages passed, if traced
 }
 
 func (elem *QueueInboundElement) Drop() {
@@ -52,11 +54,15 @@ func (device *Device) addToInboundAndDecryptionQueues(inboundQueue chan *QueueIn
 		case decryptionQueue <- element:
 			return true
 		default:
+			element.peer.drop(DropQueueFull)
+			element.trace.drop(DropQueueFull)
 			element.Drop()
 			element.Unlock()
 			return false
 		}
 	default:
+		element.peer.drop(DropQueueFull)
+		element.trace.drop(DropQueueFull)
 		device.PutInboundElement(element)
 		return false
 	}
@@ -131,6 +137,7 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 		}
 
 		if size < MinMessageSize {
+			device.drop(DropInvalidPacket)
 			continue
 		}
 
@@ -138,6 +145,7 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 
 		packet := buffer[:size]
 		msgType := binary.LittleEndian.Uint32(packet[:4])
+		device.captureOuter(nil, endpoint, packet, false)
 
 		var okay bool
 
@@ -150,6 +158,7 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			// check size
 
 			if len(packet) < MessageTransportSize {
+				device.drop(DropInvalidPacket)
 				continue
 			}
 
@@ -161,12 +170,21 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			value := device.indexTable.Lookup(receiver)
 			keypair := value.keypair
 			if keypair == nil {
+				device.drop(DropUnknownIndex)
 				continue
 			}
 
 			// check keypair expiry
 
 			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				value.peer.drop(DropExpiredKeypair)
+				continue
+			}
+
+			// check source address
+
+			if !value.peer.endpointAllowed(endpoint) {
+				value.peer.drop(DropDisallowedEndpoint)
 				continue
 			}
 
@@ -176,15 +194,19 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			elem.packet = packet
 			elem.buffer = buffer
 			elem.keypair = keypair
+			elem.peer = peer
 			elem.dropped = AtomicFalse
 			elem.endpoint = endpoint
 			elem.counter = 0
 			elem.Mutex = sync.Mutex{}
+			elem.trace = nil
 			elem.Lock()
 
 			// add to decryption queues
 
 			if peer.isRunning.Get() {
+				elem.trace = device.trace.start(false, peer, traceBindReceive)
+				elem.trace.record(traceDecryptionQueue)
 				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
 					buffer = device.GetMessageBuffer()
 				}
@@ -207,7 +229,9 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			logDebug.Println("Received message with unknown type")
 		}
 
-		if okay {
+		if !okay {
+			device.drop(DropInvalidPacket)
+		} else {
 			if (device.addToHandshakeQueue(
 				device.queue.handshake,
 				QueueHandshakeElement{
@@ -218,6 +242,8 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 				},
 			)) {
 				buffer = device.GetMessageBuffer()
+			} else {
+				device.drop(DropQueueFull)
 			}
 		}
 	}
@@ -280,8 +306,12 @@ func (device *Device) RoutineDecryption() {
 				nil,
 			)
 			if err != nil {
+				elem.peer.drop(DropDecryptionFailed)
+				elem.trace.drop(DropDecryptionFailed)
 				elem.Drop()
 				device.PutMessageBuffer(elem.buffer)
+			} else {
+				elem.trace.record(traceDecryption)
 			}
 			elem.Unlock()
 		}
@@ -347,6 +377,7 @@ func (device *Device) RoutineHandshake() {
 			entry := device.indexTable.Lookup(reply.Receiver)
 
 			if entry.peer == nil {
+				device.drop(DropUnknownIndex)
 				continue
 			}
 
@@ -365,8 +396,10 @@ func (device *Device) RoutineHandshake() {
 
 			// check mac fields and maybe ratelimit
 
-			if !device.cookieChecker.CheckMAC1(elem.packet) {
+			checker := device.cookieCheckerFor(elem.packet)
+			if checker == nil {
 				logDebug.Println("Received packet with invalid mac1")
+				device.drop(DropHandshakeInvalidMAC)
 				continue
 			}
 
@@ -376,7 +409,8 @@ func (device *Device) RoutineHandshake() {
 
 				// verify MAC2 field
 
-				if !device.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+				if !checker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+					device.drop(DropHandshakeRateLimited)
 					device.SendHandshakeCookie(&elem)
 					continue
 				}
@@ -384,6 +418,7 @@ func (device *Device) RoutineHandshake() {
 				// check ratelimiter
 
 				if !device.rate.limiter.Allow(elem.endpoint.DstIP()) {
+					device.drop(DropHandshakeRateLimited)
 					continue
 				}
 			}
@@ -410,12 +445,23 @@ func (device *Device) RoutineHandshake() {
 
 			// consume initiation
 
-			peer := device.ConsumeMessageInitiation(&msg)
+			peer, err := device.consumeMessageInitiation(&msg, elem.endpoint)
+			if err == errResolveRateLimited {
+				logDebug.Println("Too many peer resolutions from", elem.endpoint.DstToString())
+				device.drop(DropHandshakeRateLimited)
+				continue
+			}
+			if err == errDisallowedEndpoint {
+				logInfo.Println(peer, "- Received handshake initiation from disallowed endpoint", elem.endpoint.DstToString())
+				peer.drop(DropDisallowedEndpoint)
+				continue
+			}
 			if peer == nil {
 				logInfo.Println(
 					"Received invalid initiation message from",
 					elem.endpoint.DstToString(),
 				)
+				device.drop(DropHandshakeInvalid)
 				continue
 			}
 
@@ -446,12 +492,18 @@ func (device *Device) RoutineHandshake() {
 
 			// consume response
 
-			peer := device.ConsumeMessageResponse(&msg)
+			peer, err := device.consumeMessageResponse(&msg, elem.endpoint)
+			if err == errDisallowedEndpoint {
+				logInfo.Println(peer, "- Received handshake response from disallowed endpoint", elem.endpoint.DstToString())
+				peer.drop(DropDisallowedEndpoint)
+				continue
+			}
 			if peer == nil {
 				logInfo.Println(
 					"Received invalid response message from",
 					elem.endpoint.DstToString(),
 				)
+				device.drop(DropHandshakeInvalid)
 				continue
 			}
 
@@ -536,10 +588,13 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		if elem.IsDropped() {
 			continue
 		}
+		elem.trace.record(traceSequentialReceiver)
 
 		// check for replay
 
 		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+			peer.drop(DropReplay)
+			elem.trace.drop(DropReplay)
 			continue
 		}
 
@@ -576,12 +631,16 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv4.HeaderLen {
+				peer.drop(DropInvalidPacket)
+				elem.trace.drop(DropInvalidPacket)
 				continue
 			}
 
 			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
 			length := binary.BigEndian.Uint16(field)
 			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
+				peer.drop(DropInvalidPacket)
+				elem.trace.drop(DropInvalidPacket)
 				continue
 			}
 
@@ -595,6 +654,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					"IPv4 packet with disallowed source address from",
 					peer,
 				)
+				peer.drop(DropDisallowedSource)
+				elem.trace.drop(DropDisallowedSource)
 				continue
 			}
 
@@ -603,6 +664,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			// strip padding
 
 			if len(elem.packet) < ipv6.HeaderLen {
+				peer.drop(DropInvalidPacket)
+				elem.trace.drop(DropInvalidPacket)
 				continue
 			}
 
@@ -610,6 +673,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			length := binary.BigEndian.Uint16(field)
 			length += ipv6.HeaderLen
 			if int(length) > len(elem.packet) {
+				peer.drop(DropInvalidPacket)
+				elem.trace.drop(DropInvalidPacket)
 				continue
 			}
 
@@ -623,16 +688,70 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					"IPv6 packet with disallowed source address from",
 					peer,
 				)
+				peer.drop(DropDisallowedSource)
+				elem.trace.drop(DropDisallowedSource)
 				continue
 			}
 
 		default:
+			if isZero(elem.packet) {
+				logDebug.Println(peer, "- Receiving padded keepalive packet")
+				continue
+			}
 			logInfo.Println("Packet with invalid IP version from", peer)
+			peer.drop(DropInvalidPacket)
+			elem.trace.drop(DropInvalidPacket)
+			continue
+		}
+
+		elem.trace.setPacket(peer, elem.packet)
+
+		// apply ingress policing
+
+		if !peer.rateLimit.rx.allow(len(elem.packet), time.Now()) {
+			peer.dropRateLimited()
+			elem.trace.drop(DropRateLimited)
+			continue
+		}
+
+		// consult packet filter
+
+		if device.filterInbound(peer, elem.packet) != FilterAccept {
+			logDebug.Println(peer, "- Inbound packet dropped by filter")
+			peer.drop(DropFiltered)
+			elem.trace.drop(DropFiltered)
+			continue
+		}
+
+		device.accountFlow(peer, elem.packet, false)
+
+		// forward to other peer in hub mode
+
+		switch device.hubForward(peer, elem) {
+		case hubDrop:
+			continue
+		case hubForwarded:
+			device.PutInboundElement(elem)
+			elem = nil
 			continue
 		}
 
+		// masquerade behind the NAT source
+
+		if !device.nat.masquerade(elem.packet) {
+			logDebug.Println(peer, "- Inbound packet dropped by NAT")
+			peer.drop(DropNAT)
+			elem.trace.drop(DropNAT)
+			continue
+		}
+
+		if device.tun.clampMSS.Get() {
+			clampTCPMSS(elem.packet, peer.enforcedMTU())
+		}
+
 		// write to tun device
 
+		device.captureInner(peer, elem.packet, false)
 		offset := MessageTransportOffsetContent
 		_, err := device.tun.device.Write(elem.buffer[:offset+len(elem.packet)], offset)
 		if len(peer.queue.inbound) == 0 {
@@ -644,5 +763,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		if err != nil && !device.isClosed.Get() {
 			logError.Println("Failed to write packet to TUN device:", err)
 		}
+		if err == nil {
+			elem.trace.complete(traceTUNWrite)
+		}
 	}
 }
@@ -0,0 +1,472 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/ratelimiter"
+)
+
+var errResolveRateLimited = errors.New("too many resolutions from source address")
+
+/* On-demand peers
+ *
+ * A PeerResolver installed on the device is asked for the configuration of initiators
+ * not configured on the device, once the initiation has passed MAC1 validation and rate limiting
+ * and has been authenticated with the static key of the initiator. As any key authenticates,
+ * resolutions are also rate limited per source address, whatever the load. The peer is created
+ * from the returned configuration and the initiation consumed, so that the handshake
+ * completes in the same round trip.
+ *
+ * At most ResolveConcurrentLookups initiators and destinations are resolved at a time,
+ * further ones are rejected. A handshake worker waits up to ResolveTimeout for the resolver,
+ * a configuration returned later is used for the initiation retransmitted by the initiator.
+ * Rejected initiators are not resolved again for ResolveCacheTime.
+ *
+ * Likewise, a DestinationResolver is asked for the peer to route packets read from the TUN device to,
+ * if no peer has an allowed IP matching their destination. Up to ResolvePendingPackets packets
+ * per destination are held while it is resolved, and then routed again. Packets to destinations
+ * without peer are dropped for ResolveCacheTime.
+ *
+ * Peers created on demand get the idle timeout of the device, if set (see expiry.go).
+ */
+
+const (
+	ResolvePendingPackets    = 16
+	ResolveConcurrentLookups = 8
+	ResolveTimeout           = time.Millisecond * 100
+	ResolveCacheTime         = time.Second * 10
+	ResolveCacheSize         = 1024
+)
+
+type PeerConfig struct {
+	PublicKey                   NoisePublicKey
+	PresharedKey                NoiseSymmetricKey
+	Endpoint                    string // optional, "host:port"
+	AllowedIPs                  []net.IPNet
+	PersistentKeepaliveInterval uint16 // in seconds, 0 disables
+}
+
+type PeerResolver interface {
+	/* Returns the configuration of the peer with the public key,
+	 * or nil to reject the initiator
+	 */
+	ResolvePeer(publicKey NoisePublicKey) (*PeerConfig, error)
+}
+
+type DestinationResolver interface {
+	/* Returns the configuration of the peer to route packets to the destination to,
+	 * or nil if there is none, with the destination among its allowed IPs
+	 */
+	ResolveDestination(dst net.IP) (*PeerConfig, error)
+}
+
+type peerResolution struct {
+	config *PeerConfig   // nil if rejected
+	done   chan struct{} // closed once resolved
+	until  time.Time     // of caching the result
+}
+
+type peerResolutions struct {
+	sync.Mutex
+	entries map[NoisePublicKey]*peerResolution
+	lookups int                     // of peers and destinations in progress
+	limiter ratelimiter.Ratelimiter // per source address
+}
+
+type onDemandPeers struct {
+	sync.Mutex
+	resolver    DestinationResolver
+	pending     map[[net.IPv6len]byte][]*QueueOutboundElement
+	rejected    map[[net.IPv6len]byte]time.Time // destinations without peer, until
+	peers       map[*Peer]struct{}
+	idleTimeout time.Duration
+}
+
+type peerResolverHolder struct {
+	PeerResolver
+}
+
+/* Installs a resolver for unknown initiators on the device,
+ * a nil resolver rejects them
+ */
+func (device *Device) SetPeerResolver(resolver PeerResolver) {
+	device.resolver.Store(peerResolverHolder{resolver})
+}
+
+func (device *Device) peerResolver() PeerResolver {
+	holder, _ := device.resolver.Load().(peerResolverHolder)
+	return holder.PeerResolver
+}
+
+/* Creates a peer from the configuration
+ */
+func (device *Device) AddPeer(config *PeerConfig) (*Peer, error) {
+	var endpoint conn.Endpoint
+	if config.Endpoint != "" {
+		var err error
+		endpoint, err = conn.CreateEndpoint(config.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	peer, err := device.NewPeer(config.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	peer.handshake.mutex.Lock()
+	peer.handshake.presharedKey = config.PresharedKey
+	peer.handshake.mutex.Unlock()
+
+	peer.Lock()
+	peer.endpoint = endpoint
+	peer.persistentKeepaliveInterval = config.PersistentKeepaliveInterval
+	peer.Unlock()
+
+	for _, network := range config.AllowedIPs {
+		ones, _ := network.Mask.Size()
+		device.allowedips.Insert(network.IP, uint(ones), peer)
+	}
+
+	if config.PersistentKeepaliveInterval != 0 && endpoint != nil && device.isUp.Get() {
+		peer.SendKeepalive()
+	}
+	return peer, nil
+}
+
+/* Creates the peer of an unknown initiator from the configuration returned by the resolver
+ *
+ * Must not hold device.staticIdentity
+ */
+func (device *Device) resolvePeer(publicKey NoisePublicKey) *Peer {
+	config := device.resolvePeerConfig(publicKey)
+	if config == nil {
+		return nil
+	}
+
+	resolved := *config
+	resolved.PublicKey = publicKey
+	peer, err := device.AddPeer(&resolved)
+	if err != nil {
+
+		// a concurrent initiation may have created the peer already
+
+		if peer = device.LookupPeer(publicKey); peer == nil {
+			device.log.Error.Println("Failed to create resolved peer:", err)
+		}
+		return peer
+	}
+
+	device.onDemand.track(device, peer)
+	device.log.Info.Println(peer, "- Created on demand for initiation")
+	return peer
+}
+
+/* Returns the configuration of an unknown initiator, from the cache or the resolver,
+ * waiting for the resolver up to ResolveTimeout
+ */
+func (device *Device) resolvePeerConfig(publicKey NoisePublicKey) *PeerConfig {
+	resolver := device.peerResolver()
+	if resolver == nil {
+		return nil
+	}
+
+	table := &device.resolutions
+	table.Lock()
+	now := time.Now()
+	resolution, ok := table.entries[publicKey]
+	if ok && isClosed(resolution.done) && !now.Before(resolution.until) {
+		delete(table.entries, publicKey)
+		ok = false
+	}
+	if !ok {
+		if !table.unsafeAcquireLookup() {
+			table.Unlock()
+			device.log.Debug.Println("Too many resolutions in progress, rejecting initiator")
+			return nil
+		}
+		if table.entries == nil {
+			table.entries = make(map[NoisePublicKey]*peerResolution)
+		}
+		resolution = &peerResolution{done: make(chan struct{})}
+		table.entries[publicKey] = resolution
+		go device.routineResolvePeer(resolver, publicKey, resolution)
+	}
+	table.Unlock()
+
+	timer := time.NewTimer(ResolveTimeout)
+	defer timer.Stop()
+	select {
+	case <-resolution.done:
+	case <-timer.C:
+		return nil
+	}
+
+	// configurations are used once, rejections cached
+
+	if resolution.config == nil {
+		return nil
+	}
+	table.Lock()
+	if table.entries[publicKey] == resolution {
+		delete(table.entries, publicKey)
+	}
+	table.Unlock()
+	return resolution.config
+}
+
+func (device *Device) routineResolvePeer(resolver PeerResolver, publicKey NoisePublicKey, resolution *peerResolution) {
+	config, err := resolver.ResolvePeer(publicKey)
+	if err != nil {
+		device.log.Error.Println("Failed to resolve peer:", err)
+		config = nil
+	}
+
+	table := &device.resolutions
+	table.Lock()
+	defer table.Unlock()
+
+	table.lookups--
+	now := time.Now()
+	resolution.config = config
+	resolution.until = now.Add(ResolveCacheTime)
+	close(resolution.done)
+
+	// bound the cache, evicting expired results and then the new one
+
+	if len(table.entries) > ResolveCacheSize {
+		for key, other := range table.entries {
+			if isClosed(other.done) && !now.Before(other.until) {
+				delete(table.entries, key)
+			}
+		}
+	}
+	if len(table.entries) > ResolveCacheSize && table.entries[publicKey] == resolution {
+		delete(table.entries, publicKey)
+	}
+}
+
+/* Takes one of the ResolveConcurrentLookups lookups, if available
+ *
+ * Must hold table.Mutex
+ */
+func (table *peerResolutions) unsafeAcquireLookup() bool {
+	if table.lookups >= ResolveConcurrentLookups {
+		return false
+	}
+	table.lookups++
+	return true
+}
+
+func (table *peerResolutions) releaseLookup() {
+	table.Lock()
+	defer table.Unlock()
+	table.lookups--
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+/* Applies the idle timeout for peers created on demand to the peer
+ */
+func (table *onDemandPeers) track(device *Device, peer *Peer) {
+	table.Lock()
+	if table.peers == nil {
+		table.peers = make(map[*Peer]struct{})
+	}
+	table.peers[peer] = struct{}{}
+	if table.idleTimeout > 0 {
+		device.SetPeerIdleTimeout(peer, table.idleTimeout)
+	}
+	table.Unlock()
+
+	// the peer may have been removed meanwhile
+
+	if device.LookupPeer(peer.handshake.remoteStatic) != peer {
+		table.forget(peer)
+	}
+}
+
+/* Stops tracking the removed peer
+ */
+func (table *onDemandPeers) forget(peer *Peer) {
+	table.Lock()
+	defer table.Unlock()
+	delete(table.peers, peer)
+}
+
+/* Installs a resolver for destinations without peer on the device,
+ * a nil resolver drops their packets
+ */
+func (device *Device) SetDestinationResolver(resolver DestinationResolver) {
+	table := &device.onDemand
+	table.Lock()
+	defer table.Unlock()
+	table.resolver = resolver
+	if table.pending == nil {
+		table.pending = make(map[[net.IPv6len]byte][]*QueueOutboundElement)
+	}
+}
+
+/* Holds the packet while its destination is resolved to a peer,
+ * returns false if the packet is to be dropped
+ */
+func (device *Device) resolveDestination(elem *QueueOutboundElement) bool {
+	table := &device.onDemand
+	table.Lock()
+	defer table.Unlock()
+
+	if table.resolver == nil {
+		return false
+	}
+
+	var dst net.IP
+	if elem.packet[0]>>4 == ipv4.Version {
+		dst = elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+	} else {
+		dst = elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+	}
+	var key [net.IPv6len]byte
+	copy(key[:], dst.To16())
+
+	if until, ok := table.rejected[key]; ok {
+		if time.Now().Before(until) {
+			return false
+		}
+		delete(table.rejected, key)
+	}
+
+	pending, ok := table.pending[key]
+	if !ok {
+		device.resolutions.Lock()
+		acquired := device.resolutions.unsafeAcquireLookup()
+		device.resolutions.Unlock()
+		if !acquired {
+			device.log.Debug.Println("Too many resolutions in progress, dropping packet to", dst)
+			return false
+		}
+		go device.routineResolveDestination(table.resolver, key, append(net.IP{}, dst...))
+	} else if len(pending) >= ResolvePendingPackets {
+		return false
+	}
+	table.pending[key] = append(pending, elem)
+	return true
+}
+
+func (device *Device) routineResolveDestination(resolver DestinationResolver, key [net.IPv6len]byte, dst net.IP) {
+	logInfo := device.log.Info
+	logError := device.log.Error
+
+	config, err := resolver.ResolveDestination(dst)
+	device.resolutions.releaseLookup()
+	if err != nil {
+		logError.Println("Failed to resolve destination", dst, ":", err)
+	} else if config != nil && !device.isClosed.Get() {
+		peer, err := device.AddPeer(config)
+		if err == nil {
+			device.onDemand.track(device, peer)
+			logInfo.Println(peer, "- Created on demand for destination", dst)
+		} else if device.LookupPeer(config.PublicKey) == nil {
+			logError.Println("Failed to create peer for destination", dst, ":", err)
+		}
+	}
+
+	table := &device.onDemand
+	table.Lock()
+	pending := table.pending[key]
+	delete(table.pending, key)
+	table.Unlock()
+
+	// route the held packets again, caching destinations still without peer
+
+	for _, elem := range pending {
+		var peer *Peer
+		if len(dst) == net.IPv4len {
+			peer = device.allowedips.LookupIPv4(dst)
+		} else {
+			peer = device.allowedips.LookupIPv6(dst)
+		}
+		if peer == nil {
+			device.drop(DropNoPeer)
+			elem.trace.drop(DropNoPeer)
+		} else if device.sendOutbound(peer, elem) {
+			continue
+		}
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}
+	if config == nil {
+		table.reject(key, time.Now())
+	}
+}
+
+/* Must not hold table.Mutex
+ */
+func (table *onDemandPeers) reject(key [net.IPv6len]byte, now time.Time) {
+	table.Lock()
+	defer table.Unlock()
+
+	if table.rejected == nil {
+		table.rejected = make(map[[net.IPv6len]byte]time.Time)
+	}
+	if len(table.rejected) >= ResolveCacheSize {
+		for other, until := range table.rejected {
+			if !now.Before(until) {
+				delete(table.rejected, other)
+			}
+		}
+		if len(table.rejected) >= ResolveCacheSize {
+			return
+		}
+	}
+	table.rejected[key] = now.Add(ResolveCacheTime)
+}
+
+/* Releases the packets held for destinations being resolved
+ */
+func (device *Device) flushPendingDestinations() {
+	table := &device.onDemand
+	table.Lock()
+	pending := table.pending
+	table.pending = make(map[[net.IPv6len]byte][]*QueueOutboundElement)
+	table.resolver = nil
+	table.Unlock()
+
+	for _, elems := range pending {
+		for _, elem := range elems {
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+		}
+	}
+}
+
+/* Sets the idle timeout of peers created on demand, see SetPeerIdleTimeout,
+ * 0 keeps them
+ */
+func (device *Device) SetOnDemandIdleTimeout(timeout time.Duration) {
+	table := &device.onDemand
+	table.Lock()
+	defer table.Unlock()
+
+	table.idleTimeout = timeout
+	for peer := range table.peers {
+		device.SetPeerIdleTimeout(peer, timeout)
+	}
+}
@@ -0,0 +1,360 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+type testPeerResolver struct {
+	config   *PeerConfig
+	resolved []NoisePublicKey
+}
+
+func (resolver *testPeerResolver) ResolvePeer(publicKey NoisePublicKey) (*PeerConfig, error) {
+	resolver.resolved = append(resolver.resolved, publicKey)
+	return resolver.config, nil
+}
+
+func TestPeerResolver(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	pk1 := dev1.staticIdentity.privateKey.publicKey()
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+
+	initiation := func() *MessageInitiation {
+		msg, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		return msg
+	}
+
+	// without resolver, or if it declines, unknown initiators are rejected
+
+	if dev2.ConsumeMessageInitiation(initiation()) != nil {
+		t.Fatal("initiation from unknown peer consumed without resolver")
+	}
+	resolver := &testPeerResolver{}
+	dev2.SetPeerResolver(resolver)
+	if dev2.ConsumeMessageInitiation(initiation()) != nil {
+		t.Fatal("initiation consumed though rejected by resolver")
+	}
+	if len(resolver.resolved) != 1 || resolver.resolved[0] != pk1 {
+		t.Fatal("resolver not asked for initiator")
+	}
+
+	// rejections are cached
+
+	_, network, _ := net.ParseCIDR("10.0.0.1/32")
+	resolver.config = &PeerConfig{AllowedIPs: []net.IPNet{*network}}
+	if dev2.ConsumeMessageInitiation(initiation()) != nil || len(resolver.resolved) != 1 {
+		t.Fatal("rejected initiator resolved again")
+	}
+	dev2.resolutions.entries[pk1].until = time.Now()
+
+	// the peer is created from the resolved configuration in the same round
+
+	peer1 := dev2.ConsumeMessageInitiation(initiation())
+	if peer1 == nil {
+		t.Fatal("initiation from resolved peer not consumed")
+	}
+	if dev2.LookupPeer(pk1) != peer1 {
+		t.Error("resolved peer not added to device")
+	}
+	if dev2.allowedips.LookupIPv4(net.ParseIP("10.0.0.1").To4()) != peer1 {
+		t.Error("allowed IPs of resolved peer not set")
+	}
+	if _, err := dev2.CreateMessageResponse(peer1); err != nil {
+		t.Error("failed to respond to resolved peer:", err)
+	}
+
+	// known peers are not resolved again
+
+	dev2.ConsumeMessageInitiation(initiation())
+	if len(resolver.resolved) != 2 {
+		t.Error("known peer resolved again")
+	}
+
+	// initiations not authenticated with the static key of the initiator are not resolved
+
+	dev2.RemovePeer(pk1)
+	msg := initiation()
+	msg.Timestamp[0] ^= 1
+	if dev2.ConsumeMessageInitiation(msg) != nil || len(resolver.resolved) != 2 {
+		t.Error("unauthenticated initiator resolved")
+	}
+}
+
+func TestPeerResolverRateLimit(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	resolver := &testPeerResolver{}
+	dev2.SetPeerResolver(resolver)
+
+	initiate := func(endpoint string) error {
+		src, err := conn.CreateEndpoint(endpoint)
+		assertNil(t, err)
+		msg, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		dev2.resolutions.Lock()
+		dev2.resolutions.entries = nil // forget the rejection
+		dev2.resolutions.Unlock()
+		_, err = dev2.consumeMessageInitiation(msg, src)
+		return err
+	}
+
+	// unknown initiators are resolved at a limited rate per source address, whatever the load
+
+	limited := false
+	for i := 0; i < 10 && !limited; i++ {
+		limited = initiate("192.0.2.1:51820") == errResolveRateLimited
+	}
+	if !limited {
+		t.Fatal("resolutions from the same source address not rate limited")
+	}
+	resolved := len(resolver.resolved)
+	if initiate("192.0.2.2:51820") == errResolveRateLimited || len(resolver.resolved) != resolved+1 {
+		t.Error("resolution from another source address rate limited")
+	}
+}
+
+type testSlowPeerResolver struct {
+	config  *PeerConfig
+	release chan struct{}
+}
+
+func (resolver *testSlowPeerResolver) ResolvePeer(publicKey NoisePublicKey) (*PeerConfig, error) {
+	<-resolver.release
+	return resolver.config, nil
+}
+
+func TestPeerResolverTimeout(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	pk1 := dev1.staticIdentity.privateKey.publicKey()
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	resolver := &testSlowPeerResolver{config: &PeerConfig{}, release: make(chan struct{})}
+	dev2.SetPeerResolver(resolver)
+
+	// initiations are rejected while the resolver is slow
+
+	msg, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg) != nil {
+		t.Fatal("initiation consumed before resolution")
+	}
+
+	// and lookups bounded
+
+	for i := 1; i < ResolveConcurrentLookups; i++ {
+		sk, err := newPrivateKey()
+		assertNil(t, err)
+		go dev2.resolvePeerConfig(sk.publicKey())
+	}
+	for {
+		dev2.resolutions.Lock()
+		lookups := dev2.resolutions.lookups
+		dev2.resolutions.Unlock()
+		if lookups == ResolveConcurrentLookups {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	start := time.Now()
+	if dev2.resolvePeerConfig(sk.publicKey()) != nil || time.Since(start) >= ResolveTimeout {
+		t.Error("lookup beyond bound not rejected immediately")
+	}
+
+	// the configuration resolved meanwhile is used for the retransmission
+
+	close(resolver.release)
+	for {
+		dev2.resolutions.Lock()
+		lookups := dev2.resolutions.lookups
+		dev2.resolutions.Unlock()
+		if lookups == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	msg, err = dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg) == nil || dev2.LookupPeer(pk1) == nil {
+		t.Error("retransmitted initiation not consumed after resolution")
+	}
+}
+
+type testDestinationResolver struct {
+	config *PeerConfig
+}
+
+func (resolver *testDestinationResolver) ResolveDestination(dst net.IP) (*PeerConfig, error) {
+	if !dst.Equal(net.ParseIP("1.0.0.2")) {
+		return nil, nil
+	}
+	return resolver.config, nil
+}
+
+func TestDestinationResolver(t *testing.T) {
+	port1 := getFreePort(t)
+	port2 := getFreePort(t)
+
+	// the first device knows no peers, the second knows the first
+
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), NewLogger(LogLevelError, "dev1: "))
+	dev1.Up()
+	defer dev1.Close()
+	cfg1 := "private_key=481eb0d8113a4a5da532d2c3e9c14b53c8454b34ab109676f6b58c2245e37b58\nlisten_port=" + port1 + "\n"
+	if err := dev1.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg1))); err != nil {
+		t.Fatal(err)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), NewLogger(LogLevelError, "dev2: "))
+	dev2.Up()
+	defer dev2.Close()
+	cfg2 := `private_key=98c7989b1661a0d64fd6af3502000f87716b7c4bbcf00d04fc6073aa7b539768
+listen_port=` + port2 + `
+public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427
+allowed_ip=1.0.0.1/32
+`
+	if err := dev2.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg2))); err != nil {
+		t.Fatal(err)
+	}
+
+	var pk2 NoisePublicKey
+	assertNil(t, pk2.FromHex("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"))
+	_, network, _ := net.ParseCIDR("1.0.0.2/32")
+	dev1.SetDestinationResolver(&testDestinationResolver{&PeerConfig{
+		PublicKey:  pk2,
+		Endpoint:   "127.0.0.1:" + port2,
+		AllowedIPs: []net.IPNet{*network},
+	}})
+
+	// the held packet is sent to the resolved peer
+
+	ping := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+	tun1.Outbound <- ping
+	select {
+	case msgRecv := <-tun2.Inbound:
+		if !bytes.Equal(ping, msgRecv) {
+			t.Error("ping did not transit correctly")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	// destinations without peer are cached
+
+	tun1.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.3"), net.ParseIP("1.0.0.1"))
+	var key [net.IPv6len]byte
+	copy(key[:], net.ParseIP("1.0.0.3").To16())
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		dev1.onDemand.Lock()
+		_, rejected := dev1.onDemand.rejected[key]
+		dev1.onDemand.Unlock()
+		if rejected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("destination without peer not cached")
+		}
+	}
+
+	// the peer is removed once idle
+
+	peer := dev1.LookupPeer(pk2)
+	if peer == nil {
+		t.Fatal("resolved peer not added")
+	}
+	dev1.SetOnDemandIdleTimeout(time.Minute)
+	if _, idleTimeout := dev1.peerExpiry(peer); idleTimeout != time.Minute {
+		t.Fatal("idle timeout not applied to resolved peer")
+	}
+	now := time.Now()
+	dev1.expirePeers(now)
+	dev1.expirePeers(now.Add(time.Second))
+	if dev1.LookupPeer(pk2) == nil {
+		t.Fatal("peer removed before idle timeout")
+	}
+	dev1.expirePeers(now.Add(time.Minute * 2))
+	if dev1.LookupPeer(pk2) != nil {
+		t.Error("idle peer not removed")
+	}
+	dev1.onDemand.Lock()
+	_, tracked := dev1.onDemand.peers[peer]
+	dev1.onDemand.Unlock()
+	if tracked {
+		t.Error("removed peer still tracked")
+	}
+}
+
+func TestDestinationResolverBound(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+	resolver := &testSlowDestinationResolver{release: make(chan struct{})}
+	dev.SetDestinationResolver(resolver)
+
+	// destinations share the bound on lookups with initiators
+
+	dev.resolutions.Lock()
+	dev.resolutions.lookups = ResolveConcurrentLookups - 1
+	dev.resolutions.Unlock()
+	packet := func(dst string) *QueueOutboundElement {
+		elem := dev.NewOutboundElement()
+		elem.buffer = dev.GetMessageBuffer()
+		elem.packet = tuntest.Ping(net.ParseIP(dst), net.ParseIP("1.0.0.1"))
+		return elem
+	}
+	if !dev.resolveDestination(packet("1.0.0.2")) {
+		t.Fatal("packet to destination within bound not held")
+	}
+	elem := packet("1.0.0.3")
+	if dev.resolveDestination(elem) {
+		t.Error("packet to destination beyond bound held")
+	}
+	dev.PutMessageBuffer(elem.buffer)
+	dev.PutOutboundElement(elem)
+	close(resolver.release)
+	for {
+		dev.resolutions.Lock()
+		lookups := dev.resolutions.lookups
+		dev.resolutions.Unlock()
+		if lookups == ResolveConcurrentLookups-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type testSlowDestinationResolver struct {
+	release chan struct{}
+}
+
+func (resolver *testSlowDestinationResolver) ResolveDestination(dst net.IP) (*PeerConfig, error) {
+	<-resolver.release
+	return nil, nil
+}
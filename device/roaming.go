@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Roaming
+ *
+ * A peer roams to the source address of every authenticated packet received from it,
+ * unless roaming is disabled for the peer. The last RoamingHistorySize changes of its endpoint
+ * are kept for UAPI, and each is published as a PeerEventRoamed event.
+ * Endpoints configured through UAPI are not recorded.
+ */
+
+const RoamingHistorySize = 8
+
+type roamingChange struct {
+	time     time.Time
+	endpoint string
+}
+
+type roamingHistory struct {
+	changes [RoamingHistorySize]roamingChange
+	count   uint64 // changes recorded in total
+}
+
+func (history *roamingHistory) record(change roamingChange) {
+	history.changes[history.count%RoamingHistorySize] = change
+	history.count++
+}
+
+/* Returns the recorded changes, oldest first
+ */
+func (history *roamingHistory) entries() []roamingChange {
+	n := history.count
+	if n > RoamingHistorySize {
+		n = RoamingHistorySize
+	}
+	entries := make([]roamingChange, 0, n)
+	for i := history.count - n; i < history.count; i++ {
+		entries = append(entries, history.changes[i%RoamingHistorySize])
+	}
+	return entries
+}
+
+func (peer *Peer) SetRoamingDisabled(disabled bool) {
+	peer.roaming.disabled.Set(disabled)
+}
+
+func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
+	if peer.disableRoaming || peer.roaming.disabled.Get() || !peer.endpointAllowed(endpoint) {
+		return
+	}
+
+	peer.Lock()
+	previous := peer.endpoint
+	peer.endpoint = endpoint
+	roamed := previous == nil || !bytes.Equal(previous.DstToBytes(), endpoint.DstToBytes())
+	var change roamingChange
+	if roamed {
+		change = roamingChange{time.Now(), endpoint.DstToString()}
+		peer.roaming.history.record(change)
+	}
+	peer.Unlock()
+
+	if roamed {
+		peer.device.publishPeerEvent(peer, PeerEventRoamed, change.endpoint)
+	}
+}
@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func TestRoaming(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	subscription := device.SubscribePeerEvents()
+	defer subscription.Close()
+
+	peer := testPeer(t, device)
+	roam := func(address string) {
+		endpoint, err := conn.CreateEndpoint(address)
+		assertNil(t, err)
+		peer.SetEndpointFromPacket(endpoint)
+	}
+	config := func() string {
+		var buf bytes.Buffer
+		writer := bufio.NewWriter(&buf)
+		assertNil(t, device.IpcGetOperation(writer))
+		writer.Flush()
+		return buf.String()
+	}
+
+	// each change is recorded and published, packets from the current endpoint are not
+
+	roam("192.0.2.1:51820")
+	roam("192.0.2.1:51820")
+	for i := 2; i < RoamingHistorySize+4; i++ {
+		roam(fmt.Sprintf("192.0.2.%d:51820", i))
+	}
+	if peer.roaming.history.count != RoamingHistorySize+3 {
+		t.Errorf("%d changes recorded, expected %d", peer.roaming.history.count, RoamingHistorySize+3)
+	}
+	for i := 1; i < RoamingHistorySize+4; i++ {
+		select {
+		case event := <-subscription.Events():
+			if event.Type != PeerEventRoamed || event.Endpoint != fmt.Sprintf("192.0.2.%d:51820", i) {
+				t.Errorf("unexpected %v event to %s", event.Type, event.Endpoint)
+			}
+		default:
+			t.Fatalf("no roaming event for change %d", i)
+		}
+	}
+
+	// the last changes are reported, oldest first
+
+	var endpoints []string
+	for _, line := range strings.Split(config(), "\n") {
+		if strings.HasPrefix(line, "roamed_to=") {
+			endpoints = append(endpoints, strings.TrimPrefix(line, "roamed_to="))
+		}
+	}
+	if len(endpoints) != RoamingHistorySize ||
+		endpoints[0] != "192.0.2.4:51820" ||
+		endpoints[RoamingHistorySize-1] != fmt.Sprintf("192.0.2.%d:51820", RoamingHistorySize+3) {
+		t.Errorf("unexpected roaming history: %v", endpoints)
+	}
+
+	// disabling roaming keeps the endpoint
+
+	uapi := "public_key=" + peer.handshake.remoteStatic.ToHex() + "\ndisable_roaming=true\n"
+	assertNil(t, device.IpcSetOperation(bufio.NewReader(strings.NewReader(uapi))))
+	roam("198.51.100.1:51820")
+	if peer.endpoint.DstToString() != fmt.Sprintf("192.0.2.%d:51820", RoamingHistorySize+3) {
+		t.Error("roamed with roaming disabled")
+	}
+	if !strings.Contains(config(), "disable_roaming=true\n") {
+		t.Error("disabled roaming missing from configuration")
+	}
+	select {
+	case event := <-subscription.Events():
+		t.Errorf("unexpected %v event", event.Type)
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Static key rotation
+ *
+ * Rotating the private key with a grace period keeps accepting handshake initiations
+ * for the previous public key until the grace period has passed: their MAC1 is verified
+ * and their static key decrypted with the previous identity, while initiations are
+ * sent with the new one. Sessions established before the rotation are kept.
+ * Initiations for the previous public key are logged and counted per peer.
+ * Once the grace period has passed, the previous private key and the shared secrets
+ * pre-computed with it are wiped.
+ */
+
+type previousIdentity struct {
+	*identitySecrets              // privateKey in secure memory, zero if delegated
+	secrets          *secureBlock // holding identitySecrets
+	delegate         StaticKey
+	publicKey        NoisePublicKey
+	until            time.Time   // accepted until, zero if none
+	expiry           *time.Timer // wiping the identity at until
+	cookieChecker    CookieChecker
+}
+
+func (identity *previousIdentity) accepting(now time.Time) bool {
+	return now.Before(identity.until)
+}
+
+/* Must hold device.staticIdentity.Mutex
+ */
+func (identity *previousIdentity) schedule(grace time.Duration, expire func()) {
+	if identity.expiry != nil {
+		identity.expiry.Stop()
+	}
+	identity.expiry = time.AfterFunc(grace, expire)
+}
+
+/* Must hold device.staticIdentity.Mutex
+ */
+func (identity *previousIdentity) unsafeClear() {
+	if identity.expiry != nil {
+		identity.expiry.Stop()
+		identity.expiry = nil
+	}
+	setZero(identity.privateKey[:])
+	identity.delegate = nil
+	identity.publicKey = NoisePublicKey{}
+	identity.until = time.Time{}
+}
+
+/* Wipes the previous identity and the shared secrets pre-computed with it
+ * once its grace period has passed
+ */
+func (device *Device) expirePreviousIdentity() {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	previous := &device.staticIdentity.previous
+	now := time.Now()
+	if previous.until.IsZero() {
+		return
+	}
+	if previous.accepting(now) {
+		previous.schedule(previous.until.Sub(now), device.expirePreviousIdentity)
+		return
+	}
+	previous.unsafeClear()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.handshake.mutex.Lock()
+		setZero(peer.handshake.precomputedStaticStaticPrevious[:])
+		peer.handshake.mutex.Unlock()
+	}
+}
+
+/* Returns the cookie checker of the identity the MAC1 of the handshake message is valid for,
+ * or nil if there is none
+ */
+func (device *Device) cookieCheckerFor(msg []byte) *CookieChecker {
+	if device.cookieChecker.CheckMAC1(msg) {
+		return &device.cookieChecker
+	}
+
+	device.staticIdentity.RLock()
+	accepting := device.staticIdentity.previous.accepting(time.Now())
+	device.staticIdentity.RUnlock()
+
+	checker := &device.staticIdentity.previous.cookieChecker
+	if accepting && checker.CheckMAC1(msg) {
+		return checker
+	}
+	return nil
+}
+
+/* Sets the grace period of subsequent changes of the private key through UAPI
+ */
+func (device *Device) SetPrivateKeyGrace(grace time.Duration) {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+	device.staticIdentity.grace = grace
+}
+
+func (device *Device) privateKeyGrace() time.Duration {
+	device.staticIdentity.RLock()
+	defer device.staticIdentity.RUnlock()
+	return device.staticIdentity.grace
+}
@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPrivateKeyRotation(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.staticIdentity.privateKey.publicKey())
+	previousPublicKey := dev2.staticIdentity.publicKey
+
+	initiation := func() (*MessageInitiation, []byte) {
+		peer1.handshake.mutex.Lock()
+		peer1.handshake.lastInitiationConsumption = time.Time{}
+		peer1.handshake.mutex.Unlock()
+
+		msg, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		var buf bytes.Buffer
+		assertNil(t, binary.Write(&buf, binary.LittleEndian, msg))
+		packet := buf.Bytes()
+		peer2.cookieGenerator.AddMacs(packet)
+		return msg, packet
+	}
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.RotatePrivateKey(sk, time.Minute))
+	if dev2.staticIdentity.publicKey != sk.publicKey() {
+		t.Fatal("private key not rotated")
+	}
+
+	// initiations for the previous key are accepted during the grace period
+
+	msg, packet := initiation()
+	if dev2.cookieCheckerFor(packet) != &dev2.staticIdentity.previous.cookieChecker {
+		t.Error("MAC1 for previous key not accepted")
+	}
+	if dev2.ConsumeMessageInitiation(msg) != peer1 {
+		t.Fatal("initiation for previous key not consumed")
+	}
+	if peer1.handshake.previousIdentityInitiations != 1 {
+		t.Error("initiation for previous key not counted")
+	}
+
+	// peers added meanwhile accept the previous key as well
+
+	dev2.RemovePeer(peer1.handshake.remoteStatic)
+	peer1, _ = dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	if msg, _ = initiation(); dev2.ConsumeMessageInitiation(msg) != peer1 {
+		t.Error("initiation for previous key not consumed by new peer")
+	}
+
+	// but no longer after the grace period
+
+	dev2.staticIdentity.previous.until = time.Now()
+	msg, packet = initiation()
+	if dev2.cookieCheckerFor(packet) != nil {
+		t.Error("MAC1 for previous key accepted after grace period")
+	}
+	if dev2.ConsumeMessageInitiation(msg) != nil {
+		t.Error("initiation for previous key consumed after grace period")
+	}
+
+	// and its key material is wiped
+
+	dev2.expirePreviousIdentity()
+	if !dev2.staticIdentity.previous.privateKey.IsZero() ||
+		!isZero(peer1.handshake.precomputedStaticStaticPrevious[:]) {
+		t.Error("previous key material not wiped after grace period")
+	}
+
+	// rotating without grace period drops the previous key immediately
+
+	peer2.cookieGenerator.Init(dev2.staticIdentity.publicKey)
+	peer2.handshake.mutex.Lock()
+	peer2.handshake.remoteStatic = dev2.staticIdentity.publicKey
+	peer2.handshake.precomputedStaticStatic = dev1.staticIdentity.privateKey.sharedSecret(dev2.staticIdentity.publicKey)
+	peer2.handshake.mutex.Unlock()
+	sk, err = newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.SetPrivateKey(sk))
+	if msg, _ = initiation(); dev2.ConsumeMessageInitiation(msg) != nil {
+		t.Error("initiation for previous key consumed without grace period")
+	}
+	if dev2.staticIdentity.previous.publicKey == previousPublicKey {
+		t.Error("previous identity kept")
+	}
+
+	// the previous key is wiped once the grace period has passed
+
+	sk, err = newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.RotatePrivateKey(sk, time.Millisecond))
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		dev2.staticIdentity.RLock()
+		wiped := dev2.staticIdentity.previous.privateKey.IsZero()
+		dev2.staticIdentity.RUnlock()
+		if wiped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("previous key not wiped after grace period")
+		}
+	}
+}
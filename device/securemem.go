@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+/* Secure memory
+ *
+ * Private keys, preshared keys and the key material of handshakes are held in blocks
+ * allocated from arenas outside of the Go heap, where the platform allows:
+ * locked into memory so they are never swapped out, excluded from core dumps,
+ * and surrounded by inaccessible guard pages. Blocks are wiped when released,
+ * once their holder is garbage collected, and reused for subsequent blocks of their size.
+ *
+ * If an arena cannot be protected, such as when exceeding the limit of locked memory,
+ * it is still used, and the error returned with each block allocated from it.
+ *
+ * The protection is limited to that:
+ *
+ * - Guard pages surround each arena, not each block, as a page per block would exhaust
+ *   the limit of locked memory with a few hundred peers. Overflows between the blocks
+ *   of an arena are not caught.
+ *
+ * - The session keys of keypairs are expanded into the AEAD ciphers on the Go heap,
+ *   which cannot be placed or wiped from here; they are dropped with their keypair.
+ *   Only the key material of the handshake deriving them is held in secure memory.
+ */
+
+const (
+	secureArenaSize  = 64 * 1024
+	secureBlockAlign = 64
+)
+
+var secureMemory struct {
+	sync.Mutex
+	arena []byte                // unallocated remainder of the current arena
+	err   error                 // of protecting the current arena
+	free  map[int][]secureBlock // wiped blocks by size
+}
+
+type secureBlock struct {
+	memory []byte
+	err    error // of protecting its arena
+}
+
+/* Allocates a zeroed block of secure memory, released when the returned block is unreachable
+ */
+func newSecureBlock(size uintptr) (*secureBlock, error) {
+	n := (int(size) + secureBlockAlign - 1) &^ (secureBlockAlign - 1)
+
+	mem := &secureMemory
+	mem.Lock()
+	defer mem.Unlock()
+
+	block := new(secureBlock)
+	if free := mem.free[n]; len(free) > 0 {
+		*block = free[len(free)-1]
+		mem.free[n] = free[:len(free)-1]
+	} else {
+		if len(mem.arena) < n {
+			arenaSize := secureArenaSize
+			if n > arenaSize {
+				arenaSize = n
+			}
+			mem.arena, mem.err = secureMap(arenaSize)
+		}
+		block.memory = mem.arena[:n:n]
+		block.err = mem.err
+		mem.arena = mem.arena[n:]
+	}
+
+	runtime.SetFinalizer(block, (*secureBlock).release)
+	return block, block.err
+}
+
+func (block *secureBlock) pointer() unsafe.Pointer {
+	return unsafe.Pointer(&block.memory[0])
+}
+
+func (block *secureBlock) release() {
+	setZero(block.memory)
+
+	mem := &secureMemory
+	mem.Lock()
+	defer mem.Unlock()
+
+	if mem.free == nil {
+		mem.free = make(map[int][]secureBlock)
+	}
+	mem.free[len(block.memory)] = append(mem.free[len(block.memory)], *block)
+	block.memory = nil
+}
+
+/* Key material of the static identity
+ */
+type identitySecrets struct {
+	privateKey NoisePrivateKey
+}
+
+func newIdentitySecrets() (*identitySecrets, *secureBlock, error) {
+	block, err := newSecureBlock(unsafe.Sizeof(identitySecrets{}))
+	return (*identitySecrets)(block.pointer()), block, err
+}
+
+/* Key material of a handshake
+ */
+type handshakeSecrets struct {
+	chainKey                        [blake2s.Size]byte       // chain key
+	presharedKey                    NoiseSymmetricKey        // psk
+	previousPresharedKey            NoiseSymmetricKey        // psk accepted during rotation
+	localEphemeral                  NoisePrivateKey          // ephemeral secret key
+	precomputedStaticStatic         [NoisePublicKeySize]byte // precomputed shared secret
+	precomputedStaticStaticPrevious [NoisePublicKeySize]byte // with the previous identity during rotation
+}
+
+func newHandshakeSecrets() (*handshakeSecrets, *secureBlock, error) {
+	block, err := newSecureBlock(unsafe.Sizeof(handshakeSecrets{}))
+	return (*handshakeSecrets)(block.pointer()), block, err
+}
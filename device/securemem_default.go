@@ -0,0 +1,16 @@
+// +build !linux,!darwin,!freebsd,!openbsd,!windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+)
+
+func secureMap(size int) ([]byte, error) {
+	return make([]byte, size), errors.New("secure memory not supported on this platform")
+}
@@ -0,0 +1,14 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func secureNoDump(memory []byte) error {
+	return unix.Madvise(memory, unix.MADV_NOCORE)
+}
@@ -0,0 +1,14 @@
+// +build darwin openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+/* Not supported, processes handling keys should disable core dumps
+ */
+func secureNoDump(memory []byte) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestSecureBlock(t *testing.T) {
+	secrets, block, err := newHandshakeSecrets()
+	if err != nil {
+		t.Log("Secure memory not protected:", err)
+	}
+	if uintptr(unsafe.Pointer(secrets))%secureBlockAlign != 0 {
+		t.Error("block not aligned")
+	}
+	if len(block.memory) < int(unsafe.Sizeof(*secrets)) {
+		t.Fatalf("block of %d bytes too small", len(block.memory))
+	}
+
+	secrets.presharedKey = NoiseSymmetricKey{1, 2, 3}
+	secrets.chainKey[0] = 1
+
+	// released blocks are wiped and reused
+
+	memory := &block.memory[0]
+	block.release()
+	reused, block, _ := newHandshakeSecrets()
+	if &block.memory[0] != memory {
+		t.Error("released block not reused")
+	}
+	if reused.presharedKey != (NoiseSymmetricKey{}) || reused.chainKey[0] != 0 {
+		t.Error("released block not wiped")
+	}
+
+	// blocks do not overlap
+
+	other, _, _ := newHandshakeSecrets()
+	other.presharedKey = NoiseSymmetricKey{4}
+	if reused.presharedKey != (NoiseSymmetricKey{}) {
+		t.Error("blocks overlap")
+	}
+}
+
+func TestSecureMemoryKeys(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer, err := dev.NewPeer(sk.publicKey())
+	assertNil(t, err)
+
+	inBlock := func(pointer unsafe.Pointer, block *secureBlock) bool {
+		start := uintptr(unsafe.Pointer(&block.memory[0]))
+		return uintptr(pointer) >= start && uintptr(pointer) < start+uintptr(len(block.memory))
+	}
+	if !inBlock(unsafe.Pointer(&dev.staticIdentity.privateKey), dev.staticIdentity.secrets) {
+		t.Error("private key not in secure memory")
+	}
+	handshake := &peer.handshake
+	if !inBlock(unsafe.Pointer(&handshake.presharedKey), handshake.secrets) ||
+		!inBlock(unsafe.Pointer(&handshake.chainKey), handshake.secrets) {
+		t.Error("handshake key material not in secure memory")
+	}
+
+	// closing the device wipes its private key
+
+	dev.Close()
+	if !dev.staticIdentity.privateKey.IsZero() {
+		t.Error("private key not wiped")
+	}
+}
+
+func TestSecureMemoryPlaceholderPeer(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	peer := testPeer(t, dev)
+	psk := "preshared_key=" + NoiseSymmetricKey{1}.ToHex() + "\n"
+
+	// key material for placeholder peers is parsed but not stored
+
+	for _, config := range []string{
+		"public_key=" + sk.publicKey().ToHex() + "\nupdate_only=true\n" + psk,
+		"public_key=" + peer.handshake.remoteStatic.ToHex() + "\nremove=true\n" + psk,
+		"public_key=" + dev.staticIdentity.publicKey.ToHex() + "\n" + psk,
+	} {
+		assertNil(t, dev.IpcSetOperation(bufio.NewReader(strings.NewReader(config))))
+	}
+	if dev.LookupPeer(sk.publicKey()) != nil || dev.LookupPeer(peer.handshake.remoteStatic) != nil {
+		t.Error("placeholder peer configured")
+	}
+}
@@ -0,0 +1,39 @@
+// +build linux darwin freebsd openbsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Maps an arena of size bytes between guard pages, locked and excluded from core dumps,
+ * falling back to an unprotected arena
+ */
+func secureMap(size int) ([]byte, error) {
+	pageSize := os.Getpagesize()
+	size = (size + pageSize - 1) &^ (pageSize - 1)
+
+	mapping, err := unix.Mmap(-1, 0, size+2*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return make([]byte, size), err
+	}
+	arena := mapping[pageSize : pageSize+size : pageSize+size]
+
+	if err := unix.Mprotect(mapping[:pageSize], unix.PROT_NONE); err != nil {
+		return arena, err
+	}
+	if err := unix.Mprotect(mapping[pageSize+size:], unix.PROT_NONE); err != nil {
+		return arena, err
+	}
+	if err := secureNoDump(arena); err != nil {
+		return arena, err
+	}
+	return arena, unix.Mlock(arena)
+}
@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"os"
+	"reflect"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+/* Allocates an arena of size bytes between guard pages, locked into the working set,
+ * falling back to an unprotected arena
+ */
+func secureMap(size int) ([]byte, error) {
+	pageSize := os.Getpagesize()
+	size = (size + pageSize - 1) &^ (pageSize - 1)
+
+	mapping, err := windows.VirtualAlloc(0, uintptr(size+2*pageSize), windows.MEM_RESERVE|windows.MEM_COMMIT, windows.PAGE_READWRITE)
+	if err != nil {
+		return make([]byte, size), err
+	}
+	address := mapping + uintptr(pageSize)
+	var arena []byte
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&arena))
+	header.Data, header.Len, header.Cap = address, size, size
+
+	var protect uint32
+	if err := windows.VirtualProtect(mapping, uintptr(pageSize), windows.PAGE_NOACCESS, &protect); err != nil {
+		return arena, err
+	}
+	if err := windows.VirtualProtect(address+uintptr(size), uintptr(pageSize), windows.PAGE_NOACCESS, &protect); err != nil {
+		return arena, err
+	}
+	return arena, windows.VirtualLock(address, uintptr(size))
+}
@@ -8,6 +8,7 @@ package device
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -45,11 +46,12 @@ import (
 type QueueOutboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
-	packet  []byte                // slice of "buffer" (always!)
-	nonce   uint64                // nonce for encryption
-	keypair *Keypair              // keypair for encryption
-	peer    *Peer                 // related peer
+	buffer    *[MaxMessageSize]byte // slice holding the packet data
+	packet    []byte                // slice of "buffer" (always!)
+	nonce     uint64                // nonce for encryption
+	keypair   *Keypair              // keypair for encryption
+	peer      *Peer                 // related peer
+	trace     *packetTrace          // stages passed, if traced
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -60,6 +62,7 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.nonce = 0
 	elem.keypair = nil
 	elem.peer = nil
+	elem.trace = nil
 	return elem
 }
 
@@ -71,7 +74,8 @@ func (elem *QueueOutboundElement) IsDropped() bool {
 	return atomic.LoadInt32(&elem.dropped) == AtomicTrue
 }
 
-func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundElement, device *Device) {
+func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundElement, peer *Peer) {
+	device := peer.device
 	for {
 		select {
 		case queue <- element:
@@ -79,6 +83,8 @@ func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundEle
 		default:
 			select {
 			case old := <-queue:
+				peer.drop(DropQueueFull)
+				old.trace.drop(DropQueueFull)
 				device.PutMessageBuffer(old.buffer)
 				device.PutOutboundElement(old)
 			default:
@@ -87,27 +93,35 @@ func addToNonceQueue(queue chan *QueueOutboundElement, element *QueueOutboundEle
 	}
 }
 
-func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement, encryptionQueue chan *QueueOutboundElement, element *QueueOutboundElement) {
+/* Returns whether the element has been added to both queues
+ */
+func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement, encryptionQueue chan *QueueOutboundElement, element *QueueOutboundElement) bool {
 	select {
 	case outboundQueue <- element:
 		select {
 		case encryptionQueue <- element:
-			return
+			return true
 		default:
+			element.peer.drop(DropQueueFull)
+			element.trace.drop(DropQueueFull)
 			element.Drop()
 			element.peer.device.PutMessageBuffer(element.buffer)
 			element.Unlock()
 		}
 	default:
+		element.peer.drop(DropQueueFull)
+		element.trace.drop(DropQueueFull)
 		element.peer.device.PutMessageBuffer(element.buffer)
 		element.peer.device.PutOutboundElement(element)
 	}
+	return false
 }
 
 /* Queues a keepalive if no packets are queued for peer
  */
 func (peer *Peer) SendKeepalive() bool {
-	if len(peer.queue.nonce) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
+	if len(peer.queue.nonce) != 0 || peer.queue.fq.backlog() != 0 ||
+		peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
 		return false
 	}
 	elem := peer.device.NewOutboundElement()
@@ -209,8 +223,13 @@ func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement)
 
 	device.log.Debug.Println("Sending cookie response for denied handshake message for", initiatingElem.endpoint.DstToString())
 
+	checker := device.cookieCheckerFor(initiatingElem.packet)
+	if checker == nil {
+		return errors.New("invalid mac1")
+	}
+
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
-	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
+	reply, err := checker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
 		device.log.Error.Println("Failed to create cookie reply:", err)
 		return err
@@ -276,11 +295,20 @@ func (device *Device) RoutineReadFromTUN() {
 			return
 		}
 
-		if size == 0 || size > MaxContentSize {
+		if size == 0 {
 			continue
 		}
 
 		elem.packet = elem.buffer[offset : offset+size]
+		elem.trace = device.trace.start(true, nil, traceTUNRead)
+
+		// translate replies to masqueraded packets
+
+		if !device.nat.unmasquerade(elem.packet) {
+			device.drop(DropNAT)
+			elem.trace.drop(DropNAT)
+			continue
+		}
 
 		// lookup peer
 
@@ -288,6 +316,8 @@ func (device *Device) RoutineReadFromTUN() {
 		switch elem.packet[0] >> 4 {
 		case ipv4.Version:
 			if len(elem.packet) < ipv4.HeaderLen {
+				device.drop(DropInvalidPacket)
+				elem.trace.drop(DropInvalidPacket)
 				continue
 			}
 			dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
@@ -295,6 +325,8 @@ func (device *Device) RoutineReadFromTUN() {
 
 		case ipv6.Version:
 			if len(elem.packet) < ipv6.HeaderLen {
+				device.drop(DropInvalidPacket)
+				elem.trace.drop(DropInvalidPacket)
 				continue
 			}
 			dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
@@ -302,24 +334,103 @@ func (device *Device) RoutineReadFromTUN() {
 
 		default:
 			logDebug.Println("Received packet with unknown IP version")
+			device.drop(DropInvalidPacket)
+			elem.trace.drop(DropInvalidPacket)
+			continue
 		}
 
+		elem.trace.setPacket(peer, elem.packet)
+		elem.trace.record(tracePeerLookup)
+		device.captureInner(peer, elem.packet, true)
+
 		if peer == nil {
-			continue
-		}
 
-		// insert into nonce/pre-handshake queue
+			// hold packet while the destination is resolved to a peer
 
-		if peer.isRunning.Get() {
-			if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
-				peer.SendHandshakeInitiation(false)
+			if device.resolveDestination(elem) {
+				elem = nil
+				continue
+			}
+
+			device.drop(DropNoPeer)
+			elem.trace.drop(DropNoPeer)
+			if device.tun.icmpUnreachable.Get() {
+				device.sendICMPHostUnreachable(elem.packet)
 			}
-			addToNonceQueue(peer.queue.nonce, elem, device)
+			continue
+		}
+
+		if device.sendOutbound(peer, elem) {
 			elem = nil
 		}
 	}
 }
 
+/* Passes a packet read from the TUN device on to the peer it is routed to,
+ * returns true if the element has been handed over to the peer
+ */
+func (device *Device) sendOutbound(peer *Peer, elem *QueueOutboundElement) bool {
+	logDebug := device.log.Debug
+
+	// consult packet filter
+
+	if device.filterOutbound(peer, elem.packet) != FilterAccept {
+		logDebug.Println(peer, "- Outbound packet dropped by filter")
+		peer.drop(DropFiltered)
+		elem.trace.drop(DropFiltered)
+		return false
+	}
+
+	// fail fast if no handshake can be initiated
+
+	if device.tun.icmpUnreachable.Get() {
+		peer.RLock()
+		hasEndpoint := peer.endpoint != nil
+		peer.RUnlock()
+		if !hasEndpoint {
+			logDebug.Println(peer, "- No known endpoint, dropping packet")
+			peer.drop(DropNoEndpoint)
+			elem.trace.drop(DropNoEndpoint)
+			device.sendICMPHostUnreachable(elem.packet)
+			return false
+		}
+	}
+
+	// enforce tunnel MTU, outer datagrams are sent with DF set during path MTU discovery
+
+	mtu := peer.enforcedMTU()
+	if packetExceedsMTU(elem.packet, mtu, !device.net.pathMTUDiscovery.Get()) {
+		logDebug.Println(peer, "- Packet of", len(elem.packet), "bytes exceeds tunnel MTU of", mtu)
+		peer.drop(DropTooBig)
+		elem.trace.drop(DropTooBig)
+		device.sendICMPPacketTooBig(elem.packet, mtu)
+		return false
+	}
+
+	if device.tun.clampMSS.Get() {
+		clampTCPMSS(elem.packet, mtu)
+	}
+
+	return peer.queueShaped(elem)
+}
+
+/* Queues a packet for the peer, subject to fair queueing and egress shaping,
+ * returns true if the element has been handed over to the peer
+ */
+func (peer *Peer) queueShaped(elem *QueueOutboundElement) bool {
+
+	// insert into nonce/pre-handshake queue
+
+	if !peer.isRunning.Get() {
+		return false
+	}
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.SendHandshakeInitiation(false)
+	}
+	peer.queueOutbound(elem)
+	return true
+}
+
 func (peer *Peer) FlushNonceQueue() {
 	select {
 	case peer.signals.flushNonceQueue <- struct{}{}:
@@ -340,6 +451,7 @@ func (peer *Peer) RoutineNonce() {
 	logDebug := device.log.Debug
 
 	flush := func() {
+		peer.queue.fq.flush()
 		for {
 			select {
 			case elem := <-peer.queue.nonce:
@@ -365,6 +477,8 @@ func (peer *Peer) RoutineNonce() {
 	NextPacket:
 		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
+		var elem *QueueOutboundElement
+
 		select {
 		case <-peer.routines.stop:
 			return
@@ -373,77 +487,122 @@ func (peer *Peer) RoutineNonce() {
 			flush()
 			goto NextPacket
 
-		case elem, ok := <-peer.queue.nonce:
+		case <-peer.queue.fq.notify:
+			elem = peer.queue.fq.dequeue(time.Now())
+			if elem == nil {
+				goto NextPacket
+			}
 
+		case queued, ok := <-peer.queue.nonce:
 			if !ok {
 				return
 			}
+			elem = queued
+		}
 
-			// make sure to always pick the newest key
-
-			for {
-
-				// check validity of newest key pair
+		// hold back until permitted by egress shaping
 
-				keypair = peer.keypairs.Current()
-				if keypair != nil && keypair.sendNonce < RejectAfterMessages {
-					if time.Since(keypair.created) < RejectAfterTime {
-						break
-					}
-				}
-				peer.queue.packetInNonceQueueIsAwaitingKey.Set(true)
+		wait, ok := peer.rateLimit.tx.delay(len(elem.packet), time.Now())
+		if !ok {
+			peer.dropRateLimited()
+			elem.trace.drop(DropRateLimited)
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			goto NextPacket
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
 
-				// no suitable key pair, request for new handshake
+			case <-peer.signals.flushNonceQueue:
+				timer.Stop()
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				flush()
+				goto NextPacket
 
-				select {
-				case <-peer.signals.newKeypairArrived:
-				default:
-				}
+			case <-peer.routines.stop:
+				timer.Stop()
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				return
+			}
+		}
 
-				peer.SendHandshakeInitiation(false)
+		// make sure to always pick the newest key
 
-				// wait for key to be established
+		for {
 
-				logDebug.Println(peer, "- Awaiting keypair")
+			// check validity of newest key pair
 
-				select {
-				case <-peer.signals.newKeypairArrived:
-					logDebug.Println(peer, "- Obtained awaited keypair")
+			keypair = peer.keypairs.Current()
+			if keypair != nil && keypair.sendNonce < RejectAfterMessages {
+				if time.Since(keypair.created) < RejectAfterTime {
+					break
+				}
+			}
+			peer.queue.packetInNonceQueueIsAwaitingKey.Set(true)
 
-				case <-peer.signals.flushNonceQueue:
-					device.PutMessageBuffer(elem.buffer)
-					device.PutOutboundElement(elem)
-					flush()
-					goto NextPacket
+			// no suitable key pair, request for new handshake
 
-				case <-peer.routines.stop:
-					device.PutMessageBuffer(elem.buffer)
-					device.PutOutboundElement(elem)
-					return
-				}
+			select {
+			case <-peer.signals.newKeypairArrived:
+			default:
 			}
-			peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
-			// populate work element
+			peer.SendHandshakeInitiation(false)
 
-			elem.peer = peer
-			elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
+			// wait for key to be established
 
-			// double check in case of race condition added by future code
+			logDebug.Println(peer, "- Awaiting keypair")
 
-			if elem.nonce >= RejectAfterMessages {
-				atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+			select {
+			case <-peer.signals.newKeypairArrived:
+				logDebug.Println(peer, "- Obtained awaited keypair")
+
+			case <-peer.signals.flushNonceQueue:
 				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
+				flush()
 				goto NextPacket
+
+			case <-peer.routines.stop:
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+				return
 			}
+		}
+		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
-			elem.keypair = keypair
-			elem.dropped = AtomicFalse
-			elem.Lock()
+		// populate work element
 
-			// add to parallel and sequential queue
-			addToOutboundAndEncryptionQueues(peer.queue.outbound, device.queue.encryption, elem)
+		elem.peer = peer
+		elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
+
+		// double check in case of race condition added by future code
+
+		if elem.nonce >= RejectAfterMessages {
+			atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+			goto NextPacket
+		}
+
+		elem.keypair = keypair
+		elem.dropped = AtomicFalse
+		elem.trace.record(traceNonce)
+		elem.Lock()
+
+		// add to parallel and sequential queue, accounting the plaintext to egress shaping and its flow
+
+		flow, accounted := device.flowKey(peer, elem.packet, true)
+		size := len(elem.packet)
+		if addToOutboundAndEncryptionQueues(peer.queue.outbound, device.queue.encryption, elem) {
+			peer.rateLimit.tx.take(size, time.Now())
+			if accounted {
+				device.flows.account(&flow, size, true)
+			}
 		}
 	}
 }
@@ -543,6 +702,7 @@ func (device *Device) RoutineEncryption() {
 				elem.packet,
 				nil,
 			)
+			elem.trace.record(traceEncryption)
 			elem.Unlock()
 		}
 	}
@@ -602,6 +762,8 @@ func (peer *Peer) RoutineSequentialSender() {
 				continue
 			}
 
+			elem.trace.record(traceSequentialSender)
+
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketSent()
 
@@ -611,6 +773,9 @@ func (peer *Peer) RoutineSequentialSender() {
 			if len(elem.packet) != MessageKeepaliveSize {
 				peer.timersDataSent()
 			}
+			if err == nil {
+				elem.trace.complete(traceBindSend)
+			}
 			device.PutMessageBuffer(elem.buffer)
 			device.PutOutboundElement(elem)
 			if err != nil {
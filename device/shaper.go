@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+/* Per-peer bandwidth limits
+ *
+ * Each peer has a token bucket for either direction, limiting the inner bytes per second.
+ * Packets sent to the peer are shaped: whenever the bucket runs dry,
+ * the nonce worker holds back packets until enough tokens have accumulated,
+ * dropping packets which would be held back for more than RateLimitMaxDelay.
+ * Tokens are taken once a packet is handed to the encryption queue,
+ * so that packets dropped before do not count against the limit.
+ * Packets received from the peer are policed: they are dropped when the bucket is empty.
+ *
+ * Changing the rate refills the bucket, changing only the burst keeps its tokens.
+ */
+
+const (
+	RateLimitMaxDelay     = time.Millisecond * 100 // maximum time a shaped packet is held back
+	RateLimitDefaultBurst = time.Millisecond * 100 // burst size in terms of the rate, if not configured
+	rateLimitMinBurst     = 2 * DefaultMTU
+)
+
+type tokenBucket struct {
+	sync.Mutex
+	rate   uint64 // bits per second (0 = unlimited)
+	burst  uint64 // bytes (0 = default)
+	drops  uint64 // packets dropped
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) Set(rate, burst uint64) {
+	tb.Lock()
+	defer tb.Unlock()
+	if rate != tb.rate {
+		tb.last = time.Time{}
+	}
+	tb.rate = rate
+	tb.burst = burst
+}
+
+func (tb *tokenBucket) Get() (rate, burst, drops uint64) {
+	tb.Lock()
+	defer tb.Unlock()
+	return tb.rate, tb.burst, tb.drops
+}
+
+/* Adds the tokens accumulated since the last update
+ *
+ * Must hold tb.Mutex
+ */
+func (tb *tokenBucket) unsafeRefill(now time.Time) {
+	burst := float64(tb.burst)
+	if tb.burst == 0 {
+		burst = RateLimitDefaultBurst.Seconds() * float64(tb.rate) / 8
+		if burst < rateLimitMinBurst {
+			burst = rateLimitMinBurst
+		}
+	}
+	if tb.last.IsZero() {
+		tb.tokens = burst
+	} else {
+		tb.tokens += now.Sub(tb.last).Seconds() * float64(tb.rate) / 8
+		if tb.tokens > burst {
+			tb.tokens = burst
+		}
+	}
+	tb.last = now
+}
+
+/* Takes tokens for a packet of size bytes if available,
+ * otherwise counts the packet as dropped
+ */
+func (tb *tokenBucket) allow(size int, now time.Time) bool {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.rate == 0 {
+		return true
+	}
+	tb.unsafeRefill(now)
+	if tb.tokens < float64(size) {
+		tb.drops++
+		return false
+	}
+	tb.tokens -= float64(size)
+	return true
+}
+
+/* Returns how long a packet of size bytes must be held back
+ * until enough tokens have accumulated, without taking them,
+ * or false if it would be held back for too long and must be dropped
+ */
+func (tb *tokenBucket) delay(size int, now time.Time) (time.Duration, bool) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.rate == 0 {
+		return 0, true
+	}
+	tb.unsafeRefill(now)
+	missing := float64(size) - tb.tokens
+	if missing <= 0 {
+		return 0, true
+	}
+	delay := time.Duration(missing * 8 / float64(tb.rate) * float64(time.Second))
+	if delay > RateLimitMaxDelay {
+		tb.drops++
+		return 0, false
+	}
+	return delay, true
+}
+
+/* Takes tokens for a packet of size bytes sent
+ */
+func (tb *tokenBucket) take(size int, now time.Time) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.rate == 0 {
+		return
+	}
+	tb.unsafeRefill(now)
+	tb.tokens -= float64(size)
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketPolicing(t *testing.T) {
+	var tb tokenBucket
+	now := time.Now()
+
+	if !tb.allow(1<<20, now) {
+		t.Fatal("unlimited bucket dropped packet")
+	}
+
+	tb.Set(8000, 3000) // 1000 bytes per second
+	if !tb.allow(1500, now) || !tb.allow(1500, now) {
+		t.Fatal("burst not permitted")
+	}
+	if tb.allow(1500, now) {
+		t.Fatal("empty bucket permitted packet")
+	}
+	now = now.Add(time.Second)
+	if tb.allow(1500, now) {
+		t.Fatal("permitted packet before enough tokens accumulated")
+	}
+	if !tb.allow(1000, now) {
+		t.Fatal("accumulated tokens not permitted")
+	}
+	if _, _, drops := tb.Get(); drops != 2 {
+		t.Errorf("counted %d drops, expected 2", drops)
+	}
+}
+
+func TestTokenBucketShaping(t *testing.T) {
+	var tb tokenBucket
+	now := time.Now()
+
+	tb.Set(80000, 1000) // 10000 bytes per second
+	if delay, ok := tb.delay(1000, now); !ok || delay != 0 {
+		t.Fatalf("burst held back for %v", delay)
+	}
+	tb.take(1000, now)
+
+	// tokens are only taken for packets sent
+
+	if delay, ok := tb.delay(500, now); !ok || delay != 50*time.Millisecond {
+		t.Fatalf("unexpected delay %v", delay)
+	}
+	if delay, ok := tb.delay(500, now); !ok || delay != 50*time.Millisecond {
+		t.Fatalf("unexpected delay %v for packet not sent before", delay)
+	}
+	now = now.Add(50 * time.Millisecond)
+	tb.take(500, now)
+	if _, ok := tb.delay(1500, now); ok {
+		t.Fatal("packet held back beyond maximum delay")
+	}
+	if delay, ok := tb.delay(500, now.Add(20*time.Millisecond)); !ok || delay != 30*time.Millisecond {
+		t.Fatalf("unexpected delay %v after refill", delay)
+	}
+	if _, _, drops := tb.Get(); drops != 1 {
+		t.Errorf("counted %d drops, expected 1", drops)
+	}
+
+	// setting the same rate again keeps the bucket, setting another one refills it
+
+	tb.Set(80000, 2000)
+	if delay, ok := tb.delay(500, now); !ok || delay != 50*time.Millisecond {
+		t.Errorf("bucket refilled by setting the same rate, delay %v", delay)
+	}
+	tb.Set(160000, 2000)
+	if delay, ok := tb.delay(2000, now); !ok || delay != 0 {
+		t.Errorf("bucket not refilled by setting another rate, delay %v", delay)
+	}
+}
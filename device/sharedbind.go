@@ -0,0 +1,288 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+/* Shared binds
+ *
+ * A SharedBind lets several devices, each with its own static identity, peers and TUN device,
+ * listen on the same UDP port. Received handshake initiations are delivered to the device
+ * whose public key their MAC1 is valid for, all other messages to the device
+ * whose index table holds their receiver index. Messages matching no device are dropped.
+ * Attached devices allocate their indices from one index space, so that no two of them
+ * hold the same index.
+ *
+ * The socket is opened when the first device comes up and closed when the last goes down.
+ * The fwmark is shared by all devices, the listen port of the devices is ignored.
+ */
+
+const (
+	messageResponseOffsetReceiver = 8
+)
+
+type SharedBind struct {
+	sync.RWMutex
+	port     uint16 // requested
+	bind     conn.Bind
+	stopping *sync.WaitGroup // receiving routines of bind
+	members  []*sharedBindMember
+	indices  indexSpace
+}
+
+type sharedDatagram struct {
+	buffer   *[MaxMessageSize]byte
+	size     int
+	endpoint conn.Endpoint
+}
+
+/* The bind of a device attached to a shared bind
+ */
+type sharedBindMember struct {
+	shared  *SharedBind
+	device  *Device
+	inbound [2]chan sharedDatagram // IPv4, IPv6
+	closed  chan struct{}
+	closing sync.Once
+}
+
+var sharedBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([MaxMessageSize]byte)
+	},
+}
+
+func NewSharedBind(port uint16) *SharedBind {
+	return &SharedBind{port: port}
+}
+
+/* Attaches the device to the shared bind, opening the socket for the first device
+ */
+func (shared *SharedBind) attach(device *Device) (conn.Bind, uint16, error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	if shared.bind == nil {
+		bind, port, err := conn.CreateBind(shared.port)
+		if err != nil {
+			return nil, 0, err
+		}
+		shared.bind = bind
+		shared.port = port
+		shared.stopping = new(sync.WaitGroup)
+		shared.stopping.Add(2)
+		go shared.routineReceive(ipv4.Version, bind, shared.stopping)
+		go shared.routineReceive(ipv6.Version, bind, shared.stopping)
+	}
+
+	member := &sharedBindMember{
+		shared: shared,
+		device: device,
+		closed: make(chan struct{}),
+	}
+	for i := range member.inbound {
+		member.inbound[i] = make(chan sharedDatagram, QueueInboundSize)
+	}
+	shared.members = append(shared.members, member)
+	device.indexTable.join(&shared.indices)
+	return member, shared.port, nil
+}
+
+/* Detaches the member, closing the socket after the last one
+ */
+func (shared *SharedBind) detach(member *sharedBindMember) error {
+	shared.Lock()
+	for i, other := range shared.members {
+		if other == member {
+			shared.members = append(shared.members[:i], shared.members[i+1:]...)
+			member.device.indexTable.leave()
+			break
+		}
+	}
+	if len(shared.members) > 0 || shared.bind == nil {
+		shared.Unlock()
+		return nil
+	}
+	err := shared.bind.Close()
+	stopping := shared.stopping
+	shared.bind = nil
+	shared.stopping = nil
+	shared.Unlock()
+
+	stopping.Wait()
+	return err
+}
+
+/* Returns the member the message is destined to, or nil
+ */
+func (shared *SharedBind) route(msg []byte) *sharedBindMember {
+	if len(msg) < MinMessageSize {
+		return nil
+	}
+
+	shared.RLock()
+	defer shared.RUnlock()
+
+	msgType := binary.LittleEndian.Uint32(msg[:4])
+	switch msgType {
+	case MessageInitiationType:
+		if len(msg) != MessageInitiationSize {
+			return nil
+		}
+		for _, member := range shared.members {
+			if member.device.cookieCheckerFor(msg) != nil {
+				return member
+			}
+		}
+		return nil
+
+	case MessageResponseType:
+		if len(msg) != MessageResponseSize {
+			return nil
+		}
+		return shared.lookupIndex(binary.LittleEndian.Uint32(msg[messageResponseOffsetReceiver:]))
+
+	case MessageCookieReplyType, MessageTransportType:
+		return shared.lookupIndex(binary.LittleEndian.Uint32(msg[MessageTransportOffsetReceiver:]))
+
+	default:
+		return nil
+	}
+}
+
+/* Must hold shared.RWMutex
+ */
+func (shared *SharedBind) lookupIndex(index uint32) *sharedBindMember {
+	table := shared.indices.lookup(index)
+	if table == nil {
+		return nil
+	}
+	for _, member := range shared.members {
+		if &member.device.indexTable == table {
+			return member
+		}
+	}
+	return nil
+}
+
+func (shared *SharedBind) routineReceive(IP int, bind conn.Bind, stopping *sync.WaitGroup) {
+	defer stopping.Done()
+
+	queue := 0
+	if IP != ipv4.Version {
+		queue = 1
+	}
+
+	for {
+		buffer := sharedBufferPool.Get().(*[MaxMessageSize]byte)
+
+		var (
+			size     int
+			endpoint conn.Endpoint
+			err      error
+		)
+		if IP == ipv4.Version {
+			size, endpoint, err = bind.ReceiveIPv4(buffer[:])
+		} else {
+			size, endpoint, err = bind.ReceiveIPv6(buffer[:])
+		}
+		if err != nil {
+			sharedBufferPool.Put(buffer)
+			return
+		}
+
+		member := shared.route(buffer[:size])
+		if member == nil {
+			sharedBufferPool.Put(buffer)
+			continue
+		}
+		select {
+		case member.inbound[queue] <- sharedDatagram{buffer, size, endpoint}:
+		default:
+			member.device.drop(DropQueueFull)
+			sharedBufferPool.Put(buffer)
+		}
+	}
+}
+
+/* Attaches the device to the shared bind instead of opening a socket of its own,
+ * a nil shared bind restores the latter
+ */
+func (device *Device) SetSharedBind(shared *SharedBind) error {
+	device.net.Lock()
+	device.net.shared = shared
+	device.net.Unlock()
+	return device.BindUpdate()
+}
+
+func (member *sharedBindMember) receive(queue int, buff []byte) (int, conn.Endpoint, error) {
+	select {
+	case datagram := <-member.inbound[queue]:
+		n := copy(buff, datagram.buffer[:datagram.size])
+		sharedBufferPool.Put(datagram.buffer)
+		return n, datagram.endpoint, nil
+	case <-member.closed:
+		return 0, nil, errors.New("shared bind closed")
+	}
+}
+
+func (member *sharedBindMember) ReceiveIPv4(buff []byte) (int, conn.Endpoint, error) {
+	return member.receive(0, buff)
+}
+
+func (member *sharedBindMember) ReceiveIPv6(buff []byte) (int, conn.Endpoint, error) {
+	return member.receive(1, buff)
+}
+
+func (member *sharedBindMember) Send(buff []byte, endpoint conn.Endpoint) error {
+	member.shared.RLock()
+	bind := member.shared.bind
+	member.shared.RUnlock()
+	if bind == nil {
+		return errors.New("shared bind closed")
+	}
+	return bind.Send(buff, endpoint)
+}
+
+func (member *sharedBindMember) SetMark(mark uint32) error {
+	member.shared.RLock()
+	defer member.shared.RUnlock()
+	if member.shared.bind == nil {
+		return errors.New("shared bind closed")
+	}
+	return member.shared.bind.SetMark(mark)
+}
+
+func (member *sharedBindMember) LastMark() uint32 {
+	member.shared.RLock()
+	defer member.shared.RUnlock()
+	if member.shared.bind == nil {
+		return 0
+	}
+	return member.shared.bind.LastMark()
+}
+
+func (member *sharedBindMember) Close() error {
+	var err error
+	member.closing.Do(func() {
+		close(member.closed)
+		err = member.shared.detach(member)
+		for i := range member.inbound {
+			for len(member.inbound[i]) > 0 {
+				sharedBufferPool.Put((<-member.inbound[i]).buffer)
+			}
+		}
+	})
+	return err
+}
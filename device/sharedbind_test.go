@@ -0,0 +1,164 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestSharedBind(t *testing.T) {
+	port, err := strconv.ParseUint(getFreePort(t), 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := NewSharedBind(uint16(port))
+
+	newDevice := func(name string, config string) (*Device, *tuntest.ChannelTUN) {
+		tun := tuntest.NewChannelTUN()
+		device := NewDevice(tun.TUN(), NewLogger(LogLevelError, name+": "))
+		if err := device.IpcSetOperation(bufio.NewReader(strings.NewReader(config))); err != nil {
+			t.Fatal(err)
+		}
+		return device, tun
+	}
+	newKey := func() NoisePrivateKey {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sk
+	}
+
+	// two servers with distinct identities on the shared port, each with a client
+
+	var servers, clients [2]*Device
+	var serverTUNs, clientTUNs [2]*tuntest.ChannelTUN
+	for i := range servers {
+		serverKey, clientKey := newKey(), newKey()
+		clientIP, serverIP := fmt.Sprintf("1.0.%d.2", i), fmt.Sprintf("1.0.%d.1", i)
+
+		servers[i], serverTUNs[i] = newDevice(fmt.Sprintf("server%d", i), fmt.Sprintf(
+			"private_key=%s\npublic_key=%s\nallowed_ip=%s/32\n",
+			serverKey.ToHex(), clientKey.publicKey().ToHex(), clientIP))
+		if err := servers[i].SetSharedBind(shared); err != nil {
+			t.Fatal(err)
+		}
+		servers[i].Up()
+		defer servers[i].Close()
+
+		clients[i], clientTUNs[i] = newDevice(fmt.Sprintf("client%d", i), fmt.Sprintf(
+			"private_key=%s\nlisten_port=%s\npublic_key=%s\nallowed_ip=%s/32\nendpoint=127.0.0.1:%d\n",
+			clientKey.ToHex(), getFreePort(t), serverKey.publicKey().ToHex(), serverIP, port))
+		clients[i].Up()
+		defer clients[i].Close()
+	}
+
+	for i := range servers {
+		if servers[i].net.port != uint16(port) {
+			t.Fatalf("server listening on port %d, expected shared port %d", servers[i].net.port, port)
+		}
+	}
+
+	// each client reaches its server, and its server only
+
+	for i := range clients {
+		clientIP, serverIP := net.ParseIP(fmt.Sprintf("1.0.%d.2", i)), net.ParseIP(fmt.Sprintf("1.0.%d.1", i))
+		ping := tuntest.Ping(serverIP, clientIP)
+		clientTUNs[i].Outbound <- ping
+		select {
+		case received := <-serverTUNs[i].Inbound:
+			if !bytes.Equal(ping, received) {
+				t.Error("ping did not transit correctly")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("ping from client %d did not transit", i)
+		}
+
+		reply := tuntest.Ping(clientIP, serverIP)
+		serverTUNs[i].Outbound <- reply
+		select {
+		case received := <-clientTUNs[i].Inbound:
+			if !bytes.Equal(reply, received) {
+				t.Error("reply did not transit correctly")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("reply to client %d did not transit", i)
+		}
+	}
+	for i := range serverTUNs {
+		select {
+		case <-serverTUNs[i].Inbound:
+			t.Errorf("server %d received unexpected packet", i)
+		default:
+		}
+	}
+
+	// the socket is closed with the last device
+
+	servers[0].Down()
+	servers[1].Down()
+	if shared.bind != nil {
+		t.Error("shared socket not closed")
+	}
+}
+
+func TestIndexSpace(t *testing.T) {
+	var space indexSpace
+	var first, second IndexTable
+	first.Init()
+	second.Init()
+	peer := new(Peer)
+
+	// indices held before joining are kept by the first table to join
+
+	first.table[1] = IndexTableEntry{peer: peer}
+	second.table[1] = IndexTableEntry{peer: peer}
+	second.table[2] = IndexTableEntry{peer: peer}
+	first.join(&space)
+	second.join(&space)
+	if space.lookup(1) != &first || space.lookup(2) != &second {
+		t.Fatal("indices not owned by their tables")
+	}
+	if second.Lookup(1).peer != nil {
+		t.Error("colliding index kept by joining table")
+	}
+
+	// indices allocated by one table are not held by the other
+
+	for i := 0; i < 64; i++ {
+		index, err := first.NewIndexForHandshake(peer, nil)
+		assertNil(t, err)
+		if space.lookup(index) != &first || second.Lookup(index).peer != nil {
+			t.Fatalf("index %d not claimed by its table", index)
+		}
+		second.Lock()
+		claimed := second.claim(index)
+		second.Unlock()
+		if claimed {
+			t.Fatalf("index %d claimed twice", index)
+		}
+	}
+
+	// deleted and departed indices are released
+
+	first.Delete(1)
+	if space.lookup(1) != nil {
+		t.Error("deleted index still claimed")
+	}
+	second.leave()
+	if space.lookup(2) != nil {
+		t.Error("index of departed table still claimed")
+	}
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Delegated static keys
+ *
+ * The Diffie-Hellman operations with the static private key of the device can be
+ * delegated to a StaticKey, such as an agent in a separate privileged process
+ * (see package keyagent) or a hardware token, so that the device never holds
+ * the private key. The device then has no private key to report through UAPI,
+ * and the key log omits it.
+ *
+ * The StaticKey is called for every handshake initiation received or response consumed,
+ * and for every peer on its next handshake after the key changes. A failing operation
+ * fails the handshake, and is retried on the next one.
+ */
+
+type StaticKey interface {
+	PublicKey() NoisePublicKey
+	SharedSecret(publicKey NoisePublicKey) ([NoisePublicKeySize]byte, error)
+}
+
+/* Delegates the static key operations of the device, replacing its private key
+ */
+func (device *Device) SetStaticKey(key StaticKey) error {
+	return device.RotateStaticKey(key, 0)
+}
+
+/* Delegates the static key operations of the device, accepting initiations for the previous key
+ * during the grace period and keeping current sessions, if not 0
+ */
+func (device *Device) RotateStaticKey(key StaticKey, grace time.Duration) error {
+	device.staticIdentity.Lock()
+	defer device.staticIdentity.Unlock()
+
+	return device.unsafeRotateIdentity(NoisePrivateKey{}, key, grace)
+}
+
+/* Computes the shared secret of the current or the previous static key with the public key,
+ * all zeros if a delegated operation fails
+ *
+ * Must hold device.staticIdentity.RLock
+ */
+func (device *Device) staticSharedSecret(previous bool, pk NoisePublicKey) (ss [NoisePublicKeySize]byte) {
+	privateKey := &device.staticIdentity.privateKey
+	delegate := device.staticIdentity.delegate
+	if previous {
+		privateKey = &device.staticIdentity.previous.privateKey
+		delegate = device.staticIdentity.previous.delegate
+	}
+
+	if delegate == nil {
+		return privateKey.sharedSecret(pk)
+	}
+	ss, err := delegate.SharedSecret(pk)
+	if err != nil {
+		device.log.Error.Println("Failed to compute shared secret with static key:", err)
+		setZero(ss[:])
+	}
+	return ss
+}
+
+/* Pre-computes the static-static shared secrets of the handshake with the private keys,
+ * leaving those of delegated keys pending, so that no delegated operation is performed
+ * while holding the locks of the device or the peers
+ *
+ * Must hold device.staticIdentity.RLock and handshake.mutex
+ */
+func (device *Device) unsafePrecomputeStaticStatic(handshake *Handshake, previous bool) {
+	setZero(handshake.precomputedStaticStatic[:])
+	setZero(handshake.precomputedStaticStaticPrevious[:])
+	handshake.staticStaticPending = device.staticIdentity.delegate != nil ||
+		previous && device.staticIdentity.previous.delegate != nil
+	if handshake.staticStaticPending {
+		return
+	}
+	handshake.precomputedStaticStatic = device.staticSharedSecret(false, handshake.remoteStatic)
+	if previous {
+		handshake.precomputedStaticStaticPrevious = device.staticSharedSecret(true, handshake.remoteStatic)
+	}
+}
+
+/* Computes the pending static-static shared secrets of the handshake, before its next
+ * initiation or response, retrying those whose delegated operation failed
+ *
+ * Must hold device.staticIdentity.RLock, but not handshake.mutex
+ */
+func (device *Device) computePendingStaticStatic(handshake *Handshake) {
+	handshake.mutex.RLock()
+	pending := handshake.staticStaticPending
+	pk := handshake.remoteStatic
+	handshake.mutex.RUnlock()
+	if !pending {
+		return
+	}
+
+	previous := device.staticIdentity.previous.accepting(time.Now())
+	ss := device.staticSharedSecret(false, pk)
+	var ssPrevious [NoisePublicKeySize]byte
+	if previous {
+		ssPrevious = device.staticSharedSecret(true, pk)
+	}
+
+	handshake.mutex.Lock()
+	if handshake.staticStaticPending && handshake.remoteStatic == pk {
+		handshake.precomputedStaticStatic = ss
+		handshake.precomputedStaticStaticPrevious = ssPrevious
+		handshake.staticStaticPending = isZero(ss[:]) || previous && isZero(ssPrevious[:])
+	}
+	handshake.mutex.Unlock()
+
+	setZero(ss[:])
+	setZero(ssPrevious[:])
+}
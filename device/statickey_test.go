@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tai64n"
+)
+
+type testStaticKey struct {
+	privateKey NoisePrivateKey
+	failing    bool
+	calls      int
+}
+
+func (key *testStaticKey) PublicKey() NoisePublicKey {
+	return key.privateKey.publicKey()
+}
+
+func (key *testStaticKey) SharedSecret(publicKey NoisePublicKey) ([NoisePublicKeySize]byte, error) {
+	key.calls++
+	if key.failing {
+		return [NoisePublicKeySize]byte{}, errors.New("unavailable")
+	}
+	return key.privateKey.sharedSecret(publicKey), nil
+}
+
+func TestStaticKeyDelegation(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	sk, err := newPrivateKey()
+	assertNil(t, err)
+	key := &testStaticKey{privateKey: sk}
+	assertNil(t, dev2.SetStaticKey(key))
+	if dev2.staticIdentity.publicKey != sk.publicKey() || !dev2.staticIdentity.privateKey.IsZero() {
+		t.Fatal("static key not delegated")
+	}
+
+	peer1, _ := dev2.NewPeer(dev1.staticIdentity.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(sk.publicKey())
+	if key.calls != 0 || !peer1.handshake.staticStaticPending {
+		t.Errorf("static-static DH of new peer not deferred, %d calls", key.calls)
+	}
+
+	handshake := func() bool {
+		peer1.handshake.mutex.Lock()
+		peer1.handshake.lastInitiationConsumption = time.Time{}
+		peer1.handshake.lastTimestamp = tai64n.Timestamp{}
+		peer1.handshake.mutex.Unlock()
+
+		initiation, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		if dev2.ConsumeMessageInitiation(initiation) != peer1 {
+			return false
+		}
+		response, err := dev2.CreateMessageResponse(peer1)
+		assertNil(t, err)
+		return dev1.ConsumeMessageResponse(response) == peer2
+	}
+
+	// the device completes handshakes with the delegated key, and the delegated key only
+
+	if !handshake() {
+		t.Fatal("handshake with delegated static key failed")
+	}
+	if peer1.handshake.staticStaticPending {
+		t.Error("static-static DH not computed on handshake")
+	}
+	initiation, err := dev2.CreateMessageInitiation(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageInitiation(initiation) != peer2 {
+		t.Fatal("initiation with delegated static key not consumed")
+	}
+	response, err := dev1.CreateMessageResponse(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageResponse(response) != peer1 {
+		t.Error("response to delegated static key not consumed")
+	}
+
+	// and reports no private key
+
+	var config bytes.Buffer
+	writer := bufio.NewWriter(&config)
+	assertNil(t, dev2.IpcGetOperation(writer))
+	writer.Flush()
+	if bytes.Contains(config.Bytes(), []byte("private_key=")) {
+		t.Error("private key reported for delegated static key")
+	}
+
+	// failing operations fail the handshake
+
+	key.failing = true
+	if handshake() {
+		t.Error("handshake succeeded with failing static key")
+	}
+
+	// and are retried on the next handshake after changing the key
+
+	assertNil(t, dev2.SetStaticKey(key))
+	if handshake() {
+		t.Error("handshake succeeded with failing static key")
+	}
+	key.failing = false
+	if !handshake() {
+		t.Error("failed static-static DH not retried")
+	}
+
+	// rotating to a private key keeps accepting the delegated one during the grace period
+
+	sk, err = newPrivateKey()
+	assertNil(t, err)
+	assertNil(t, dev2.RotatePrivateKey(sk, time.Minute))
+	if dev2.staticIdentity.delegate != nil || dev2.staticIdentity.previous.delegate != key {
+		t.Fatal("delegated static key not kept as previous identity")
+	}
+	if !handshake() {
+		t.Error("handshake with previous delegated static key failed")
+	}
+}
@@ -0,0 +1,385 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/ipc"
+)
+
+/* Packet tracing
+ *
+ * Traced packets carry a record of the pipeline stages they pass, with timestamps.
+ * A packet is traced if it is sampled (one in trace_sample packets),
+ * or if it matches the configured peer and 5-tuple filters.
+ * The latter can only be decided once the peer and the inner packet are known,
+ * so while filters are configured all packets are recorded tentatively.
+ *
+ * A trace is completed when its element is returned to the pool,
+ * and kept traces are stored in a ring buffer, which is drained by the "trace=1" UAPI operation.
+ * The configuration is loaded atomically, so that only kept traces take the lock of the tracer.
+ */
+
+const (
+	TraceBufferSize = 256 // number of completed traces kept
+	traceMaxEvents  = 16
+)
+
+type traceStage uint8
+
+const (
+	traceTUNRead traceStage = iota
+	tracePeerLookup
+	traceNonceQueue
+	traceNonce
+	traceEncryption
+	traceSequentialSender
+	traceBindSend
+	traceBindReceive
+	traceDecryptionQueue
+	traceDecryption
+	traceSequentialReceiver
+	traceTUNWrite
+	traceHubForward
+)
+
+var traceStageNames = [...]string{
+	traceTUNRead:            "tun_read",
+	tracePeerLookup:         "peer_lookup",
+	traceNonceQueue:         "nonce_queue",
+	traceNonce:              "nonce",
+	traceEncryption:         "encryption",
+	traceSequentialSender:   "sequential_sender",
+	traceBindSend:           "bind_send",
+	traceBindReceive:        "bind_receive",
+	traceDecryptionQueue:    "decryption_queue",
+	traceDecryption:         "decryption",
+	traceSequentialReceiver: "sequential_receiver",
+	traceTUNWrite:           "tun_write",
+	traceHubForward:         "hub_forward",
+}
+
+type traceEvent struct {
+	stage traceStage
+	at    time.Time
+}
+
+type packetTrace struct {
+	id       uint64
+	outbound bool
+	sampled  bool
+	peer     *Peer
+	hasTuple bool
+	src      net.IP
+	dst      net.IP
+	protocol uint8
+	srcPort  uint16
+	dstPort  uint16
+	events   [traceMaxEvents]traceEvent
+	n        int
+	done     bool // reached the TUN device or the bind
+	dropped  bool
+	reason   DropReason
+}
+
+type traceConfig struct {
+	sample uint32
+	peer   *NoisePublicKey
+	filter *aclRule
+	spec   string // filter as configured
+}
+
+type tracer struct {
+	sync.Mutex // protects the ring buffer and serializes configuration updates
+	enabled    AtomicBool
+	counter    uint32       // atomic
+	settings   atomic.Value // *traceConfig
+	nextID     uint64
+	ring       [TraceBufferSize]*packetTrace
+	head       int
+	count      int
+	pool       sync.Pool
+}
+
+/* Records that the packet has passed the stage
+ */
+func (trace *packetTrace) record(stage traceStage) {
+	if trace == nil || trace.n == traceMaxEvents {
+		return
+	}
+	trace.events[trace.n] = traceEvent{stage: stage, at: time.Now()}
+	trace.n++
+}
+
+/* Records the peer and the inner 5-tuple of the packet
+ */
+func (trace *packetTrace) setPacket(peer *Peer, packet []byte) {
+	if trace == nil {
+		return
+	}
+	trace.peer = peer
+	var tuple FiveTuple
+	if !parseFiveTuple(packet, &tuple) {
+		return
+	}
+	trace.hasTuple = true
+	trace.src = append(trace.src[:0], tuple.Src...)
+	trace.dst = append(trace.dst[:0], tuple.Dst...)
+	trace.protocol = tuple.Protocol
+	trace.srcPort = tuple.SrcPort
+	trace.dstPort = tuple.DstPort
+}
+
+/* Records that the packet has been delivered after passing the stage
+ */
+func (trace *packetTrace) complete(stage traceStage) {
+	if trace == nil {
+		return
+	}
+	trace.record(stage)
+	trace.done = true
+}
+
+/* Records why the packet is being dropped
+ */
+func (trace *packetTrace) drop(reason DropReason) {
+	if trace == nil {
+		return
+	}
+	trace.dropped = true
+	trace.reason = reason
+}
+
+/* Starts a trace for a packet entering the device,
+ * if tracing is enabled
+ */
+func (tracer *tracer) start(outbound bool, peer *Peer, stage traceStage) *packetTrace {
+	if !tracer.enabled.Get() {
+		return nil
+	}
+	trace, _ := tracer.pool.Get().(*packetTrace)
+	if trace == nil {
+		trace = new(packetTrace)
+	}
+
+	counter := atomic.AddUint32(&tracer.counter, 1)
+	sample := tracer.loadConfig().sample
+	trace.sampled = sample != 0 && counter%sample == 0
+
+	trace.outbound = outbound
+	trace.peer = peer
+	trace.record(stage)
+	return trace
+}
+
+func (tracer *tracer) loadConfig() *traceConfig {
+	config, _ := tracer.settings.Load().(*traceConfig)
+	if config == nil {
+		return &traceConfig{}
+	}
+	return config
+}
+
+func (config *traceConfig) keep(trace *packetTrace) bool {
+	if trace.sampled {
+		return true
+	}
+	if config.peer == nil && config.filter == nil {
+		return false
+	}
+	if config.peer != nil && (trace.peer == nil || !trace.peer.handshake.remoteStatic.Equals(*config.peer)) {
+		return false
+	}
+	if config.filter != nil {
+		if !trace.hasTuple {
+			return false
+		}
+		if !config.filter.matches(trace.src, trace.protocol, trace.srcPort) &&
+			!config.filter.matches(trace.dst, trace.protocol, trace.dstPort) {
+			return false
+		}
+	}
+	return true
+}
+
+func (tracer *tracer) release(trace *packetTrace) {
+	trace.peer = nil
+	trace.hasTuple = false
+	trace.n = 0
+	trace.done = false
+	trace.dropped = false
+	tracer.pool.Put(trace)
+}
+
+/* Completes a trace, storing it in the ring buffer if it is to be kept
+ */
+func (tracer *tracer) commit(trace *packetTrace) {
+	if !tracer.loadConfig().keep(trace) {
+		tracer.release(trace)
+		return
+	}
+
+	tracer.Lock()
+	tracer.nextID++
+	trace.id = tracer.nextID
+	var evicted *packetTrace
+	index := (tracer.head + tracer.count) % TraceBufferSize
+	if tracer.count == TraceBufferSize {
+		evicted = tracer.ring[tracer.head]
+		tracer.head = (tracer.head + 1) % TraceBufferSize
+	} else {
+		tracer.count++
+	}
+	tracer.ring[index] = trace
+	tracer.Unlock()
+
+	if evicted != nil {
+		tracer.release(evicted)
+	}
+}
+
+/* Removes and returns all completed traces, oldest first
+ */
+func (tracer *tracer) drain() []*packetTrace {
+	tracer.Lock()
+	defer tracer.Unlock()
+
+	traces := make([]*packetTrace, 0, tracer.count)
+	for ; tracer.count > 0; tracer.count-- {
+		traces = append(traces, tracer.ring[tracer.head])
+		tracer.ring[tracer.head] = nil
+		tracer.head = (tracer.head + 1) % TraceBufferSize
+	}
+	return traces
+}
+
+/* Puts drained traces back in front of those completed meanwhile,
+ * releasing the oldest ones which no longer fit
+ */
+func (tracer *tracer) restore(traces []*packetTrace) {
+	tracer.Lock()
+	if excess := len(traces) + tracer.count - TraceBufferSize; excess > 0 {
+		for _, trace := range traces[:excess] {
+			defer tracer.release(trace)
+		}
+		traces = traces[excess:]
+	}
+	tracer.head = (tracer.head - len(traces) + TraceBufferSize) % TraceBufferSize
+	tracer.count += len(traces)
+	for i, trace := range traces {
+		tracer.ring[(tracer.head+i)%TraceBufferSize] = trace
+	}
+	tracer.Unlock()
+}
+
+/* Replaces the configuration by a modified copy
+ */
+func (tracer *tracer) updateConfig(update func(config *traceConfig)) {
+	tracer.Lock()
+	defer tracer.Unlock()
+	config := *tracer.loadConfig()
+	update(&config)
+	tracer.settings.Store(&config)
+	tracer.enabled.Set(config.sample != 0 || config.peer != nil || config.filter != nil)
+}
+
+func (tracer *tracer) setSample(sample uint32) {
+	tracer.updateConfig(func(config *traceConfig) {
+		config.sample = sample
+	})
+}
+
+func (tracer *tracer) setPeer(peer *NoisePublicKey) {
+	tracer.updateConfig(func(config *traceConfig) {
+		config.peer = peer
+	})
+}
+
+/* Sets the 5-tuple filter, given in the format of ACL rules,
+ * matching either the source or the destination of packets
+ */
+func (tracer *tracer) setFilter(spec string) error {
+	var filter *aclRule
+	if spec != "" {
+		var err error
+		filter, err = parseACLRule(spec, true)
+		if err != nil {
+			return err
+		}
+	}
+	tracer.updateConfig(func(config *traceConfig) {
+		config.filter = filter
+		config.spec = spec
+	})
+	return nil
+}
+
+func (tracer *tracer) config() (sample uint32, peer *NoisePublicKey, filter string) {
+	config := tracer.loadConfig()
+	return config.sample, config.peer, config.spec
+}
+
+/* Formats a trace as UAPI lines
+ */
+func (trace *packetTrace) lines() []string {
+	lines := make([]string, 0, 8+trace.n)
+	lines = append(lines, fmt.Sprintf("trace=%d", trace.id))
+	if trace.outbound {
+		lines = append(lines, "direction=outbound")
+	} else {
+		lines = append(lines, "direction=inbound")
+	}
+	if trace.peer != nil {
+		lines = append(lines, "public_key="+trace.peer.handshake.remoteStatic.ToHex())
+	}
+	if trace.hasTuple {
+		lines = append(lines, fmt.Sprintf("protocol=%d", trace.protocol))
+		lines = append(lines, "src="+net.JoinHostPort(trace.src.String(), fmt.Sprint(trace.srcPort)))
+		lines = append(lines, "dst="+net.JoinHostPort(trace.dst.String(), fmt.Sprint(trace.dstPort)))
+	}
+	for _, event := range trace.events[:trace.n] {
+		offset := event.at.Sub(trace.events[0].at)
+		lines = append(lines, fmt.Sprintf("stage=%s:%d", traceStageNames[event.stage], offset.Nanoseconds()))
+	}
+	switch {
+	case trace.dropped:
+		lines = append(lines, "result=dropped", "drop_reason="+trace.reason.String())
+	case trace.done:
+		lines = append(lines, "result=delivered")
+	default:
+		lines = append(lines, "result=discarded") // keepalives, probes and send failures
+	}
+	return lines
+}
+
+/* Writes and removes all completed traces,
+ * putting them back if they cannot be written
+ */
+func (device *Device) IpcTraceOperation(socket *bufio.Writer) error {
+	traces := device.trace.drain()
+	for _, trace := range traces {
+		for _, line := range trace.lines() {
+			if _, err := socket.WriteString(line + "\n"); err != nil {
+				device.trace.restore(traces)
+				return &IPCError{ipc.IpcErrorIO}
+			}
+		}
+	}
+	if err := socket.Flush(); err != nil {
+		device.trace.restore(traces)
+		return &IPCError{ipc.IpcErrorIO}
+	}
+	for _, trace := range traces {
+		device.trace.release(trace)
+	}
+	return nil
+}
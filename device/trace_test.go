@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+)
+
+func TestTraceSampling(t *testing.T) {
+	var tracer tracer
+	if tracer.start(true, nil, traceTUNRead) != nil {
+		t.Fatal("trace started while tracing is disabled")
+	}
+
+	tracer.setSample(4)
+	for i := 0; i < 4*TraceBufferSize+8; i++ {
+		trace := tracer.start(true, nil, traceTUNRead)
+		trace.record(tracePeerLookup)
+		tracer.commit(trace)
+	}
+	traces := tracer.drain()
+	if len(traces) != TraceBufferSize {
+		t.Fatalf("kept %d traces, expected %d", len(traces), TraceBufferSize)
+	}
+	for i := 1; i < len(traces); i++ {
+		if traces[i].id != traces[i-1].id+1 {
+			t.Fatalf("traces out of order: %d after %d", traces[i].id, traces[i-1].id)
+		}
+	}
+	if traces[len(traces)-1].id != TraceBufferSize+2 {
+		t.Errorf("newest trace %d, expected %d", traces[len(traces)-1].id, TraceBufferSize+2)
+	}
+	if len(tracer.drain()) != 0 {
+		t.Error("traces remain after drain")
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := testPeer(t, device)
+	other := testPeer(t, device)
+
+	key := peer.handshake.remoteStatic
+	device.trace.setPeer(&key)
+	if err := device.trace.setFilter("icmp:10.0.0.2/32"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		peer *Peer
+		src  net.IP
+		keep bool
+	}{
+		{peer, net.IPv4(10, 0, 0, 2), true},
+		{peer, net.IPv4(10, 0, 0, 3), false},
+		{other, net.IPv4(10, 0, 0, 2), false},
+		{nil, net.IPv4(10, 0, 0, 2), false},
+	}
+	for _, test := range tests {
+		trace := device.trace.start(true, nil, traceTUNRead)
+		trace.setPacket(test.peer, tuntest.Ping(net.IPv4(10, 0, 1, 1), test.src))
+		trace.drop(DropNoEndpoint)
+		device.trace.commit(trace)
+		if kept := len(device.trace.drain()) == 1; kept != test.keep {
+			t.Errorf("trace from %v of %v kept: %v, expected %v", test.src, test.peer, kept, test.keep)
+		}
+	}
+
+	trace := device.trace.start(true, peer, traceTUNRead)
+	trace.setPacket(peer, tuntest.Ping(net.IPv4(10, 0, 1, 1), net.IPv4(10, 0, 0, 2)))
+	trace.complete(traceBindSend)
+	device.trace.commit(trace)
+
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if err := device.IpcTraceOperation(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Flush()
+	for _, line := range []string{
+		"direction=outbound\n",
+		"public_key=" + key.ToHex() + "\n",
+		"src=10.0.0.2:",
+		"stage=tun_read:0\n",
+		"stage=bind_send:",
+		"result=delivered\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("trace output lacks %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("closed")
+}
+
+func TestTraceRestore(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	device.trace.setSample(1)
+
+	commit := func(n int) {
+		for i := 0; i < n; i++ {
+			trace := device.trace.start(true, nil, traceTUNRead)
+			device.trace.commit(trace)
+		}
+	}
+	check := func(traces []*packetTrace, first, count uint64) {
+		if uint64(len(traces)) != count {
+			t.Fatalf("kept %d traces, expected %d", len(traces), count)
+		}
+		for i, trace := range traces {
+			if trace.id != first+uint64(i) {
+				t.Fatalf("trace %d at position %d, expected %d", trace.id, i, first+uint64(i))
+			}
+		}
+	}
+
+	// traces are kept if they cannot be written
+
+	commit(3)
+	if device.IpcTraceOperation(bufio.NewWriter(failingWriter{})) == nil {
+		t.Fatal("writing traces succeeded")
+	}
+	commit(1)
+	check(device.trace.drain(), 1, 4)
+
+	// ahead of those completed meanwhile, as long as they fit
+
+	commit(TraceBufferSize)
+	traces := device.trace.drain()
+	commit(2)
+	device.trace.restore(traces)
+	check(device.trace.drain(), 7, TraceBufferSize)
+}
@@ -54,3 +54,13 @@ func (device *Device) RoutineTUNEventReader() {
 	logDebug.Println("Routine: event worker - stopped")
 	device.state.stopping.Done()
 }
+
+/* Returns the largest inner packet which may be sent through the tunnel
+ */
+func (device *Device) tunnelMTU() int {
+	mtu := int(atomic.LoadInt32(&device.tun.mtu))
+	if mtu <= 0 || mtu > MaxContentSize {
+		return MaxContentSize
+	}
+	return mtu
+}
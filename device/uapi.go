@@ -57,6 +57,14 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 			send("private_key=" + device.staticIdentity.privateKey.ToHex())
 		}
 
+		if grace := device.staticIdentity.grace; grace != 0 {
+			send(fmt.Sprintf("private_key_grace=%d", grace/time.Second))
+		}
+		if previous := &device.staticIdentity.previous; previous.accepting(time.Now()) {
+			send("previous_public_key=" + previous.publicKey.ToHex())
+			send(fmt.Sprintf("previous_key_until=%d", previous.until.Unix()))
+		}
+
 		if device.net.port != 0 {
 			send(fmt.Sprintf("listen_port=%d", device.net.port))
 		}
@@ -65,6 +73,59 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
 		}
 
+		if device.tun.clampMSS.Get() {
+			send("clamp_mss=true")
+		}
+
+		if device.net.pathMTUDiscovery.Get() {
+			send("pmtu_discovery=true")
+		}
+
+		if device.tun.icmpUnreachable.Get() {
+			send("icmp_unreachable=true")
+		}
+
+		if device.hub.enabled.Get() {
+			send("hub_mode=true")
+		}
+
+		if device.queue.fairQueueing.Get() {
+			send("fq_codel=true")
+		}
+
+		if sample, peer, filter := device.trace.config(); sample != 0 || peer != nil || filter != "" {
+			if sample != 0 {
+				send(fmt.Sprintf("trace_sample=%d", sample))
+			}
+			if peer != nil {
+				send("trace_peer=" + peer.ToHex())
+			}
+			if filter != "" {
+				send("trace_filter=" + filter)
+			}
+		}
+
+		if collector, flows := device.FlowCollector(); collector != "" {
+			send("flow_collector=" + collector)
+			send(fmt.Sprintf("flows=%d", flows))
+		}
+
+		if sources, mappings := device.NATSources(); len(sources) > 0 {
+			for _, source := range sources {
+				send("nat_source=" + source.String())
+			}
+			send(fmt.Sprintf("nat_mappings=%d", mappings))
+		}
+
+		if path, packets := device.capture.status(); path != "" {
+			send("capture_file=" + path)
+			send(fmt.Sprintf("capture_packets=%d", packets))
+		}
+
+		device.drops.forEach(func(reason DropReason, count uint64) {
+			send(fmt.Sprintf("drop_%s=%d", reason, count))
+		})
+
 		// serialize each peer state
 
 		for _, peer := range device.peers.keyMap {
@@ -87,11 +148,85 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) error {
 			send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
 			send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
 			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+			if path := atomic.LoadInt32(&peer.mtu.path); path > 0 {
+				send(fmt.Sprintf("path_mtu=%d", path))
+			}
+			send(fmt.Sprintf("tunnel_mtu=%d", peer.tunnelMTU()))
+			if peer.mtu.clamp.Get() {
+				send("clamp_mtu=true")
+			}
+			if peer.hubIsolated.Get() {
+				send("hub_forward=false")
+			}
+			peer.handshake.mutex.RLock()
+			previousInitiations := peer.handshake.previousIdentityInitiations
+			peer.handshake.mutex.RUnlock()
+			if previousInitiations != 0 {
+				send(fmt.Sprintf("previous_key_initiations=%d", previousInitiations))
+			}
+			expiresAt, idleTimeout := device.peerExpiry(peer)
+			if !expiresAt.IsZero() {
+				send(fmt.Sprintf("expires_at=%d", expiresAt.Unix()))
+			}
+			if idleTimeout != 0 {
+				send(fmt.Sprintf("idle_timeout=%d", idleTimeout/time.Second))
+			}
+
+			txRate, txBurst, txDrops := peer.rateLimit.tx.Get()
+			rxRate, rxBurst, rxDrops := peer.rateLimit.rx.Get()
+			if txRate != 0 {
+				send(fmt.Sprintf("tx_rate_limit=%d", txRate))
+			}
+			if rxRate != 0 {
+				send(fmt.Sprintf("rx_rate_limit=%d", rxRate))
+			}
+			if txRate != 0 || rxRate != 0 {
+				burst := txBurst
+				if txRate == 0 {
+					burst = rxBurst
+				}
+				send(fmt.Sprintf("rate_limit_burst=%d", burst))
+			}
+			if device.queue.fairQueueing.Get() {
+				overlimitDrops, codelDrops, delay := peer.queue.fq.Stats()
+				send(fmt.Sprintf("fq_overlimit_drops=%d", overlimitDrops))
+				send(fmt.Sprintf("fq_codel_drops=%d", codelDrops))
+				send(fmt.Sprintf("fq_queue_delay_usec=%d", delay.Microseconds()))
+			}
+			if txDrops != 0 || txRate != 0 {
+				send(fmt.Sprintf("tx_rate_limit_drops=%d", txDrops))
+			}
+			if rxDrops != 0 || rxRate != 0 {
+				send(fmt.Sprintf("rx_rate_limit_drops=%d", rxDrops))
+			}
+			drops := peer.dropCounters()
+			drops.forEach(func(reason DropReason, count uint64) {
+				send(fmt.Sprintf("drop_%s=%d", reason, count))
+			})
 
 			for _, ip := range device.allowedips.EntriesForPeer(peer) {
 				send("allowed_ip=" + ip.String())
 			}
 
+			for _, network := range peer.AllowedEndpoints() {
+				send("allowed_endpoint=" + network.String())
+			}
+
+			if peer.roaming.disabled.Get() {
+				send("disable_roaming=true")
+			}
+			for _, change := range peer.roaming.history.entries() {
+				send("roamed_to=" + change.endpoint)
+				send(fmt.Sprintf("roamed_at=%d", change.time.Unix()))
+			}
+
+			if acl := peer.accessList(); acl != nil {
+				for _, rule := range acl.rules {
+					send(rule.String())
+					send(fmt.Sprintf("acl_hits=%d", atomic.LoadUint64(&rule.hits)))
+				}
+			}
+
 		}
 	}()
 
@@ -146,7 +281,20 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 					return &IPCError{ipc.IpcErrorInvalid}
 				}
 				logDebug.Println("UAPI: Updating private key")
-				device.SetPrivateKey(sk)
+				device.RotatePrivateKey(sk, device.privateKeyGrace())
+
+			case "private_key_grace":
+
+				// accept initiations for the previous key after changing the private key, 0 disables
+
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to set private_key_grace, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating private key grace period")
+				device.SetPrivateKeyGrace(time.Duration(secs) * time.Second)
 
 			case "listen_port":
 
@@ -195,6 +343,141 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 					return &IPCError{ipc.IpcErrorPortInUse}
 				}
 
+			case "clamp_mss":
+
+				// enable or disable TCP MSS clamping
+
+				clamp, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set clamp_mss, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating TCP MSS clamping")
+				device.tun.clampMSS.Set(clamp)
+
+			case "pmtu_discovery":
+
+				// enable or disable outer path MTU discovery
+
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set pmtu_discovery, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating path MTU discovery")
+
+				if err := device.BindSetPathMTUDiscovery(enabled); err != nil {
+					logError.Println("Failed to update path MTU discovery:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+			case "icmp_unreachable":
+
+				// enable or disable ICMP unreachable for unroutable packets
+
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set icmp_unreachable, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating ICMP unreachable responses")
+				device.tun.icmpUnreachable.Set(enabled)
+
+			case "hub_mode":
+
+				// enable or disable forwarding between peers
+
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set hub_mode, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating hub mode")
+				device.hub.enabled.Set(enabled)
+
+			case "fq_codel":
+
+				// enable or disable fair queueing of packets to peers
+
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set fq_codel, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating fair queueing")
+				device.queue.fairQueueing.Set(enabled)
+
+			case "flow_collector":
+
+				// export flows to the IPFIX collector, empty to disable
+
+				logDebug.Println("UAPI: Updating flow collector")
+				if err := device.SetFlowCollector(value); err != nil {
+					logError.Println("Failed to set flow_collector:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+			case "nat_source":
+
+				// masquerade packets from peers behind the address, empty to disable
+
+				var source net.IP
+				if value != "" {
+					source = net.ParseIP(value)
+					if source == nil {
+						logError.Println("Failed to set nat_source, invalid value:", value)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+
+				logDebug.Println("UAPI: Updating NAT source")
+				device.SetNATSource(source)
+
+			case "trace_sample":
+
+				// trace one in every n packets, 0 disables sampling
+
+				sample, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to set trace_sample, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating trace sampling")
+				device.trace.setSample(uint32(sample))
+
+			case "trace_peer":
+
+				// trace packets to and from the peer, empty to disable
+
+				var peer *NoisePublicKey
+				if value != "" {
+					peer = new(NoisePublicKey)
+					if err := peer.FromHex(value); err != nil {
+						logError.Println("Failed to set trace_peer:", err)
+						return &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+
+				logDebug.Println("UAPI: Updating trace peer")
+				device.trace.setPeer(peer)
+
+			case "trace_filter":
+
+				// trace packets matching the 5-tuple filter, empty to disable
+
+				if err := device.trace.setFilter(value); err != nil {
+					logError.Println("Failed to set trace_filter:", err, ":", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating trace filter")
+
 			case "public_key":
 				// switch to peer configuration
 				logDebug.Println("UAPI: Transition to peer configuration")
@@ -290,15 +573,23 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 
 				logDebug.Println(peer, "- UAPI: Updating preshared key")
 
-				peer.handshake.mutex.Lock()
-				err := peer.handshake.presharedKey.FromHex(value)
-				peer.handshake.mutex.Unlock()
-
+				var psk NoiseSymmetricKey
+				err := psk.FromHex(value)
 				if err != nil {
 					logError.Println("Failed to set preshared key:", err)
 					return &IPCError{ipc.IpcErrorInvalid}
 				}
 
+				if dummy {
+					setZero(psk[:])
+					continue
+				}
+
+				peer.handshake.mutex.Lock()
+				peer.handshake.presharedKey = psk
+				peer.handshake.mutex.Unlock()
+				setZero(psk[:])
+
 			case "endpoint":
 
 				// set endpoint destination
@@ -313,6 +604,7 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 						return err
 					}
 					peer.endpoint = endpoint
+					peer.resetPathMTU()
 					return nil
 				}()
 
@@ -348,6 +640,121 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 					}
 				}
 
+			case "expires_at":
+
+				// remove peer at the unix time, 0 keeps it
+
+				logDebug.Println(peer, "- UAPI: Updating expiry time")
+
+				secs, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || secs < 0 {
+					logError.Println("Failed to set expires_at, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				var expiresAt time.Time
+				if secs != 0 {
+					expiresAt = time.Unix(secs, 0)
+				}
+				device.SetPeerExpiry(peer, expiresAt)
+
+			case "idle_timeout":
+
+				// remove peer after receiving nothing for the seconds, 0 keeps it
+
+				logDebug.Println(peer, "- UAPI: Updating idle timeout")
+
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to set idle_timeout, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				device.SetPeerIdleTimeout(peer, time.Duration(secs)*time.Second)
+
+			case "disable_roaming":
+
+				// keep the endpoint regardless of the source of packets received
+
+				disabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set disable_roaming, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println(peer, "- UAPI: Updating roaming")
+				peer.SetRoamingDisabled(disabled)
+
+			case "clamp_mtu":
+
+				// limit inner packets to the path MTU towards the peer
+
+				clamp, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set clamp_mtu, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println(peer, "- UAPI: Updating MTU clamping")
+				peer.mtu.clamp.Set(clamp)
+
+			case "tx_rate_limit", "rx_rate_limit":
+
+				// update bandwidth limit in bits per second (0 = unlimited)
+
+				logDebug.Println(peer, "- UAPI: Updating", key)
+
+				rate, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					logError.Println("Failed to set", key+":", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				bucket := &peer.rateLimit.tx
+				if key == "rx_rate_limit" {
+					bucket = &peer.rateLimit.rx
+				}
+				_, burst, _ := bucket.Get()
+				bucket.Set(rate, burst)
+
+			case "rate_limit_burst":
+
+				// update burst size in bytes of both directions (0 = default)
+
+				logDebug.Println(peer, "- UAPI: Updating rate limit burst")
+
+				burst, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					logError.Println("Failed to set rate limit burst:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				for _, bucket := range []*tokenBucket{&peer.rateLimit.tx, &peer.rateLimit.rx} {
+					rate, _, _ := bucket.Get()
+					bucket.Set(rate, burst)
+				}
+
+			case "hub_forward":
+
+				// permit forwarding to and from the peer in hub mode
+
+				forward, err := strconv.ParseBool(value)
+				if err != nil {
+					logError.Println("Failed to set hub_forward, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				logDebug.Println(peer, "- UAPI: Updating hub forwarding")
+				peer.hubIsolated.Set(!forward)
+
 			case "replace_allowed_ips":
 
 				logDebug.Println(peer, "- UAPI: Removing all allowedips")
@@ -380,6 +787,67 @@ func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
 				ones, _ := network.Mask.Size()
 				device.allowedips.Insert(network.IP, uint(ones), peer)
 
+			case "replace_allowed_endpoints":
+
+				logDebug.Println(peer, "- UAPI: Removing all allowed endpoints")
+
+				if value != "true" {
+					logError.Println("Failed to replace allowed endpoints, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearAllowedEndpoints()
+
+			case "allowed_endpoint":
+
+				logDebug.Println(peer, "- UAPI: Adding allowed endpoint")
+
+				_, network, err := net.ParseCIDR(value)
+				if err != nil {
+					logError.Println("Failed to set allowed endpoint:", err)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.AddAllowedEndpoint(*network)
+
+			case "replace_acl":
+
+				logDebug.Println(peer, "- UAPI: Removing all ACL rules")
+
+				if value != "true" {
+					logError.Println("Failed to replace ACL, invalid value:", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.ClearACL()
+
+			case "acl_allow", "acl_deny":
+
+				logDebug.Println(peer, "- UAPI: Adding ACL rule")
+
+				if _, err := parseACLRule(value, key == "acl_allow"); err != nil {
+					logError.Println("Failed to add ACL rule:", err, ":", value)
+					return &IPCError{ipc.IpcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.AddACLRule(value, key == "acl_allow")
+
 			case "protocol_version":
 
 				if value != "1" {
@@ -437,6 +905,22 @@ func (device *Device) IpcHandle(socket net.Conn) {
 			status = &IPCError{1}
 		}
 
+	case "capture=1\n":
+		err = device.IpcCaptureOperation(buffered.Reader)
+		if err != nil && !errors.As(err, &status) {
+			// should never happen
+			device.log.Error.Println("Invalid UAPI error:", err)
+			status = &IPCError{1}
+		}
+
+	case "trace=1\n":
+		err = device.IpcTraceOperation(buffered.Writer)
+		if err != nil && !errors.As(err, &status) {
+			// should never happen
+			device.log.Error.Println("Invalid UAPI error:", err)
+			status = &IPCError{1}
+		}
+
 	default:
 		device.log.Error.Println("Invalid UAPI operation:", op)
 		return
@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package ipfix implements encoding of IPFIX messages as specified in RFC 7011.
+package ipfix
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	Version           = 10
+	HeaderLen         = 16
+	SetHeaderLen      = 4
+	TemplateSetID     = 2
+	MinDataSetID      = 256
+	VariableLength    = 0xffff
+	MaxVariableLength = 0xfffe
+)
+
+// Information elements assigned by IANA, as far as used by this package's users.
+const (
+	OctetDeltaCount          = 1
+	PacketDeltaCount         = 2
+	ProtocolIdentifier       = 4
+	SourceTransportPort      = 7
+	SourceIPv4Address        = 8
+	DestinationTransportPort = 11
+	DestinationIPv4Address   = 12
+	SourceIPv6Address        = 27
+	DestinationIPv6Address   = 28
+	FlowDirection            = 61
+	FlowStartMilliseconds    = 152
+	FlowEndMilliseconds      = 153
+	UserName                 = 371
+)
+
+// A Field is an information element of a template,
+// with length VariableLength for variable length encoding.
+type Field struct {
+	ID     uint16
+	Length uint16
+}
+
+// A Template describes the layout of the data records of a set.
+type Template struct {
+	ID     uint16
+	Fields []Field
+}
+
+// A Message is an IPFIX message under construction.
+// Records are appended field by field in the order of their template.
+type Message struct {
+	buf   []byte
+	set   int // offset of the header of the open set, or -1
+	setID uint16
+}
+
+// NewMessage starts a message of the observation domain,
+// reusing the buffer.
+func NewMessage(buf []byte, domain uint32, sequence uint32, exportTime time.Time) *Message {
+	m := &Message{buf: buf[:0], set: -1}
+	var header [HeaderLen]byte
+	binary.BigEndian.PutUint16(header[0:], Version)
+	binary.BigEndian.PutUint32(header[4:], uint32(exportTime.Unix()))
+	binary.BigEndian.PutUint32(header[8:], sequence)
+	binary.BigEndian.PutUint32(header[12:], domain)
+	m.buf = append(m.buf, header[:]...)
+	return m
+}
+
+func (m *Message) closeSet() {
+	if m.set < 0 {
+		return
+	}
+	binary.BigEndian.PutUint16(m.buf[m.set+2:], uint16(len(m.buf)-m.set))
+	m.set = -1
+}
+
+func (m *Message) openSet(id uint16) {
+	if m.set >= 0 && m.setID == id {
+		return
+	}
+	m.closeSet()
+	m.set = len(m.buf)
+	m.setID = id
+	m.buf = append(m.buf, byte(id>>8), byte(id), 0, 0)
+}
+
+// AddTemplate appends a template record.
+func (m *Message) AddTemplate(template *Template) {
+	m.openSet(TemplateSetID)
+	m.Uint16(template.ID)
+	m.Uint16(uint16(len(template.Fields)))
+	for _, field := range template.Fields {
+		m.Uint16(field.ID)
+		m.Uint16(field.Length)
+	}
+}
+
+// StartRecord starts a data record of the template,
+// whose fields are to be appended next.
+func (m *Message) StartRecord(templateID uint16) {
+	m.openSet(templateID)
+}
+
+func (m *Message) Uint8(v uint8) {
+	m.buf = append(m.buf, v)
+}
+
+func (m *Message) Uint16(v uint16) {
+	m.buf = append(m.buf, byte(v>>8), byte(v))
+}
+
+func (m *Message) Uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	m.buf = append(m.buf, b[:]...)
+}
+
+func (m *Message) Uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	m.buf = append(m.buf, b[:]...)
+}
+
+// Milliseconds appends a dateTimeMilliseconds value.
+func (m *Message) Milliseconds(t time.Time) {
+	m.Uint64(uint64(t.UnixNano() / int64(time.Millisecond)))
+}
+
+// IPv4 appends an ipv4Address value, the unspecified address if ip is not IPv4.
+func (m *Message) IPv4(ip net.IP) {
+	var b [net.IPv4len]byte
+	copy(b[:], ip.To4())
+	m.buf = append(m.buf, b[:]...)
+}
+
+// IPv6 appends an ipv6Address value.
+func (m *Message) IPv6(ip net.IP) {
+	var b [net.IPv6len]byte
+	copy(b[:], ip.To16())
+	m.buf = append(m.buf, b[:]...)
+}
+
+// String appends a variable length string value, truncated to MaxVariableLength.
+func (m *Message) String(s string) {
+	if len(s) > MaxVariableLength {
+		s = s[:MaxVariableLength]
+	}
+	if len(s) < 255 {
+		m.buf = append(m.buf, byte(len(s)))
+	} else {
+		m.buf = append(m.buf, 255, byte(len(s)>>8), byte(len(s)))
+	}
+	m.buf = append(m.buf, s...)
+}
+
+// Len returns the length of the message so far.
+func (m *Message) Len() int {
+	return len(m.buf)
+}
+
+// Bytes completes the message and returns its encoding.
+func (m *Message) Bytes() []byte {
+	m.closeSet()
+	binary.BigEndian.PutUint16(m.buf[2:], uint16(len(m.buf)))
+	return m.buf
+}
+
+// A Header is the header of a received message.
+type Header struct {
+	ExportTime time.Time
+	Sequence   uint32
+	Domain     uint32
+}
+
+// A Set is a set of a received message, with the records undecoded.
+type Set struct {
+	ID      uint16
+	Records []byte
+}
+
+// ParseMessage validates a received message and splits it into its sets.
+func ParseMessage(msg []byte) (Header, []Set, error) {
+	var header Header
+	if len(msg) < HeaderLen || binary.BigEndian.Uint16(msg[0:]) != Version {
+		return header, nil, errors.New("not an IPFIX message")
+	}
+	if int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+		return header, nil, errors.New("invalid message length")
+	}
+	header.ExportTime = time.Unix(int64(binary.BigEndian.Uint32(msg[4:])), 0)
+	header.Sequence = binary.BigEndian.Uint32(msg[8:])
+	header.Domain = binary.BigEndian.Uint32(msg[12:])
+
+	var sets []Set
+	for msg = msg[HeaderLen:]; len(msg) > 0; {
+		if len(msg) < SetHeaderLen {
+			return header, nil, errors.New("truncated set header")
+		}
+		length := int(binary.BigEndian.Uint16(msg[2:]))
+		if length < SetHeaderLen || length > len(msg) {
+			return header, nil, errors.New("invalid set length")
+		}
+		sets = append(sets, Set{
+			ID:      binary.BigEndian.Uint16(msg[0:]),
+			Records: msg[SetHeaderLen:length],
+		})
+		msg = msg[length:]
+	}
+	return header, sets, nil
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipfix
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage(t *testing.T) {
+	template := Template{
+		ID: MinDataSetID,
+		Fields: []Field{
+			{SourceIPv4Address, 4},
+			{OctetDeltaCount, 8},
+			{UserName, VariableLength},
+		},
+	}
+	now := time.Unix(1600000000, 0)
+
+	m := NewMessage(nil, 7, 42, now)
+	m.AddTemplate(&template)
+	for i := 0; i < 2; i++ {
+		m.StartRecord(template.ID)
+		m.IPv4(net.IPv4(10, 0, 0, byte(i)))
+		m.Uint64(uint64(1000 + i))
+		m.String(strings.Repeat("a", 300*i))
+	}
+	msg := m.Bytes()
+
+	header, sets, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.ExportTime.Equal(now) || header.Sequence != 42 || header.Domain != 7 {
+		t.Errorf("unexpected header %+v", header)
+	}
+	if len(sets) != 2 || sets[0].ID != TemplateSetID || sets[1].ID != template.ID {
+		t.Fatalf("unexpected sets %+v", sets)
+	}
+
+	expected := []byte{1, 0, 0, 3, 0, 8, 0, 4, 0, 1, 0, 8, 1, 115, 0xff, 0xff}
+	if !bytes.Equal(sets[0].Records, expected) {
+		t.Errorf("template record %x, expected %x", sets[0].Records, expected)
+	}
+
+	records := sets[1].Records
+	if len(records) != 4+8+1+4+8+3+300 {
+		t.Fatalf("data records of %d bytes", len(records))
+	}
+	if !bytes.Equal(records[:13], []byte{10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0xe8, 0}) {
+		t.Errorf("unexpected first record %x", records[:13])
+	}
+	if !bytes.Equal(records[25:28], []byte{255, 1, 44}) {
+		t.Errorf("unexpected long string length %x", records[25:28])
+	}
+}
+
+func TestParseMessageInvalid(t *testing.T) {
+	msg := NewMessage(nil, 0, 0, time.Now()).Bytes()
+	if _, _, err := ParseMessage(msg[:HeaderLen-1]); err == nil {
+		t.Error("accepted truncated header")
+	}
+	msg = append(msg, 1, 0, 0, 8)
+	if _, _, err := ParseMessage(msg); err == nil {
+		t.Error("accepted message with inconsistent length")
+	}
+}
@@ -0,0 +1,192 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package keyagent implements an agent holding the static private key of a device
+// in a separate process, and a client delegating the static key operations of the device to it
+// over a Unix socket.
+//
+// Each request is a single byte operation followed by a public key,
+// each response a single byte status followed by a public key or shared secret:
+//
+//	request:  op (1) | public key (32)
+//	response: status (1) | result (32)
+//
+// OpPublicKey returns the public key of the agent, the public key of its request is ignored.
+// OpSharedSecret returns the shared secret of the private key with the public key of the request.
+// The agent refuses public keys resulting in an all-zero shared secret.
+package keyagent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	OpPublicKey    = 1
+	OpSharedSecret = 2
+)
+
+const (
+	StatusOK     = 0
+	StatusFailed = 1
+)
+
+const (
+	KeySize     = device.NoisePublicKeySize
+	MessageSize = 1 + KeySize
+)
+
+// RequestTimeout bounds each request, as the device waits for the agent during handshakes.
+const RequestTimeout = time.Second
+
+var ErrFailed = errors.New("keyagent: operation failed")
+
+// An Agent serves the static key operations with its private key.
+type Agent struct {
+	privateKey [KeySize]byte
+	publicKey  [KeySize]byte
+}
+
+// NewAgent returns an agent for the private key, which must be clamped.
+func NewAgent(privateKey device.NoisePrivateKey) *Agent {
+	agent := &Agent{privateKey: privateKey}
+	curve25519.ScalarBaseMult(&agent.publicKey, &agent.privateKey)
+	return agent
+}
+
+// Serve serves the connections accepted by the listener until it is closed.
+func (agent *Agent) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go agent.serveConn(conn)
+	}
+}
+
+func (agent *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var request, response [MessageSize]byte
+	for {
+		if _, err := io.ReadFull(conn, request[:]); err != nil {
+			return
+		}
+		agent.handle(&request, &response)
+		if _, err := conn.Write(response[:]); err != nil {
+			return
+		}
+	}
+}
+
+func (agent *Agent) handle(request, response *[MessageSize]byte) {
+	var result [KeySize]byte
+	defer func() {
+		copy(response[1:], result[:])
+		for i := range result {
+			result[i] = 0
+		}
+	}()
+
+	switch request[0] {
+	case OpPublicKey:
+		result = agent.publicKey
+		response[0] = StatusOK
+	case OpSharedSecret:
+		var publicKey [KeySize]byte
+		copy(publicKey[:], request[1:])
+		curve25519.ScalarMult(&result, &agent.privateKey, &publicKey)
+		response[0] = StatusOK
+		if result == [KeySize]byte{} {
+			response[0] = StatusFailed
+		}
+	default:
+		response[0] = StatusFailed
+	}
+}
+
+// A Client delegates the static key operations of a device to an agent,
+// it implements device.StaticKey.
+type Client struct {
+	mutex     sync.Mutex
+	path      string
+	conn      net.Conn // nil after a failure, redialed on the next request
+	publicKey device.NoisePublicKey
+}
+
+// Dial connects to the agent listening at path and obtains its public key.
+func Dial(path string) (*Client, error) {
+	client := &Client{path: path}
+	publicKey, err := client.request(OpPublicKey, device.NoisePublicKey{})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.publicKey = device.NoisePublicKey(publicKey)
+	return client, nil
+}
+
+func (client *Client) PublicKey() device.NoisePublicKey {
+	return client.publicKey
+}
+
+func (client *Client) SharedSecret(publicKey device.NoisePublicKey) ([device.NoisePublicKeySize]byte, error) {
+	return client.request(OpSharedSecret, publicKey)
+}
+
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.conn == nil {
+		return nil
+	}
+	err := client.conn.Close()
+	client.conn = nil
+	return err
+}
+
+func (client *Client) request(op byte, publicKey device.NoisePublicKey) (result [KeySize]byte, err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.conn == nil {
+		client.conn, err = net.Dial("unix", client.path)
+		if err != nil {
+			return
+		}
+	}
+
+	var request, response [MessageSize]byte
+	request[0] = op
+	copy(request[1:], publicKey[:])
+	err = client.conn.SetDeadline(time.Now().Add(RequestTimeout))
+	if err == nil {
+		_, err = client.conn.Write(request[:])
+	}
+	if err == nil {
+		_, err = io.ReadFull(client.conn, response[:])
+	}
+	if err != nil {
+		client.conn.Close()
+		client.conn = nil
+		return
+	}
+
+	if response[0] != StatusOK {
+		return result, ErrFailed
+	}
+	copy(result[:], response[1:])
+	for i := range response {
+		response[i] = 0
+	}
+	return result, nil
+}
@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package keyagent
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func newKey(t *testing.T) (sk device.NoisePrivateKey, pk device.NoisePublicKey) {
+	if _, err := rand.Read(sk[:]); err != nil {
+		t.Fatal(err)
+	}
+	sk[0] &= 248
+	sk[31] = (sk[31] & 127) | 64
+	curve25519.ScalarBaseMult((*[KeySize]byte)(&pk), (*[KeySize]byte)(&sk))
+	return
+}
+
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	sk, pk := newKey(t)
+	agent := NewAgent(sk)
+	serve := func() func() {
+		listener, err := Listen(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go agent.Serve(listener)
+		return func() { listener.Close() }
+	}
+	stop := serve()
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket not restricted to its owner: %v %v", info.Mode(), err)
+	}
+
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.PublicKey() != pk {
+		t.Error("public key of agent not obtained")
+	}
+
+	// shared secrets match those computed with the private key
+
+	remoteSK, remotePK := newKey(t)
+	ss, err := client.SharedSecret(remotePK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected [KeySize]byte
+	curve25519.ScalarMult(&expected, (*[KeySize]byte)(&remoteSK), (*[KeySize]byte)(&pk))
+	if ss != expected {
+		t.Error("shared secret does not match")
+	}
+
+	// low order points are refused
+
+	if _, err := client.SharedSecret(device.NoisePublicKey{}); err != ErrFailed {
+		t.Errorf("shared secret with zero public key not refused: %v", err)
+	}
+
+	// the client reconnects after the agent restarts
+
+	stop()
+	client.conn.Close()
+	if _, err := client.SharedSecret(remotePK); err == nil {
+		t.Error("shared secret obtained without agent")
+	}
+	os.Remove(path)
+	stop = serve()
+	defer stop()
+	if ss, err = client.SharedSecret(remotePK); err != nil || ss != expected {
+		t.Errorf("shared secret not obtained after agent restart: %v", err)
+	}
+}
+
+func TestAgentTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.sock")
+
+	// an agent not responding fails requests after the timeout
+
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+
+	start := time.Now()
+	if _, err := Dial(path); err == nil {
+		t.Fatal("request to unresponsive agent succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*RequestTimeout {
+		t.Errorf("request to unresponsive agent took %v", elapsed)
+	}
+}
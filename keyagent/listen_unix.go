@@ -0,0 +1,22 @@
+// +build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package keyagent
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// Listen creates a Unix socket at path accessible to its owner only.
+func Listen(path string) (net.Listener, error) {
+	oldUmask := unix.Umask(0177)
+	defer unix.Umask(oldUmask)
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,15 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2020 WireGuard LLC. All Rights Reserved.
+ */
+
+package keyagent
+
+import (
+	"net"
+)
+
+// Listen creates a Unix socket at path, accessible as permitted by the ACL of its directory.
+func Listen(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
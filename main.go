@@ -17,6 +17,7 @@ import (
 
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/keyagent"
 	"golang.zx2c4.com/wireguard/tun"
 )
 
@@ -29,6 +30,8 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	ENV_WG_KEYLOG_FILE        = "WG_KEYLOG_FILE"
+	ENV_WG_KEY_AGENT_SOCKET   = "WG_KEY_AGENT_SOCKET"
 )
 
 func printUsage() {
@@ -225,6 +228,33 @@ func main() {
 
 	device := device.NewDevice(tun, logger)
 
+	// log session keys for decrypting captures, only if explicitly requested
+
+	if keyLogPath := os.Getenv(ENV_WG_KEYLOG_FILE); keyLogPath != "" {
+		keyLog, err := os.OpenFile(keyLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			logger.Error.Println("Failed to open key log:", err)
+			os.Exit(ExitSetupFailed)
+		}
+		defer keyLog.Close()
+		device.SetKeyLogWriter(keyLog)
+	}
+
+	// delegate the static key operations to an agent holding the private key
+
+	if agentPath := os.Getenv(ENV_WG_KEY_AGENT_SOCKET); agentPath != "" {
+		agent, err := keyagent.Dial(agentPath)
+		if err != nil {
+			logger.Error.Println("Failed to connect to key agent:", err)
+			os.Exit(ExitSetupFailed)
+		}
+		defer agent.Close()
+		if err := device.SetStaticKey(agent); err != nil {
+			logger.Error.Println("Failed to delegate static key to key agent:", err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
 	logger.Info.Println("Device started")
 
 	errs := make(chan error)